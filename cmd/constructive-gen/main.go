@@ -0,0 +1,518 @@
+// Constructive-gen generates reflection-free functions to destructure and construct
+// structs with attr tags, and typed helpers to query for them. Given the type Person in
+// the current package, it generates:
+//
+//	func DestructPerson(x Person) ([]types.Claim, error)
+//	func ConstructPerson(x *Person, db types.Database, id types.ID) (bool, error)
+//	func PersonQuery() *PersonQueryBuilder
+//
+// which agree with destruct.DestructOnlyData and destruct.Construct. The query builder
+// has methods to select entities by each attr, e.g. NameIs, NameIn, and AgeBetween, and
+// to fetch the selected records.
+//
+// It is meant to be run by go generate, e.g.
+//
+//	//go:generate constructive-gen -type=Person,Pet
+//
+// Fields may be bools, strings, time.Times, builtin integers or floats, pointers to them,
+// or slices or sets of them; the fields of structs using other features of the destruct
+// package, e.g. struct refs, lists, value marshalers, or embedded structs, are rejected.
+package main
+
+import (
+	"flag"
+	"fmt"
+	"go/ast"
+	"go/format"
+	"go/parser"
+	"go/token"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+func main() {
+	log.SetFlags(0)
+	log.SetPrefix("constructive-gen: ")
+	typeNames := flag.String("type", "", "comma-separated list of type names; must be set")
+	output := flag.String("output", "", "output file name; default <type>_constructive.go")
+	flag.Parse()
+	if *typeNames == "" {
+		flag.Usage()
+		os.Exit(2)
+	}
+	names := strings.Split(*typeNames, ",")
+	dir := "."
+	if args := flag.Args(); len(args) > 0 {
+		dir = args[0]
+	}
+	if *output == "" {
+		*output = strings.ToLower(names[0]) + "_constructive.go"
+	}
+	path := filepath.Join(dir, *output)
+	src, err := generate(dir, names, filepath.Base(path))
+	if err != nil {
+		log.Fatal(err)
+	}
+	if err := ioutil.WriteFile(path, src, 0644); err != nil {
+		log.Fatal(err)
+	}
+}
+
+// generate returns the generated source for the named types of the package in the
+// directory, ignoring the output file.
+func generate(dir string, names []string, output string) ([]byte, error) {
+	fset := token.NewFileSet()
+	filter := func(info os.FileInfo) bool {
+		return !strings.HasSuffix(info.Name(), "_test.go") && info.Name() != output
+	}
+	pkgs, err := parser.ParseDir(fset, dir, filter, 0)
+	if err != nil {
+		return nil, err
+	}
+	if len(pkgs) != 1 {
+		return nil, fmt.Errorf("%d packages found in %s", len(pkgs), dir)
+	}
+	var pkg *ast.Package
+	for _, p := range pkgs {
+		pkg = p
+	}
+	specs := map[string]*ast.StructType{}
+	for _, file := range pkg.Files {
+		for _, decl := range file.Decls {
+			gen, ok := decl.(*ast.GenDecl)
+			if !ok || gen.Tok != token.TYPE {
+				continue
+			}
+			for _, spec := range gen.Specs {
+				ts := spec.(*ast.TypeSpec)
+				if st, ok := ts.Type.(*ast.StructType); ok {
+					specs[ts.Name.Name] = st
+				}
+			}
+		}
+	}
+	g := generator{pkg: pkg.Name}
+	for _, name := range names {
+		st, ok := specs[name]
+		if !ok {
+			return nil, fmt.Errorf("struct type %s not found", name)
+		}
+		model, err := parseStruct(name, st)
+		if err != nil {
+			return nil, err
+		}
+		g.generate(model)
+	}
+	var src strings.Builder
+	fmt.Fprintf(&src, "// Code generated by \"constructive-gen -type=%s\"; DO NOT EDIT.\n\n", strings.Join(names, ","))
+	fmt.Fprintf(&src, "package %s\n\nimport (\n", pkg.Name)
+	var imports []string
+	for imp := range g.imports {
+		imports = append(imports, imp)
+	}
+	sort.Strings(imports)
+	for _, imp := range imports {
+		fmt.Fprintf(&src, "\t%q\n", imp)
+	}
+	if len(imports) > 0 {
+		src.WriteString("\n")
+	}
+	src.WriteString("\t\"github.com/dball/constructive/pkg/destruct\"\n\t\"github.com/dball/constructive/pkg/types\"\n)\n")
+	src.WriteString(g.body.String())
+	formatted, err := format.Source([]byte(src.String()))
+	if err != nil {
+		return nil, fmt.Errorf("generated invalid source: %w", err)
+	}
+	return formatted, nil
+}
+
+// structModel describes a struct type with attr tags.
+type structModel struct {
+	name string
+	// id is the entity id field, if any.
+	id     *fieldModel
+	fields []fieldModel
+}
+
+// fieldModel describes a struct field that declares an attr.
+type fieldModel struct {
+	name  string
+	ident string
+	// kind is the name of the builtin type of the field's values, or "time.Time".
+	kind string
+	// shape is one of "scalar", "pointer", "slice", or "set".
+	shape     string
+	unique    bool
+	omitEmpty bool
+}
+
+var kinds = map[string]bool{
+	"bool": true, "string": true, "time.Time": true, "float32": true, "float64": true,
+	"int": true, "int8": true, "int16": true, "int32": true, "int64": true,
+	"uint": true, "uint8": true, "uint16": true, "uint32": true, "uint64": true,
+}
+
+func isInt(kind string) bool {
+	return strings.HasPrefix(kind, "int") || strings.HasPrefix(kind, "uint")
+}
+
+// parseStruct parses the fields of the struct type that declare attrs.
+func parseStruct(name string, st *ast.StructType) (model structModel, err error) {
+	model.name = name
+	namespace := ""
+	for _, field := range st.Fields.List {
+		tag := fieldTag(field)
+		if len(field.Names) == 1 && field.Names[0].Name == "_" {
+			if ns, ok := tag.Lookup("namespace"); ok {
+				namespace = ns
+			}
+		}
+	}
+	for _, field := range st.Fields.List {
+		tag := fieldTag(field)
+		attr, ok := tag.Lookup("attr")
+		if len(field.Names) == 0 {
+			return model, fmt.Errorf("%s: embedded structs are not supported", name)
+		}
+		if !ok {
+			continue
+		}
+		parts := strings.Split(attr, ",")
+		ident := parts[0]
+		if namespace != "" && !strings.Contains(ident, "/") {
+			ident = namespace + "/" + ident
+		}
+		for _, fieldName := range field.Names {
+			f := fieldModel{name: fieldName.Name, ident: ident}
+			for _, option := range parts[1:] {
+				switch option {
+				case "identity", "unique":
+					f.unique = true
+				case "omitempty":
+					f.omitEmpty = true
+				case "list", "component":
+					return model, fmt.Errorf("%s.%s: the %s option is not supported", name, f.name, option)
+				}
+			}
+			f.kind, f.shape, err = fieldKind(field.Type)
+			if err != nil {
+				return model, fmt.Errorf("%s.%s: %w", name, f.name, err)
+			}
+			if ident == "sys/db/id" {
+				if f.shape != "scalar" || !isInt(f.kind) {
+					return model, fmt.Errorf("%s.%s: entity id fields must be integers", name, f.name)
+				}
+				id := f
+				model.id = &id
+				continue
+			}
+			model.fields = append(model.fields, f)
+		}
+	}
+	return
+}
+
+func fieldTag(field *ast.Field) reflect.StructTag {
+	if field.Tag == nil {
+		return ""
+	}
+	tag, err := strconv.Unquote(field.Tag.Value)
+	if err != nil {
+		return ""
+	}
+	return reflect.StructTag(tag)
+}
+
+// fieldKind returns the kind and shape of the field type.
+func fieldKind(expr ast.Expr) (kind string, shape string, err error) {
+	shape = "scalar"
+	switch typed := expr.(type) {
+	case *ast.StarExpr:
+		shape = "pointer"
+		expr = typed.X
+	case *ast.ArrayType:
+		if typed.Len == nil {
+			shape = "slice"
+			expr = typed.Elt
+		}
+	case *ast.MapType:
+		if st, ok := typed.Value.(*ast.StructType); ok && len(st.Fields.List) == 0 {
+			shape = "set"
+			expr = typed.Key
+		}
+	}
+	switch typed := expr.(type) {
+	case *ast.Ident:
+		kind = typed.Name
+	case *ast.SelectorExpr:
+		if x, ok := typed.X.(*ast.Ident); ok {
+			kind = x.Name + "." + typed.Sel.Name
+		}
+	}
+	if !kinds[kind] {
+		err = fmt.Errorf("unsupported field type")
+	}
+	return
+}
+
+// generator accumulates the generated declarations and the imports they require.
+type generator struct {
+	pkg     string
+	body    strings.Builder
+	imports map[string]bool
+	// fieldName and zero are the qualified name of the current field and the zero result
+	// returned with its errors.
+	fieldName string
+	zero      string
+}
+
+func (g *generator) printf(format string, args ...interface{}) {
+	fmt.Fprintf(&g.body, format, args...)
+}
+
+func (g *generator) use(imp string) {
+	if g.imports == nil {
+		g.imports = map[string]bool{}
+	}
+	g.imports[imp] = true
+}
+
+func (g *generator) generate(model structModel) {
+	g.generateDestruct(model)
+	g.generateConstruct(model)
+	g.generateQuery(model)
+}
+
+// field begins generating the code for the struct's field, whose errors are returned with
+// the given zero result.
+func (g *generator) field(model structModel, f fieldModel, zero string) {
+	g.fieldName = fmt.Sprintf("%s.%s.%s", g.pkg, model.name, f.name)
+	g.zero = zero
+}
+
+// overflow returns the statement that returns the current field's overflow error, naming
+// the field as the destruct package does.
+func (g *generator) overflow() string {
+	g.use("fmt")
+	return fmt.Sprintf("return %s, fmt.Errorf(%q, types.ErrAttrFieldOverflow)", g.zero, g.fieldName+": %w")
+}
+
+// value returns the statements that set v to the value of the expression of the kind.
+func (g *generator) value(kind string, expr string) string {
+	switch kind {
+	case "bool":
+		return fmt.Sprintf("v := types.Bool(%s)\n", expr)
+	case "string":
+		return fmt.Sprintf("v := types.String(%s)\n", expr)
+	case "time.Time":
+		return fmt.Sprintf("v := types.Inst(%s)\n", expr)
+	case "float32", "float64":
+		return fmt.Sprintf("v := types.Float(%s)\n", expr)
+	case "uint", "uint64":
+		g.use("math")
+		return fmt.Sprintf("if %s > math.MaxInt64 {\n%s\n}\nv := types.Int(%s)\n", expr, g.overflow(), expr)
+	}
+	return fmt.Sprintf("v := types.Int(%s)\n", expr)
+}
+
+// zero returns the zero value of the kind.
+func zero(kind string) string {
+	switch kind {
+	case "bool":
+		return "false"
+	case "string":
+		return `""`
+	case "time.Time":
+		return "(time.Time{})"
+	}
+	return "0"
+}
+
+func (g *generator) generateDestruct(model structModel) {
+	g.printf("\n// Destruct%s returns the claims about the %s's attrs, as destruct.DestructOnlyData,\n// without reflection.\n", model.name, model.name)
+	g.printf("func Destruct%s(x %s) ([]types.Claim, error) {\n", model.name, model.name)
+	g.printf("var e types.EWriteRef\n")
+	if model.id != nil {
+		if strings.HasPrefix(model.id.kind, "int") {
+			g.field(model, *model.id, "nil")
+			g.printf("if x.%s < 0 {\n%s\n}\n", model.id.name, g.overflow())
+		}
+		g.printf("if x.%s != 0 {\ne = types.ID(x.%s)\n} else {\ne = destruct.NewTempID()\n}\n", model.id.name, model.id.name)
+	} else {
+		g.printf("e = destruct.NewTempID()\n")
+	}
+	g.printf("claims := make([]types.Claim, 0, %d)\n", len(model.fields))
+	for _, f := range model.fields {
+		retract := fmt.Sprintf("claims = append(claims, types.Claim{E: e, A: types.Ident(%q), Retract: true})\n", f.ident)
+		claim := fmt.Sprintf("claims = append(claims, types.Claim{E: e, A: types.Ident(%q), V: v})\n", f.ident)
+		if f.unique {
+			claim = "if !v.IsEmpty() {\n" + claim + "}\n"
+		}
+		g.printf("// %s\n", f.name)
+		g.field(model, f, "nil")
+		switch f.shape {
+		case "pointer":
+			g.printf("if x.%s == nil {\n%s} else {\n%s%s}\n", f.name, retract, g.value(f.kind, "*x."+f.name), claim)
+		case "slice":
+			g.printf("if x.%s != nil {\n%sfor _, el := range x.%s {\n%s%s}\n}\n", f.name, retract, f.name, g.value(f.kind, "el"), claim)
+		case "set":
+			g.use("sort")
+			g.printf("if x.%s != nil {\n%s", f.name, retract)
+			g.printf("vs := make([]types.Value, 0, len(x.%s))\nfor el := range x.%s {\n%svs = append(vs, v)\n}\n", f.name, f.name, g.value(f.kind, "el"))
+			g.printf("sort.Slice(vs, func(i, j int) bool { return types.Compare(vs[i], vs[j]) < 0 })\n")
+			g.printf("for _, value := range vs {\nv := value.(types.VRef)\n")
+			if f.unique {
+				g.printf("if !value.IsEmpty() {\nclaims = append(claims, types.Claim{E: e, A: types.Ident(%q), V: v})\n}\n", f.ident)
+			} else {
+				g.printf("claims = append(claims, types.Claim{E: e, A: types.Ident(%q), V: v})\n", f.ident)
+			}
+			g.printf("}\n}\n")
+		default:
+			if f.kind == "time.Time" {
+				g.use("time")
+			}
+			if f.omitEmpty {
+				g.printf("if x.%s == %s {\n%s} else {\n%s%s}\n", f.name, zero(f.kind), retract, g.value(f.kind, "x."+f.name), claim)
+			} else {
+				g.printf("{\n%s%s}\n", g.value(f.kind, "x."+f.name), claim)
+			}
+		}
+	}
+	g.printf("return claims, nil\n}\n")
+}
+
+// set returns the statements that set the target of the kind to the value of the datum.
+func (g *generator) set(kind string, target string) string {
+	switch kind {
+	case "bool":
+		return fmt.Sprintf("%s = bool(datum.V.(types.Bool))\n", target)
+	case "string":
+		return fmt.Sprintf("%s = string(datum.V.(types.String))\n", target)
+	case "time.Time":
+		g.use("time")
+		return fmt.Sprintf("%s = time.Time(datum.V.(types.Inst))\n", target)
+	case "float64":
+		return fmt.Sprintf("%s = float64(datum.V.(types.Float))\n", target)
+	case "float32":
+		g.use("math")
+		return fmt.Sprintf("f := float64(datum.V.(types.Float))\nif a := math.Abs(f); a > math.MaxFloat32 && a <= math.MaxFloat64 {\n%s\n}\n%s = float32(f)\n", g.overflow(), target)
+	}
+	return g.setInt(kind, "int64(datum.V.(types.Int))", target)
+}
+
+// setInt returns the statements that set the target of the integer kind to the int64
+// expression, unless it overflows.
+func (g *generator) setInt(kind string, expr string, target string) string {
+	var check string
+	switch kind {
+	case "int64":
+	case "uint64":
+		check = "n < 0"
+	case "int":
+		check = "n < math.MinInt || n > math.MaxInt"
+	case "uint":
+		check = "n < 0 || uint64(n) > math.MaxUint"
+	default:
+		bits := strings.TrimLeft(kind, "uint")
+		if strings.HasPrefix(kind, "uint") {
+			check = fmt.Sprintf("n < 0 || n > math.MaxUint%s", bits)
+		} else {
+			check = fmt.Sprintf("n < math.MinInt%s || n > math.MaxInt%s", bits, bits)
+		}
+	}
+	if check == "" {
+		return fmt.Sprintf("%s = %s\n", target, expr)
+	}
+	g.use("math")
+	return fmt.Sprintf("n := %s\nif %s {\n%s\n}\n%s = %s(n)\n", expr, check, g.overflow(), target, kind)
+}
+
+func (g *generator) generateConstruct(model structModel) {
+	g.printf("\n// Construct%s populates the %s from the datums about the entity, as destruct.Construct,\n// without reflection.\n", model.name, model.name)
+	g.printf("func Construct%s(x *%s, db types.Database, id types.ID) (bool, error) {\n", model.name, model.name)
+	if model.id != nil {
+		g.field(model, *model.id, "false")
+		g.printf("{\n%s}\n", g.setInt(model.id.kind, "int64(id)", "x."+model.id.name))
+	}
+	for i, f := range model.fields {
+		g.printf("a%d := db.AttrByIdent(%q).ID\n", i, f.ident)
+		if f.shape != "scalar" {
+			g.printf("if a%d != 0 {\nx.%s = nil\n}\n", i, f.name)
+		}
+	}
+	g.printf("found := false\niter := db.Select(types.Selection{E: id})\nfor iter.Next() {\nfound = true\n")
+	if len(model.fields) > 0 {
+		g.printf("datum := iter.Value().(types.Datum)\nswitch datum.A {\n")
+		for i, f := range model.fields {
+			g.printf("case a%d:\n", i)
+			g.field(model, f, "false")
+			switch f.shape {
+			case "pointer":
+				g.printf("var el %s\n%sx.%s = &el\n", f.kind, g.set(f.kind, "el"), f.name)
+			case "slice":
+				g.printf("var el %s\n%sx.%s = append(x.%s, el)\n", f.kind, g.set(f.kind, "el"), f.name, f.name)
+			case "set":
+				g.printf("if x.%s == nil {\nx.%s = map[%s]struct{}{}\n}\n", f.name, f.name, f.kind)
+				g.printf("var el %s\n%sx.%s[el] = struct{}{}\n", f.kind, g.set(f.kind, "el"), f.name)
+			default:
+				g.printf("%s", g.set(f.kind, "x."+f.name))
+			}
+		}
+		g.printf("}\n")
+	}
+	g.printf("}\nreturn found, nil\n}\n")
+}
+
+// valueExpr returns the expression converting the expression of the kind to a value.
+func valueExpr(kind string, expr string) string {
+	switch kind {
+	case "bool":
+		return fmt.Sprintf("types.Bool(%s)", expr)
+	case "string":
+		return fmt.Sprintf("types.String(%s)", expr)
+	case "time.Time":
+		return fmt.Sprintf("types.Inst(%s)", expr)
+	case "float32", "float64":
+		return fmt.Sprintf("types.Float(%s)", expr)
+	}
+	return fmt.Sprintf("types.Int(%s)", expr)
+}
+
+func (g *generator) generateQuery(model structModel) {
+	builder := model.name + "QueryBuilder"
+	g.printf("\n// %s builds selections of %s entities by their attrs.\n", builder, model.name)
+	g.printf("type %s struct {\nselections []types.Selection\n}\n", builder)
+	g.printf("\n// %sQuery begins a query for %s entities.\n", model.name, model.name)
+	g.printf("func %sQuery() *%s {\nreturn &%s{}\n}\n", model.name, builder, builder)
+	for _, f := range model.fields {
+		if f.kind == "time.Time" {
+			g.use("time")
+		}
+		g.printf("\n// %sIs selects the entities whose %s is the value.\n", f.name, f.ident)
+		g.printf("func (q *%s) %sIs(v %s) *%s {\n", builder, f.name, f.kind, builder)
+		g.printf("q.selections = append(q.selections, types.Selection{A: types.Ident(%q), V: %s})\nreturn q\n}\n", f.ident, valueExpr(f.kind, "v"))
+		g.printf("\n// %sIn selects the entities whose %s is any of the values.\n", f.name, f.ident)
+		g.printf("func (q *%s) %sIn(vs ...%s) *%s {\n", builder, f.name, f.kind, builder)
+		g.printf("set := make(types.VSet, len(vs))\nfor _, v := range vs {\nset[%s] = types.Void{}\n}\n", valueExpr(f.kind, "v"))
+		g.printf("q.selections = append(q.selections, types.Selection{A: types.Ident(%q), V: set})\nreturn q\n}\n", f.ident)
+		if f.kind == "bool" {
+			continue
+		}
+		g.printf("\n// %sBetween selects the entities whose %s is between the values, inclusive.\n", f.name, f.ident)
+		g.printf("func (q *%s) %sBetween(min %s, max %s) *%s {\n", builder, f.name, f.kind, f.kind, builder)
+		g.printf("q.selections = append(q.selections, types.Selection{A: types.Ident(%q), V: types.VRange{Min: %s, Max: %s}})\nreturn q\n}\n", f.ident, valueExpr(f.kind, "min"), valueExpr(f.kind, "max"))
+	}
+	g.printf("\n// Selections returns the query's selections.\n")
+	g.printf("func (q *%s) Selections() []types.Selection {\nreturn q.selections\n}\n", builder)
+	g.printf("\n// Entities returns the ids of the entities matching all of the query's selections, in order.\n")
+	g.printf("func (q *%s) Entities(db types.Database) []types.ID {\nreturn destruct.SelectEntities(db, q.selections...)\n}\n", builder)
+	g.printf("\n// Fetch returns the records of the entities matching all of the query's selections.\n")
+	g.printf("func (q *%s) Fetch(db types.Database) ([]%s, error) {\n", builder, model.name)
+	g.printf("ids := q.Entities(db)\nrecords := make([]%s, len(ids))\nfor i, id := range ids {\nif _, err := Construct%s(&records[i], db, id); err != nil {\nreturn nil, err\n}\n}\nreturn records, nil\n}\n", model.name, model.name)
+}
@@ -0,0 +1,37 @@
+package main
+
+import (
+	"go/ast"
+	"go/parser"
+	"io/ioutil"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestGenerate(t *testing.T) {
+	expected, err := ioutil.ReadFile("../../internal/gentest/person_constructive.go")
+	require.NoError(t, err)
+	actual, err := generate("../../internal/gentest", []string{"Person", "Gadget"}, "person_constructive.go")
+	require.NoError(t, err)
+	assert.Equal(t, string(expected), string(actual), "run go generate ./internal/gentest")
+}
+
+func TestUnsupportedFields(t *testing.T) {
+	cases := map[string]string{
+		"struct ref": "struct { Friend Person `attr:\"person/friend\"` }",
+		"list":       "struct { Names []string `attr:\"person/names,list\"` }",
+		"named type": "struct { Cents Money `attr:\"person/cents\"` }",
+		"embedded":   "struct { Person }",
+		"entity id":  "struct { ID string `attr:\"sys/db/id\"` }",
+	}
+	for name, src := range cases {
+		t.Run(name, func(t *testing.T) {
+			expr, err := parser.ParseExpr(src)
+			require.NoError(t, err)
+			_, err = parseStruct("Record", expr.(*ast.StructType))
+			assert.Error(t, err)
+		})
+	}
+}
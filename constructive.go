@@ -9,12 +9,33 @@ import (
 
 // Connection is a writable constructive database.
 type Connection interface {
-	// Write atomically records the given records and returns the transaction.
+	// Write atomically records the given records and returns the transaction. Records
+	// wrapped by TxMeta are recorded as metadata about the transaction itself.
 	Write(records ...interface{}) (Transaction, error)
-	// Erase atomically erases the given records and returns the transaction.
+	// WriteClaims atomically writes the claims, e.g. those invoking transaction functions,
+	// and returns the transaction.
+	WriteClaims(claims ...types.Claim) (Transaction, error)
+	// Erase atomically erases the entities of the given records, as RetractEntity, and
+	// returns the transaction.
 	Erase(records ...interface{}) (Transaction, error)
+	// RetractEntity atomically retracts every datum about the entity, every ref to it, and
+	// its components, and returns the transaction.
+	RetractEntity(eref types.EWriteRef) (Transaction, error)
 	// Read returns a snapshot of the database.
 	Read() Database
+	// Listen calls the listener with a report of each transaction subsequently written,
+	// returning a function that stops the listener. Listeners must not write to the
+	// connection, nor start or stop listeners, subscriptions, or watches.
+	Listen(listener func(types.TxReport)) (stop func())
+	// Subscribe delivers the reports of the transactions subsequently written with changes
+	// matching the filter, returning a function that cancels the subscription. A subscriber
+	// that falls so far behind that its channel fills is ended, closing the channel.
+	Subscribe(filter types.TxFilter) (reports <-chan types.TxReport, cancel func())
+	// BulkLoader begins a bulk load of records into the connection.
+	BulkLoader() *BulkLoader
+	// Register registers a transaction function under the given user ident, replacing any
+	// function previously registered under it. Claims whose Fn is the ident invoke it.
+	Register(ident types.Ident, fn types.TxFn) error
 }
 
 type connection struct {
@@ -22,35 +43,144 @@ type connection struct {
 }
 
 func (conn connection) Write(records ...interface{}) (Transaction, error) {
-	claims := destruct.Destruct(records...)
-	txn, err := conn.connection.Write(types.Request{Claims: claims})
+	claims, err := destructRecords(records)
 	if err != nil {
 		return Transaction{}, err
 	}
-	return Transaction{ID: txn.ID, NewIDs: txn.NewIDs, Database: db{txn.Database}}, nil
+	return wrapTransaction(conn.connection.Write(types.Request{Claims: claims}))
 }
 
-func (conn connection) Erase(records ...interface{}) (Transaction, error) {
-	claims := destruct.DestructOnlyData(records...)
-	for i, claim := range claims {
-		claim.Retract = true
-		claims[i] = claim
+func (conn connection) WriteClaims(claims ...types.Claim) (Transaction, error) {
+	return wrapTransaction(conn.connection.Write(types.Request{Claims: claims}))
+}
+
+// txMeta wraps a record of transaction metadata.
+type txMeta struct {
+	record interface{}
+}
+
+// TxMeta wraps a record to be written as metadata about the transaction that writes it,
+// e.g. its author or reason. The transaction's Fetch populates such records.
+func TxMeta(record interface{}) interface{} {
+	return txMeta{record}
+}
+
+// destructRecords destructures the records into claims, destructuring transaction
+// metadata records onto the transaction.
+func destructRecords(records []interface{}) ([]types.Claim, error) {
+	var claims []types.Claim
+	data := make([]interface{}, 0, len(records))
+	for _, record := range records {
+		meta, ok := record.(txMeta)
+		if ok {
+			mclaims, err := destruct.DestructEntity(types.TxnID{}, meta.record)
+			if err != nil {
+				return nil, err
+			}
+			claims = append(claims, mclaims...)
+		} else {
+			data = append(data, record)
+		}
 	}
-	txn, err := conn.connection.Write(types.Request{Claims: claims})
+	if len(data) > 0 {
+		dclaims, err := destruct.Destruct(data...)
+		if err != nil {
+			return nil, err
+		}
+		claims = append(dclaims, claims...)
+	}
+	return claims, nil
+}
+
+func (conn connection) Erase(records ...interface{}) (Transaction, error) {
+	refs, rclaims, err := destruct.DestructRecords(records...)
 	if err != nil {
 		return Transaction{}, err
 	}
-	return Transaction{ID: txn.ID, NewIDs: txn.NewIDs, Database: db{txn.Database}}, nil
+	// Only the records' own entities are retracted, identified by their claims if they have
+	// no entity ids. The entities to which they refer are left alone, but for components,
+	// which the retractions of their entities retract in turn.
+	entities := make(map[types.EWriteRef]types.Void, len(refs))
+	claims := make([]types.Claim, 0, len(rclaims)+len(refs))
+	for _, ref := range refs {
+		entities[ref] = types.Void{}
+	}
+	for _, claim := range rclaims {
+		if _, ok := entities[claim.E]; !ok {
+			continue
+		}
+		if _, ok := claim.V.(types.TempID); ok {
+			continue
+		}
+		claim.Retract = true
+		claims = append(claims, claim)
+	}
+	for _, ref := range refs {
+		if _, ok := entities[ref]; ok {
+			delete(entities, ref)
+			claims = append(claims, types.Claim{E: ref, Retract: true})
+		}
+	}
+	return wrapTransaction(conn.connection.Write(types.Request{Claims: claims}))
+}
+
+func (conn connection) RetractEntity(eref types.EWriteRef) (Transaction, error) {
+	claims := []types.Claim{{E: eref, Retract: true}}
+	return wrapTransaction(conn.connection.Write(types.Request{Claims: claims}))
 }
 
 func (conn connection) Read() Database {
 	return db{conn.connection.Read()}
 }
 
+func (conn connection) Listen(listener func(types.TxReport)) func() {
+	return conn.connection.Listen(listener)
+}
+
+func (conn connection) Subscribe(filter types.TxFilter) (<-chan types.TxReport, func()) {
+	return conn.connection.Subscribe(filter)
+}
+
+func (conn connection) BulkLoader() *BulkLoader {
+	return &BulkLoader{loader: conn.connection.BulkLoader()}
+}
+
+func (conn connection) Register(ident types.Ident, fn types.TxFn) error {
+	return conn.connection.Register(ident, fn)
+}
+
 func OpenConnection() Connection {
 	return connection{connection: database.OpenConnection()}
 }
 
+// BulkLoader loads many records into a connection in a single transaction, much more
+// quickly than writing them would. Records may only assert values, and are validated in
+// batches as they are added. The load fails if the connection is written before it
+// completes.
+type BulkLoader struct {
+	loader types.BulkLoader
+}
+
+// Add adds the records to the load. Once a record is rejected, the load fails.
+func (loader *BulkLoader) Add(records ...interface{}) error {
+	claims, err := destructRecords(records)
+	if err != nil {
+		return err
+	}
+	return loader.loader.Add(claims...)
+}
+
+// AddClaims adds the claims to the load. Once a claim is rejected, the load fails.
+func (loader *BulkLoader) AddClaims(claims ...types.Claim) error {
+	return loader.loader.Add(claims...)
+}
+
+// Load completes the load and returns its transaction, whose NewIDs include every tempid
+// in the load.
+func (loader *BulkLoader) Load() (Transaction, error) {
+	return wrapTransaction(loader.loader.Load())
+}
+
 // Transaction represents a successful recording of records or datums.
 type Transaction struct {
 	// ID is the id of the transaction entity.
@@ -61,11 +191,24 @@ type Transaction struct {
 	Database Database
 }
 
-func (txn Transaction) Fetch(ref interface{}) {
-	ok := txn.Database.FetchByID(ref, txn.ID)
+func wrapTransaction(txn types.Transaction, err error) (Transaction, error) {
+	if err != nil {
+		return Transaction{}, err
+	}
+	return Transaction{ID: txn.ID, NewIDs: txn.NewIDs, Database: db{txn.Database}}, nil
+}
+
+// Fetch populates the ref's struct from the datums about the transaction entity,
+// including those recorded from TxMeta records.
+func (txn Transaction) Fetch(ref interface{}) error {
+	ok, err := txn.Database.FetchByID(ref, txn.ID)
+	if err != nil {
+		return err
+	}
 	if !ok {
 		panic("Corruption: transaction not found in database")
 	}
+	return nil
 }
 
 // Database is a stable snapshot of data.
@@ -77,8 +220,26 @@ type Database interface {
 	// a unique record, using the entity id field, then any unique attr fields. Exactly
 	// one of these must have a non-empty value, otherwise this returns false. If a match
 	// is specified and found, the ref's struct's attr fields are set from the selected datums.
-	Fetch(ref interface{}) bool
-	FetchByID(ref interface{}, id types.ID) bool
+	// Refs to structs with fields that cannot represent their values are invalid.
+	Fetch(ref interface{}) (bool, error)
+	// FetchByID populates the ref's struct from the datums about the entity, as Fetch.
+	FetchByID(ref interface{}, id types.ID) (bool, error)
+	// AsOf returns a view of the database as it was immediately after the given transaction,
+	// which may be given as a transaction id or an instant.
+	AsOf(t types.TRef) Database
+	// Since returns a view of the database including only the datums asserted after the
+	// given transaction, which may be given as a transaction id or an instant.
+	Since(t types.TRef) Database
+	// History returns a view of every datum ever asserted or retracted in the database.
+	History() HistoryDatabase
+	// With returns the transaction that would result from writing the given records to
+	// the database, without changing the database or its connection.
+	With(records ...interface{}) (Transaction, error)
+	// Watch delivers the datums matching the selection in the database, then again whenever
+	// a transaction subsequently written to its connection changes them, returning a
+	// function that cancels the watch. A watcher that falls behind receives only the latest
+	// results.
+	Watch(sel types.Selection) (results <-chan []types.Datum, cancel func())
 	Dump() interface{}
 }
 
@@ -90,14 +251,72 @@ func (db db) Query(exemplar interface{}, selections ...types.Selection) *iterato
 	panic("TODO actually do, but also: maybe this takes a slice of ref and selections that are structs with field tagged constraint values")
 }
 
-func (db db) Fetch(ref interface{}) bool {
+func (db db) Fetch(ref interface{}) (bool, error) {
 	return destruct.Fetch(ref, db.database)
 }
 
-func (db db) FetchByID(ref interface{}, id types.ID) bool {
+func (db db) FetchByID(ref interface{}, id types.ID) (bool, error) {
 	return destruct.Construct(ref, db.database, id)
 }
 
+func (d db) AsOf(t types.TRef) Database {
+	return db{d.database.AsOf(t)}
+}
+
+func (d db) Since(t types.TRef) Database {
+	return db{d.database.Since(t)}
+}
+
+func (db db) History() HistoryDatabase {
+	return history{db.database.History()}
+}
+
+func (db db) With(records ...interface{}) (Transaction, error) {
+	claims, err := destructRecords(records)
+	if err != nil {
+		return Transaction{}, err
+	}
+	return wrapTransaction(db.database.With(types.Request{Claims: claims}))
+}
+
+func (db db) Watch(sel types.Selection) (<-chan []types.Datum, func()) {
+	return db.database.Watch(sel)
+}
+
 func (db db) Dump() interface{} {
 	return db.database.Dump()
 }
+
+// HistoryDatabase is a view of every datum ever asserted or retracted in a database.
+type HistoryDatabase interface {
+	// Select returns an iterator of the types.Change values asserting or retracting the
+	// datums matching the selection.
+	Select(selection types.Selection) *iterator.Iterator
+	// AsOf returns a view of the changes made in or before the given transaction, which
+	// may be given as a transaction id or an instant.
+	AsOf(t types.TRef) HistoryDatabase
+	// Since returns a view of the changes made after the given transaction, which may be
+	// given as a transaction id or an instant.
+	Since(t types.TRef) HistoryDatabase
+	Dump() interface{}
+}
+
+type history struct {
+	database types.HistoryDatabase
+}
+
+func (h history) Select(selection types.Selection) *iterator.Iterator {
+	return h.database.Select(selection)
+}
+
+func (h history) AsOf(t types.TRef) HistoryDatabase {
+	return history{h.database.AsOf(t)}
+}
+
+func (h history) Since(t types.TRef) HistoryDatabase {
+	return history{h.database.Since(t)}
+}
+
+func (h history) Dump() interface{} {
+	return h.database.Dump()
+}
@@ -1,9 +1,14 @@
 package constructive
 
 import (
+	"encoding/hex"
+	"fmt"
+	"reflect"
 	"testing"
 	"time"
 
+	"github.com/dball/constructive/pkg/destruct"
+	"github.com/dball/constructive/pkg/sys"
 	"github.com/dball/constructive/pkg/types"
 	"github.com/stretchr/testify/assert"
 	"github.com/stretchr/testify/require"
@@ -26,6 +31,20 @@ type Txn struct {
 	At time.Time `attr:"sys/tx/at"`
 }
 
+// fetch fetches the ref's struct from the database, requiring no error.
+func fetch(t *testing.T, db Database, ref interface{}) bool {
+	ok, err := db.Fetch(ref)
+	require.NoError(t, err)
+	return ok
+}
+
+// fetchByID fetches the ref's struct from the database by id, requiring no error.
+func fetchByID(t *testing.T, db Database, ref interface{}, id types.ID) bool {
+	ok, err := db.FetchByID(ref, id)
+	require.NoError(t, err)
+	return ok
+}
+
 func TestEverything(t *testing.T) {
 	conn := OpenConnection()
 
@@ -36,39 +55,44 @@ func TestEverything(t *testing.T) {
 
 	// populates the attribute fields of a record identified by a unique attr
 	donald := Person{Name: "Donald"}
-	ok := db.Fetch(&donald)
+	ok, err := db.Fetch(&donald)
+	require.NoError(t, err)
 	require.True(t, ok)
 	assert.Equal(t, 48, donald.Age)
 	assert.Positive(t, donald.ID)
 
 	// populates the attribute fields of a different type of struct
 	named := Named{Name: "Donald"}
-	ok = db.Fetch(&named)
+	ok, err = db.Fetch(&named)
+	require.NoError(t, err)
 	assert.Equal(t, 48, named.Age)
 	require.True(t, ok)
 
 	// fails for a record without the referenced, identified entity
 	missing := Person{Name: "Leah"}
-	ok = db.Fetch(&missing)
+	ok, err = db.Fetch(&missing)
+	require.NoError(t, err)
 	require.False(t, ok)
 
 	// accepts another record
 	_, err = conn.Write(Person{Name: "Stephen", Age: 44})
 	require.NoError(t, err)
 	stephen := Person{Name: "Stephen"}
-	ok = conn.Read().Fetch(&stephen)
+	ok, err = conn.Read().Fetch(&stephen)
+	require.NoError(t, err)
 	require.True(t, ok)
 	assert.Equal(t, 44, stephen.Age)
 
 	// populates a record identified by id
 	donald2 := Person{ID: donald.ID}
-	ok = db.Fetch(&donald2)
+	ok, err = db.Fetch(&donald2)
+	require.NoError(t, err)
 	require.True(t, ok)
 	assert.Equal(t, donald, donald2)
 
 	// transaction can fetch its attributes
 	txnObject := Txn{}
-	txn.Fetch(&txnObject)
+	require.NoError(t, txn.Fetch(&txnObject))
 	assert.NotEmpty(t, txnObject.At)
 	assert.Equal(t, txn.ID, types.ID(txnObject.ID))
 
@@ -76,21 +100,132 @@ func TestEverything(t *testing.T) {
 	txn, err = conn.Erase(Person{Name: "Donald"})
 	require.NoError(t, err)
 	p := Person{Name: "Donald"}
-	ok = txn.Database.Fetch(&p)
+	ok, err = txn.Database.Fetch(&p)
+	require.NoError(t, err)
 	assert.False(t, ok)
 
 	// no field attributes are left behind
 	p = Person{ID: donald.ID}
-	ok = txn.Database.Fetch(&p)
+	ok, err = txn.Database.Fetch(&p)
+	require.NoError(t, err)
 	assert.False(t, ok)
 }
 
+func TestWith(t *testing.T) {
+	conn := OpenConnection()
+	_, err := conn.Write(Person{Name: "Donald", Age: 48})
+	require.NoError(t, err)
+	db := conn.Read()
+	txn, err := db.With(Person{Name: "Donald", Age: 49})
+	require.NoError(t, err)
+	p := Person{Name: "Donald"}
+	require.True(t, fetch(t, txn.Database, &p))
+	assert.Equal(t, 49, p.Age)
+	p = Person{Name: "Donald"}
+	require.True(t, fetch(t, conn.Read(), &p))
+	assert.Equal(t, 48, p.Age)
+}
+
+func TestRetractEntity(t *testing.T) {
+	conn := OpenConnection()
+	_, err := conn.Write(Person{Name: "Donald", Age: 48}, Person{Name: "Stephen", Age: 44})
+	require.NoError(t, err)
+	txn, err := conn.RetractEntity(types.LookupRef{A: types.Ident("person/name"), V: types.String("Donald")})
+	require.NoError(t, err)
+	assert.False(t, fetch(t, txn.Database, &Person{Name: "Donald"}))
+	assert.True(t, fetch(t, txn.Database, &Person{Name: "Stephen"}))
+}
+
+func TestTxFns(t *testing.T) {
+	conn := OpenConnection()
+	_, err := conn.Write(Person{Name: "Donald", Age: 48})
+	require.NoError(t, err)
+	require.NoError(t, conn.Register(types.Ident("person/birthday"), func(db types.Database, claim types.Claim) ([]types.Claim, error) {
+		person := Person{}
+		if _, err := destruct.Construct(&person, db, db.ResolveEReadRef(claim.E.(types.EReadRef))); err != nil {
+			return nil, err
+		}
+		return []types.Claim{{E: claim.E, A: types.Ident("person/age"), V: types.Int(person.Age + 1)}}, nil
+	}))
+	donald := types.LookupRef{A: types.Ident("person/name"), V: types.String("Donald")}
+	txn, err := conn.WriteClaims(types.Claim{E: donald, Fn: types.Ident("person/birthday")})
+	require.NoError(t, err)
+	person := Person{Name: "Donald"}
+	require.True(t, fetch(t, txn.Database, &person))
+	assert.Equal(t, 49, person.Age)
+	assert.ErrorIs(t, conn.Register(types.Ident("sys/birthday"), nil), types.ErrInvalidUserIdent)
+}
+
+func TestHistory(t *testing.T) {
+	conn := OpenConnection()
+	txn1, err := conn.Write(Person{Name: "Donald", Age: 48})
+	require.NoError(t, err)
+	txn2, err := conn.Write(Person{Name: "Donald", Age: 49})
+	require.NoError(t, err)
+	db := conn.(connection).connection.Read()
+	donald := db.ResolveEReadRef(types.LookupRef{A: types.Ident("person/name"), V: types.String("Donald")})
+	age := db.AttrByIdent("person/age").ID
+	var changes []types.Change
+	iter := txn2.Database.History().Since(txn1.ID).Select(types.Selection{E: donald, A: age})
+	for iter.Next() {
+		changes = append(changes, iter.Value().(types.Change))
+	}
+	require.Len(t, changes, 2)
+	assert.Equal(t, types.Int(48), changes[0].V)
+	assert.False(t, changes[0].Added)
+	assert.Equal(t, types.Int(49), changes[1].V)
+	assert.True(t, changes[1].Added)
+}
+
+func TestBulkLoader(t *testing.T) {
+	conn := OpenConnection()
+	loader := conn.BulkLoader()
+	for i := 0; i < 100; i++ {
+		require.NoError(t, loader.Add(Person{Name: fmt.Sprintf("person %d", i), Age: i}))
+	}
+	require.NoError(t, loader.Add(Person{Name: "person 7", Age: 77}))
+	txn, err := loader.Load()
+	require.NoError(t, err)
+	p := Person{Name: "person 7"}
+	require.True(t, fetch(t, txn.Database, &p))
+	assert.Equal(t, 77, p.Age)
+	p = Person{Name: "person 99"}
+	require.True(t, fetch(t, conn.Read(), &p))
+	assert.Equal(t, 99, p.Age)
+}
+
+type Audit struct {
+	Author string `attr:"audit/author"`
+	Reason string `attr:"audit/reason"`
+}
+
+func TestTxMeta(t *testing.T) {
+	conn := OpenConnection()
+	txn, err := conn.Write(Person{Name: "Donald", Age: 48}, TxMeta(Audit{Author: "admin", Reason: "signup"}))
+	require.NoError(t, err)
+	audit := Audit{}
+	require.NoError(t, txn.Fetch(&audit))
+	assert.Equal(t, Audit{Author: "admin", Reason: "signup"}, audit)
+	p := Person{Name: "Donald"}
+	require.True(t, fetch(t, txn.Database, &p))
+	assert.Equal(t, 48, p.Age)
+
+	// metadata is recorded only about its own transaction
+	txn2, err := conn.Write(Person{Name: "Donald", Age: 49})
+	require.NoError(t, err)
+	audit = Audit{}
+	require.NoError(t, txn2.Fetch(&audit))
+	assert.Empty(t, audit)
+	audit = Audit{}
+	require.True(t, fetchByID(t, conn.Read(), &audit, txn.ID))
+	assert.Equal(t, "admin", audit.Author)
+}
+
 type Character struct {
-	Name string `attr:"player/name,identity"`
-	// TODO component ref attr attr to indicate existence ownership
-	Focus Skill `attr:"player/focus"`
-	// TODO map of values for set cardinality
-	// TODO slice of values for list cardinality
+	Name   string              `attr:"player/name,identity"`
+	Focus  Skill               `attr:"player/focus,component"`
+	Tags   map[string]struct{} `attr:"player/tags"`
+	Titles []string            `attr:"player/titles,list"`
 }
 
 type Skill struct {
@@ -103,6 +238,459 @@ func TestReferences(t *testing.T) {
 	_, err := conn.Write(Skill{Name: "smith", Rank: 0.8})
 	require.NoError(t, err)
 
-	_, err = conn.Write(Character{Name: "Gerhard", Focus: Skill{Name: "smith", Rank: 0.99}})
+	_, err = conn.Write(Character{Name: "Gerhard", Focus: Skill{Name: "smith", Rank: 0.99}, Tags: map[string]struct{}{"npc": {}}, Titles: []string{"Sir", "Smith"}})
+	require.NoError(t, err)
+
+	// constructs the referenced entities
+	gerhard := Character{Name: "Gerhard"}
+	require.True(t, fetch(t, conn.Read(), &gerhard))
+	assert.Equal(t, Skill{Name: "smith", Rank: 0.99}, gerhard.Focus)
+	assert.Equal(t, []string{"Sir", "Smith"}, gerhard.Titles)
+
+	// a rewrite resolves the component to the extant entity
+	txn, err := conn.Write(Character{Name: "Gerhard", Focus: Skill{Name: "smith", Rank: 1}})
+	require.NoError(t, err)
+	gerhard = Character{Name: "Gerhard"}
+	require.True(t, fetch(t, txn.Database, &gerhard))
+	assert.Equal(t, Skill{Name: "smith", Rank: 1}, gerhard.Focus)
+
+	// erasing a record erases its components, but not the other records like them
+	txn, err = conn.Erase(Character{Name: "Gerhard"})
+	require.NoError(t, err)
+	assert.False(t, fetch(t, txn.Database, &Character{Name: "Gerhard"}))
+	raw := conn.(connection).connection.Read()
+	skills := 0
+	iter := raw.Select(types.Selection{A: raw.AttrByIdent("skill/rank").ID})
+	for iter.Next() {
+		skills++
+	}
+	assert.Equal(t, 1, skills)
+}
+
+type Node struct {
+	Name string `attr:"node/name,identity"`
+	Next *Node  `attr:"node/next"`
+}
+
+func TestStructRefCycles(t *testing.T) {
+	conn := OpenConnection()
+	a := &Node{Name: "a"}
+	b := &Node{Name: "b", Next: a}
+	a.Next = b
+	_, err := conn.Write(a)
+	require.NoError(t, err)
+	node := Node{Name: "a"}
+	require.True(t, fetch(t, conn.Read(), &node))
+	require.NotNil(t, node.Next)
+	assert.Equal(t, "b", node.Next.Name)
+	assert.Same(t, &node, node.Next.Next)
+
+	// fails rather than following refs without end
+	head := &Node{Name: "0"}
+	for i := 1; i < 100; i++ {
+		head = &Node{Name: fmt.Sprint(i), Next: head}
+	}
+	_, err = conn.Write(head)
+	assert.ErrorIs(t, err, types.ErrRecordDepth)
+}
+
+type Crew struct {
+	Name string `attr:"crew/name,identity"`
+	Lead Person `attr:"crew/lead"`
+}
+
+func TestIdentifyingRefs(t *testing.T) {
+	conn := OpenConnection()
+	_, err := conn.Write(Person{Name: "Ada", Age: 36, Active: true})
+	require.NoError(t, err)
+	ada := Person{Name: "Ada"}
+	require.True(t, fetch(t, conn.Read(), &ada))
+
+	// refers to the person without claiming anything else about them
+	_, err = conn.Write(Crew{Name: "engine", Lead: Person{ID: ada.ID}})
+	require.NoError(t, err)
+	_, err = conn.Write(Crew{Name: "loom", Lead: Person{Name: "Ada"}})
+	require.NoError(t, err)
+	for _, name := range []string{"engine", "loom"} {
+		crew := Crew{Name: name}
+		require.True(t, fetch(t, conn.Read(), &crew))
+		assert.Equal(t, Person{ID: ada.ID, Name: "Ada", Age: 36, Active: true}, crew.Lead, name)
+	}
+
+	// erasing a record leaves the records to which it refers
+	txn, err := conn.Erase(Crew{Name: "loom", Lead: Person{Name: "Ada", Age: 36, Active: true}})
+	require.NoError(t, err)
+	assert.False(t, fetch(t, txn.Database, &Crew{Name: "loom"}))
+	assert.True(t, fetch(t, txn.Database, &Crew{Name: "engine"}))
+	assert.True(t, fetch(t, txn.Database, &Person{Name: "Ada"}))
+}
+
+type Member struct {
+	Name   string              `attr:"member/name,identity"`
+	Emails []string            `attr:"member/emails"`
+	Roles  map[string]struct{} `attr:"member/roles"`
+}
+
+func TestCardinalityMany(t *testing.T) {
+	conn := OpenConnection()
+	_, err := conn.Write(Member{
+		Name:   "Ada",
+		Emails: []string{"ada@work.example", "ada@home.example"},
+		Roles:  map[string]struct{}{"admin": {}, "editor": {}},
+	})
+	require.NoError(t, err)
+	ada := Member{Name: "Ada"}
+	require.True(t, fetch(t, conn.Read(), &ada))
+	assert.ElementsMatch(t, []string{"ada@work.example", "ada@home.example"}, ada.Emails)
+	assert.Equal(t, map[string]struct{}{"admin": {}, "editor": {}}, ada.Roles)
+
+	// rewriting retracts the values that are gone and keeps the rest
+	txn, err := conn.Write(Member{
+		Name:   "Ada",
+		Emails: []string{"ada@home.example"},
+		Roles:  map[string]struct{}{"editor": {}, "owner": {}},
+	})
+	require.NoError(t, err)
+	ada = Member{Name: "Ada"}
+	require.True(t, fetch(t, txn.Database, &ada))
+	assert.Equal(t, []string{"ada@home.example"}, ada.Emails)
+	assert.Equal(t, map[string]struct{}{"editor": {}, "owner": {}}, ada.Roles)
+
+	// nil fields are left alone, while empty fields retract every value
+	txn, err = conn.Write(Member{Name: "Ada", Roles: map[string]struct{}{}})
+	require.NoError(t, err)
+	ada = Member{Name: "Ada"}
+	require.True(t, fetch(t, txn.Database, &ada))
+	assert.Equal(t, []string{"ada@home.example"}, ada.Emails)
+	assert.Nil(t, ada.Roles)
+}
+
+type Playlist struct {
+	Name   string   `attr:"playlist/name,identity"`
+	Tracks []string `attr:"playlist/tracks,list"`
+}
+
+func TestLists(t *testing.T) {
+	conn := OpenConnection()
+	var changes []types.Change
+	stop := conn.Listen(func(report types.TxReport) {
+		changes = nil
+		for _, change := range report.Changes {
+			if change.E != report.ID {
+				changes = append(changes, change)
+			}
+		}
+	})
+	defer stop()
+	_, err := conn.Write(Playlist{Name: "mix", Tracks: []string{"c", "a", "b", "a"}})
+	require.NoError(t, err)
+	mix := Playlist{Name: "mix"}
+	require.True(t, fetch(t, conn.Read(), &mix))
+	assert.Equal(t, []string{"c", "a", "b", "a"}, mix.Tracks)
+
+	// swapping two elements changes only their values
+	txn, err := conn.Write(Playlist{Name: "mix", Tracks: []string{"c", "b", "a", "a"}})
+	require.NoError(t, err)
+	mix = Playlist{Name: "mix"}
+	require.True(t, fetch(t, txn.Database, &mix))
+	assert.Equal(t, []string{"c", "b", "a", "a"}, mix.Tracks)
+	assert.Len(t, changes, 4)
+
+	// removing the last element retracts it
+	txn, err = conn.Write(Playlist{Name: "mix", Tracks: []string{"c", "b", "a"}})
+	require.NoError(t, err)
+	mix = Playlist{Name: "mix"}
+	require.True(t, fetch(t, txn.Database, &mix))
+	assert.Equal(t, []string{"c", "b", "a"}, mix.Tracks)
+	assert.Len(t, changes, 3)
+
+	// an empty list retracts every element
+	txn, err = conn.Write(Playlist{Name: "mix", Tracks: []string{}})
+	require.NoError(t, err)
+	mix = Playlist{Name: "mix"}
+	require.True(t, fetch(t, txn.Database, &mix))
+	assert.Nil(t, mix.Tracks)
+}
+
+type Profile struct {
+	Name     string `attr:"profile/name,identity"`
+	Age      *int   `attr:"profile/age"`
+	Verified *bool  `attr:"profile/verified"`
+	Bio      string `attr:"profile/bio,omitempty"`
+}
+
+func TestOptionalFields(t *testing.T) {
+	conn := OpenConnection()
+	age := 0
+	_, err := conn.Write(Profile{Name: "Ada", Age: &age, Bio: "hi"})
+	require.NoError(t, err)
+	ada := Profile{Name: "Ada"}
+	require.True(t, fetch(t, conn.Read(), &ada))
+	require.NotNil(t, ada.Age)
+	assert.Equal(t, 0, *ada.Age)
+	assert.Nil(t, ada.Verified)
+	assert.Equal(t, "hi", ada.Bio)
+
+	// nil and empty fields retract their values on rewrite
+	verified := false
+	txn, err := conn.Write(Profile{Name: "Ada", Verified: &verified})
+	require.NoError(t, err)
+	ada = Profile{Name: "Ada", Age: &age}
+	require.True(t, fetch(t, txn.Database, &ada))
+	assert.Nil(t, ada.Age)
+	require.NotNil(t, ada.Verified)
+	assert.False(t, *ada.Verified)
+	assert.Empty(t, ada.Bio)
+}
+
+type Cents int64
+
+type Account struct {
+	ID      uint64  `attr:"sys/db/id"`
+	Number  uint32  `attr:"account/number,identity"`
+	Balance Cents   `attr:"account/balance"`
+	Flags   int8    `attr:"account/flags"`
+	Rate    float32 `attr:"account/rate"`
+}
+
+type SmallAccount struct {
+	Number  uint32 `attr:"account/number,identity"`
+	Balance int16  `attr:"account/balance"`
+}
+
+func TestNumericKinds(t *testing.T) {
+	conn := OpenConnection()
+	txn, err := conn.Write(Account{Number: 7, Balance: 1 << 40, Flags: -3, Rate: 0.5})
+	require.NoError(t, err)
+	account := Account{Number: 7}
+	require.True(t, fetch(t, txn.Database, &account))
+	assert.Positive(t, account.ID)
+	assert.Equal(t, Cents(1<<40), account.Balance)
+	assert.Equal(t, int8(-3), account.Flags)
+	assert.Equal(t, float32(0.5), account.Rate)
+
+	// fails rather than silently truncating a value
+	small := SmallAccount{Number: 7}
+	_, err = txn.Database.Fetch(&small)
+	assert.ErrorIs(t, err, types.ErrAttrFieldOverflow)
+}
+
+type UUID [4]byte
+
+func (id UUID) AttrType() types.ID { return sys.AttrTypeString }
+
+func (id UUID) MarshalValue() (types.VRef, error) {
+	return types.String(hex.EncodeToString(id[:])), nil
+}
+
+func (id *UUID) UnmarshalValue(v types.VRef) error {
+	_, err := hex.Decode(id[:], []byte(v.(types.String)))
+	return err
+}
+
+type Money struct {
+	Cents int64
+}
+
+func (m Money) AttrType() types.ID { return sys.AttrTypeInt }
+
+func (m Money) MarshalValue() (types.VRef, error) { return types.Int(m.Cents), nil }
+
+func (m *Money) UnmarshalValue(v types.VRef) error {
+	m.Cents = int64(v.(types.Int))
+	return nil
+}
+
+type Suit int
+
+const (
+	Hearts Suit = iota + 1
+	Spades
+)
+
+var suitIdents = map[Suit]types.Ident{Hearts: "suit/hearts", Spades: "suit/spades"}
+
+func (s Suit) AttrType() types.ID { return sys.AttrTypeRef }
+
+func (s Suit) MarshalValue() (types.VRef, error) {
+	ident, ok := suitIdents[s]
+	if !ok {
+		return nil, fmt.Errorf("invalid suit %d", s)
+	}
+	return ident, nil
+}
+
+func (s *Suit) UnmarshalValue(v types.VRef) error {
+	for suit, ident := range suitIdents {
+		if ident == v {
+			*s = suit
+			return nil
+		}
+	}
+	return fmt.Errorf("invalid suit %v", v)
+}
+
+type Wager struct {
+	ID     UUID              `attr:"wager/id,identity"`
+	Stake  Money             `attr:"wager/stake"`
+	Suit   Suit              `attr:"wager/suit"`
+	Hedges map[Suit]struct{} `attr:"wager/hedges"`
+	Alt    *UUID             `attr:"wager/alt"`
+}
+
+func TestValueCodecs(t *testing.T) {
+	conn := OpenConnection()
+	_, err := conn.(connection).connection.Write(types.Request{Claims: []types.Claim{
+		{E: types.TempID("hearts"), A: sys.DbIdent, V: types.String("suit/hearts")},
+		{E: types.TempID("spades"), A: sys.DbIdent, V: types.String("suit/spades")},
+	}})
+	require.NoError(t, err)
+	id := UUID{1, 2, 3, 4}
+	txn, err := conn.Write(Wager{ID: id, Stake: Money{Cents: 250}, Suit: Spades, Hedges: map[Suit]struct{}{Hearts: {}}})
+	require.NoError(t, err)
+	wager := Wager{ID: id}
+	require.True(t, fetch(t, txn.Database, &wager))
+	assert.Equal(t, Money{Cents: 250}, wager.Stake)
+	assert.Equal(t, Spades, wager.Suit)
+	assert.Equal(t, map[Suit]struct{}{Hearts: {}}, wager.Hedges)
+	assert.Nil(t, wager.Alt)
+
+	// marshals optional fields by their elements
+	alt := UUID{5, 6, 7, 8}
+	txn, err = conn.Write(Wager{ID: id, Stake: Money{Cents: 250}, Suit: Spades, Alt: &alt})
+	require.NoError(t, err)
+	wager = Wager{ID: id}
+	require.True(t, fetch(t, txn.Database, &wager))
+	require.NotNil(t, wager.Alt)
+	assert.Equal(t, alt, *wager.Alt)
+
+	// reports marshaling errors
+	_, err = conn.Write(Wager{ID: id, Suit: Suit(9)})
+	assert.EqualError(t, err, "constructive.Wager.Suit: invalid suit 9")
+}
+
+type Timestamps struct {
+	Created time.Time `attr:"created"`
+	Updated time.Time `attr:"updated"`
+}
+
+type Audited struct {
+	_      struct{} `namespace:"audit"`
+	Author string   `attr:"author"`
+}
+
+type Document struct {
+	_     struct{} `namespace:"document"`
+	ID    uint     `attr:"sys/db/id"`
+	Title string   `attr:"title,identity"`
+	Timestamps
+	Audited
+}
+
+func TestEmbeddedStructs(t *testing.T) {
+	conn := OpenConnection()
+	created := time.Date(2020, 3, 11, 12, 0, 0, 0, time.UTC)
+	doc := Document{Title: "Notes", Timestamps: Timestamps{Created: created, Updated: created}, Audited: Audited{Author: "ada"}}
+	txn, err := conn.Write(doc)
+	require.NoError(t, err)
+	db := conn.(connection).connection.Read()
+	for _, ident := range []types.Ident{"document/title", "document/created", "document/updated", "audit/author"} {
+		assert.Positive(t, db.AttrByIdent(ident).ID, ident)
+	}
+	fetched := Document{Title: "Notes"}
+	require.True(t, fetch(t, txn.Database, &fetched))
+	assert.Positive(t, fetched.ID)
+	assert.True(t, created.Equal(fetched.Created))
+	assert.Equal(t, "ada", fetched.Author)
+}
+
+type Label struct {
+	Name  string `attr:"label/name,identity"`
+	Color string `attr:"label/color"`
+}
+
+type ColorOnly struct {
+	Color string `attr:"label/color"`
+}
+
+func TestSchemaChanges(t *testing.T) {
+	conn := OpenConnection()
+	_, err := conn.Write(struct {
+		Name string `attr:"label/name,identity"`
+	}{Name: "todo"})
+	require.NoError(t, err)
+	// label/color does not yet exist, so is not populated
+	label := Label{Name: "todo", Color: "unknown"}
+	require.True(t, fetch(t, conn.Read(), &label))
+	assert.Equal(t, "unknown", label.Color)
+
+	// once it does, fetching the same type populates it
+	_, err = conn.Write(Label{Name: "todo", Color: "red"})
+	require.NoError(t, err)
+	label = Label{Name: "todo"}
+	require.True(t, fetch(t, conn.Read(), &label))
+	assert.Equal(t, "red", label.Color)
+}
+
+// Handle marshals to a tempid, which identifies no entity.
+type Handle string
+
+func (h Handle) AttrType() types.ID { return sys.AttrTypeRef }
+
+func (h Handle) MarshalValue() (types.VRef, error) { return types.TempID(h), nil }
+
+func (h *Handle) UnmarshalValue(v types.VRef) error { return nil }
+
+type Badge struct {
+	Handle Handle `attr:"badge/handle,identity"`
+}
+
+type Event struct {
+	At   time.Time `attr:"event/at,identity"`
+	Name string    `attr:"event/name"`
+}
+
+func TestInvalidRecords(t *testing.T) {
+	conn := OpenConnection()
+	type Tally struct {
+		Counts map[string]int `attr:"tally/counts"`
+	}
+
+	// reports records that are not structs
+	_, err := conn.Write(Person{Name: "Donald"}, "Stephen")
+	assert.ErrorIs(t, err, types.ErrInvalidRecord)
+	_, err = conn.Erase(7)
+	assert.ErrorIs(t, err, types.ErrInvalidRecord)
+	_, err = conn.Read().Fetch(Person{Name: "Donald"})
+	assert.ErrorIs(t, err, types.ErrInvalidRecord)
+
+	// reports fields that cannot be recorded
+	_, err = conn.Write(Tally{})
+	assert.ErrorIs(t, err, types.ErrInvalidAttrField)
+	_, err = conn.Write(TxMeta(Tally{}))
+	assert.ErrorIs(t, err, types.ErrInvalidAttrField)
+	_, err = conn.Read().With(Tally{})
+	assert.ErrorIs(t, err, types.ErrInvalidAttrField)
+	_, err = conn.Read().Fetch(&Tally{})
+	assert.ErrorIs(t, err, types.ErrInvalidAttrField)
+	assert.ErrorIs(t, conn.BulkLoader().Add(Tally{}), types.ErrInvalidAttrField)
+
+	// reports marshaled values that cannot identify records
+	schema, err := destruct.Schema(reflect.TypeOf(Badge{}))
+	require.NoError(t, err)
+	_, err = conn.(connection).connection.Write(types.Request{Claims: schema})
+	require.NoError(t, err)
+	_, err = conn.Read().Fetch(&Badge{Handle: "ada"})
+	assert.ErrorIs(t, err, types.ErrInvalidValue)
+
+	// writes nothing when any record is invalid
+	assert.False(t, fetch(t, conn.Read(), &Person{Name: "Donald"}))
+
+	// fetches records identified by instants
+	at := time.Date(2022, 3, 11, 12, 0, 0, 0, time.UTC)
+	_, err = conn.Write(Event{At: at, Name: "launch"})
 	require.NoError(t, err)
+	event := Event{At: at}
+	require.True(t, fetch(t, conn.Read(), &event))
+	assert.Equal(t, "launch", event.Name)
 }
@@ -68,6 +68,22 @@ func AV(d1 Datum, d2 Datum) int {
 	return Compare(d1.V, d2.V)
 }
 
+func VA(d1 Datum, d2 Datum) int {
+	v := Compare(d1.V, d2.V)
+	if v != 0 {
+		return v
+	}
+	return A(d1, d2)
+}
+
+func VAE(d1 Datum, d2 Datum) int {
+	va := VA(d1, d2)
+	if va != 0 {
+		return va
+	}
+	return E(d1, d2)
+}
+
 func AVE(d1 Datum, d2 Datum) int {
 	av := AV(d1, d2)
 	if av != 0 {
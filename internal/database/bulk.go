@@ -0,0 +1,379 @@
+package database
+
+import (
+	"errors"
+	"time"
+
+	"github.com/dball/constructive/pkg/sys"
+	. "github.com/dball/constructive/pkg/types"
+)
+
+// bulkBatchSize is the number of claims a bulk loader checks at a time.
+const bulkBatchSize = 4096
+
+// BTreeBulkLoader loads claims into a connection in a single transaction, much more quickly
+// than Write for large numbers of claims. Rather than applying each claim to a clone of
+// the index, it checks the claims' attrs and values in batches as they are added, then
+// resolves their entities once all have been added, and loads the resulting datums into
+// the index together.
+//
+// Claims about sys attrs, e.g. schema claims, are applied as Write would apply them, as
+// they are added, but only to the load's own copy of the schema, which the connection
+// adopts if and when the load succeeds. Other claims may only assert values: retractions,
+// compare-and-swap claims, and transaction functions are rejected. Tempids resolve through
+// identity unique attrs as Write would resolve them, across all of the claims in the load,
+// but lookup refs resolve only to entities extant before the load, and component refs are
+// neither matched to extant components nor checked for cycles.
+//
+// The load fails if the connection is written before it completes.
+type BTreeBulkLoader struct {
+	conn *BTreeConnection
+	tx   *transactor
+	txn  Transaction
+	// pending holds the claims not yet checked, and pendingIndexes their indexes in the load.
+	pending        []Claim
+	pendingIndexes []int
+	// claims holds the claims checked but not yet resolved, and indexes their indexes.
+	claims  []Claim
+	indexes []int
+	// count is the number of claims added.
+	count  int
+	datums []Datum
+	// uniques maps the unique attr values loaded to their entities.
+	uniques map[attrValue]ID
+	// ones maps the entities' cardinality one attrs loaded to the indexes of their datums.
+	ones map[entityAttr]int
+	// manys records the cardinality many datums loaded.
+	manys map[entityAttrValue]Void
+	// err is the error that failed the load, if any.
+	err error
+}
+
+// attrValue and entityAttrValue are map keys, so their values must be given by valueKey.
+type attrValue struct {
+	a ID
+	v Value
+}
+
+type entityAttr struct {
+	e ID
+	a ID
+}
+
+type entityAttrValue struct {
+	e ID
+	a ID
+	v Value
+}
+
+// valueKey returns a value suitable for use in a map key, discarding any monotonic clock
+// reading or location from an instant.
+func valueKey(v Value) Value {
+	if inst, ok := v.(Inst); ok {
+		return Inst(time.Time(inst).UTC().Round(0))
+	}
+	return v
+}
+
+// BulkLoader begins a bulk load into the connection.
+func (conn *BTreeConnection) BulkLoader() BulkLoader {
+	conn.lock.Lock()
+	tx := newTransactor(conn.idx, conn.nextID, conn.clock, conn.fns)
+	conn.lock.Unlock()
+	tx.conn = conn
+	txn := Transaction{NewIDs: make(map[TempID]ID)}
+	txn.ID = tx.allocID()
+	return &BTreeBulkLoader{
+		conn:    conn,
+		tx:      tx,
+		txn:     txn,
+		uniques: map[attrValue]ID{},
+		ones:    map[entityAttr]int{},
+		manys:   map[entityAttrValue]Void{},
+	}
+}
+
+// Add adds the claims to the load. Claims about sys attrs are applied to the load's schema
+// immediately, while the attrs and values of the others are checked once a batch has been
+// added. Once a claim is rejected, the load fails and all subsequent calls return its error.
+func (loader *BTreeBulkLoader) Add(claims ...Claim) error {
+	if loader.err != nil {
+		return loader.err
+	}
+	offset := loader.count
+	loader.count += len(claims)
+	var sysClaims []Claim
+	var sysIndexes []int
+	for i, claim := range claims {
+		if claim.Retract || claim.CAS || claim.Fn != "" {
+			loader.fail(offset+i, claim, ErrBulkClaim)
+			return loader.err
+		}
+		a := loader.tx.resolveARef(claim.A)
+		if a != 0 && a < sys.FirstUserID {
+			sysClaims = append(sysClaims, claim)
+			sysIndexes = append(sysIndexes, offset+i)
+		} else {
+			loader.pending = append(loader.pending, claim)
+			loader.pendingIndexes = append(loader.pendingIndexes, offset+i)
+		}
+	}
+	if len(sysClaims) > 0 {
+		err := loader.tx.resolveTempIDs(loader.txn, sysClaims)
+		if err == nil {
+			err = loader.tx.applyClaims(loader.txn, sysClaims, 0)
+		}
+		if err != nil {
+			var txErr *TxError
+			if errors.As(err, &txErr) {
+				txErr.Index = sysIndexes[txErr.Index]
+			}
+			loader.err = err
+			return err
+		}
+	}
+	if len(loader.pending) >= bulkBatchSize {
+		loader.flush()
+	}
+	return loader.err
+}
+
+// Load checks any remaining claims and resolves the entities of all of them, then loads
+// their datums and commits the transaction.
+func (loader *BTreeBulkLoader) Load() (txn Transaction, err error) {
+	if loader.err == nil && len(loader.pending) > 0 {
+		loader.flush()
+	}
+	if loader.err == nil {
+		loader.resolve()
+	}
+	if loader.err != nil {
+		return Transaction{}, loader.err
+	}
+	tx := loader.tx
+	tx.newIdx.Load(loader.datums)
+	txn = loader.txn
+	_, err = tx.newIdx.Assert(Datum{E: txn.ID, A: sys.TxAt, V: Inst(tx.clock.Now()), T: txn.ID})
+	if err != nil {
+		loader.err = err
+		return Transaction{}, err
+	}
+	txn.Database = tx.database()
+	before, changes, err := loader.conn.commitBulk(tx)
+	if err != nil {
+		loader.err = err
+		return Transaction{}, err
+	}
+	loader.conn.report(txn, before, changes)
+	loader.err = ErrBulkLoadDone
+	return
+}
+
+// commitBulk commits the bulk load's transactor if the connection has not been written
+// since the load began. On success, the caller must report the transaction.
+func (conn *BTreeConnection) commitBulk(tx *transactor) (before *BTreeDatabase, changes []Change, err error) {
+	conn.lock.Lock()
+	defer conn.lock.Unlock()
+	if conn.idx != tx.idx {
+		err = ErrConcurrentWrite
+		return
+	}
+	before, changes = conn.commit(tx)
+	return
+}
+
+// flush checks the attrs and values of the pending claims, which are then resolved by Load.
+func (loader *BTreeBulkLoader) flush() {
+	claims := loader.pending
+	indexes := loader.pendingIndexes
+	loader.pending = nil
+	loader.pendingIndexes = nil
+	tx := loader.tx
+	for i, claim := range claims {
+		attr := tx.newIdx.AttrByID(tx.resolveARef(claim.A))
+		if attr.ID == 0 {
+			loader.fail(indexes[i], claim, ErrInvalidAttr)
+			return
+		}
+		if v, ok := claim.V.(Value); ok && (v == nil || !sys.ValidValue(attr.Type, v)) {
+			loader.fail(indexes[i], claim, ErrInvalidValue)
+			return
+		}
+	}
+	loader.claims = append(loader.claims, claims...)
+	loader.indexes = append(loader.indexes, indexes...)
+}
+
+// resolve resolves the entities of all of the claims in the load, recording the datums
+// they assert. Tempids are allocated only once every claim of an identity has been seen,
+// so a tempid resolves the same way regardless of the order in which its claims were added.
+func (loader *BTreeBulkLoader) resolve() {
+	claims := loader.claims
+	indexes := loader.indexes
+	loader.claims = nil
+	loader.indexes = nil
+	tx := loader.tx
+	txn := loader.txn
+	for i, claim := range claims {
+		if err := loader.resolveIdentity(claim, false); err != nil {
+			loader.fail(indexes[i], claim, err)
+			return
+		}
+	}
+	for i, claim := range claims {
+		if err := loader.resolveIdentity(claim, true); err != nil {
+			loader.fail(indexes[i], claim, err)
+			return
+		}
+	}
+	for _, claim := range claims {
+		if tempID, ok := claim.E.(TempID); ok {
+			tx.allocTempID(txn, tempID)
+		}
+		if tempID, ok := claim.V.(TempID); ok {
+			tx.allocTempID(txn, tempID)
+		}
+	}
+	for i, claim := range claims {
+		if err := loader.assert(claim); err != nil {
+			loader.fail(indexes[i], claim, err)
+			return
+		}
+	}
+}
+
+// fail fails the load with a TxError for the claim at the given index in the load.
+func (loader *BTreeBulkLoader) fail(index int, claim Claim, err error) {
+	tx := loader.tx
+	attr := tx.newIdx.AttrByID(tx.resolveARef(claim.A)).Ident
+	if attr == "" {
+		attr, _ = claim.A.(Ident)
+	}
+	loader.err = &TxError{Index: index, Claim: claim, Attr: attr, Err: err}
+}
+
+// resolveIdentity resolves the claim's tempid to the entity with the claim's identity unique
+// attr value, if any, whether extant or loaded. If alloc is given, the value is otherwise
+// claimed for the tempid, allocating it if need be, so that subsequent claims of the value
+// resolve to the same entity.
+func (loader *BTreeBulkLoader) resolveIdentity(claim Claim, alloc bool) error {
+	tx := loader.tx
+	tempID, ok := claim.E.(TempID)
+	if !ok {
+		return nil
+	}
+	v, ok := claim.V.(Value)
+	if !ok || v == nil {
+		return nil
+	}
+	attr := tx.newIdx.AttrByID(tx.resolveARef(claim.A))
+	if attr.Unique != sys.AttrUniqueIdentity {
+		return nil
+	}
+	key := attrValue{a: attr.ID, v: valueKey(v)}
+	e, ok := loader.uniques[key]
+	if !ok {
+		e = tx.newIdx.SelectOne(Selection{A: attr.ID, V: VSelValue(v)}).E
+	}
+	if e == 0 {
+		if alloc {
+			tx.allocTempID(loader.txn, tempID)
+			loader.uniques[key] = loader.txn.NewIDs[tempID]
+		}
+		return nil
+	}
+	id, ok := loader.txn.NewIDs[tempID]
+	switch {
+	case !ok:
+		loader.txn.NewIDs[tempID] = e
+	case id != e:
+		return ErrTempIDConflict
+	}
+	return nil
+}
+
+// assert validates the claim's datum and records it to be loaded.
+func (loader *BTreeBulkLoader) assert(claim Claim) error {
+	tx := loader.tx
+	txn := loader.txn
+	a := tx.resolveARef(claim.A)
+	attr := tx.newIdx.AttrByID(a)
+	if attr.ID == 0 {
+		return ErrInvalidAttr
+	}
+	e := tx.resolveEWriteRef(txn, claim.E)
+	v, _ := claim.V.(Value)
+	switch vref := claim.V.(type) {
+	case TempID:
+		v = txn.NewIDs[vref]
+	case Ident:
+		v = tx.newIdx.ResolveIdent(vref)
+	}
+	if e == 0 || v == nil || !sys.ValidValue(attr.Type, v) {
+		return ErrInvalidValue
+	}
+	datum := Datum{E: e, A: a, V: v, T: txn.ID}
+	if attr.Cardinality == sys.AttrCardinalityMany {
+		key := entityAttrValue{e: e, a: a, v: valueKey(v)}
+		if _, ok := loader.manys[key]; ok {
+			return nil
+		}
+		if tx.newIdx.SelectOne(Selection{E: e, A: a, V: VSelValue(v)}).E != 0 {
+			return nil
+		}
+		if err := loader.claimUnique(attr, datum); err != nil {
+			return err
+		}
+		loader.manys[key] = Void{}
+		loader.datums = append(loader.datums, datum)
+		return nil
+	}
+	key := entityAttr{e: e, a: a}
+	i, loaded := loader.ones[key]
+	if loaded {
+		extant := loader.datums[i]
+		if Compare(extant.V, v) == 0 {
+			return nil
+		}
+		if err := loader.claimUnique(attr, datum); err != nil {
+			return err
+		}
+		delete(loader.uniques, attrValue{a: a, v: valueKey(extant.V)})
+		loader.datums[i] = datum
+		return nil
+	}
+	extant := tx.newIdx.SelectOne(Selection{E: e, A: a})
+	if extant.E != 0 && Compare(extant.V, v) == 0 {
+		return nil
+	}
+	if err := loader.claimUnique(attr, datum); err != nil {
+		return err
+	}
+	if extant.E != 0 {
+		extant.T = txn.ID
+		if err := tx.newIdx.Retract(extant); err != nil {
+			return err
+		}
+	}
+	loader.ones[key] = len(loader.datums)
+	loader.datums = append(loader.datums, datum)
+	return nil
+}
+
+// claimUnique records the datum's value if its attr is unique, rejecting it if another
+// entity has the value, extant or loaded.
+func (loader *BTreeBulkLoader) claimUnique(attr Attr, datum Datum) error {
+	if attr.Unique == 0 {
+		return nil
+	}
+	key := attrValue{a: attr.ID, v: valueKey(datum.V)}
+	e, ok := loader.uniques[key]
+	if !ok {
+		e = loader.tx.newIdx.SelectOne(Selection{A: attr.ID, V: VSelValue(datum.V)}).E
+	}
+	if e != 0 && e != datum.E {
+		return ErrInvalidValue
+	}
+	loader.uniques[key] = datum.E
+	return nil
+}
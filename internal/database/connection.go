@@ -22,149 +22,433 @@ type BTreeConnection struct {
 	idx    *index.BTreeIndex
 	nextID ID
 	clock  Clock
+	// fns is replaced, never changed, when functions are registered, so snapshots may share it.
+	fns map[Ident]TxFn
+	// notify serializes the delivery of transaction reports, in transaction order, and
+	// guards the listeners.
+	notify       sync.Mutex
+	listeners    []listener
+	nextListener uint64
+	// pending holds the requests waiting to be written, guarded by pendingLock.
+	pendingLock sync.Mutex
+	pending     []*pendingWrite
 }
 
+type listener struct {
+	id uint64
+	fn func(TxReport)
+}
+
+// subscriptionBuffer is the capacity of subscription channels. A subscription whose
+// channel is full when a report is due is ended.
+const subscriptionBuffer = 64
+
 func (conn *BTreeConnection) SetClock(clock Clock) {
 	conn.lock.Lock()
 	defer conn.lock.Unlock()
 	conn.clock = clock
 }
 
+// Register registers a transaction function under the given user ident, replacing any
+// function previously registered under it.
+func (conn *BTreeConnection) Register(ident Ident, fn TxFn) error {
+	if !sys.ValidUserIdent(String(ident)) {
+		return ErrInvalidUserIdent
+	}
+	conn.lock.Lock()
+	defer conn.lock.Unlock()
+	fns := make(map[Ident]TxFn, len(conn.fns)+1)
+	for k, v := range conn.fns {
+		fns[k] = v
+	}
+	fns[ident] = fn
+	conn.fns = fns
+	return nil
+}
+
 // Write attempts to update the state of the connection to reflect the claims in the
 // request. Claims assert or retract datums, though unlike datums, they may refer
 // to values via Idents, LookupRefs, etc. Failure to resolve such references will
 // result in rejected claims, as will claims about invalid attributes, values
 // inconsistent with attribute types, etc. Empty values are not allowed in claims
 // except for retractions, which specifically interpret a nil Value to retract
-// all datums for that entity and attribute.
+// all datums for that entity and attribute, except those whose values are asserted
+// for them by other claims in the request, and a nil Attr to retract the entity
+// entirely: every datum about it, every ref datum referring to it, and, recursively,
+// its components. Compare-and-swap claims are rejected unless their expected values
+// are current when they are applied.
 //
-// Claims may specify entity and ref values as tempids. All claims about an tempid
-// will resolve to an existing entity id if there is an identity unique attribute
-// in the claims that corresponds to it. Otherwise, each distinct tempid is allocated
-// a new id.
+// Claims that name a transaction function are given to that function, along with
+// the database as it stands within the transaction, and replaced by the claims it
+// returns. The transaction fails if the function returns an error.
+//
+// Claims may specify entity and ref values as tempids. Tempids are resolved before
+// any claims are applied, so the order of the claims does not matter. All claims
+// about a tempid will resolve to an existing entity id if any of them asserts an
+// identity unique attribute value held by that entity, and the request is rejected
+// if they would resolve to different entities. Otherwise, each distinct tempid is
+// allocated a new id.
 //
 // Either all claims in a request are accepted, or all are rejected.
+//
+// Once accepted, the transaction is reported to the connection's listeners before this
+// returns.
+//
+// Concurrent writes are committed in groups: the first writer to acquire the write lock
+// writes every request then pending, in order, each as its own transaction, and replaces
+// the connection's state once for the group.
 func (conn *BTreeConnection) Write(request Request) (txn Transaction, err error) {
-	txn.NewIDs = make(map[TempID]ID)
+	w := &pendingWrite{request: request, reported: make(chan Void)}
+	conn.pendingLock.Lock()
+	conn.pending = append(conn.pending, w)
+	conn.pendingLock.Unlock()
+	group := conn.writeGroup()
+	if len(group) > 0 {
+		conn.reportGroup(group)
+	}
+	<-w.reported
+	return w.txn, w.err
+}
+
+// pendingWrite is a request waiting to be written.
+type pendingWrite struct {
+	request Request
+	txn     Transaction
+	err     error
+	// before and changes are the database before the transaction and its changes.
+	before  *BTreeDatabase
+	changes []Change
+	// reported is closed once the request has been written and, if accepted, reported.
+	reported chan Void
+}
+
+// writeGroup writes the pending requests, returning them. If none are pending, another
+// writer has written them. The requests are transacted in turn against one clone of the
+// index, each against the state left by the requests before it that were accepted, and
+// each rejected request is rolled back. If any are given, the caller must report them.
+func (conn *BTreeConnection) writeGroup() (group []*pendingWrite) {
 	conn.lock.Lock()
 	defer conn.lock.Unlock()
-	newIdx := conn.idx.Clone()
-	id := conn.nextID
-	txn.ID = conn.allocID()
-	// TODO since we want to apply claim sequentially, instead of these two passes, we should
-	// resolve tempids first, probably with an unbounded iteration, then apply all claims.
-	for _, claim := range request.Claims {
-		v, ok := claim.V.(Value)
-		if !ok {
-			continue
-		}
-		a := conn.resolveARef(claim.A)
-		// TODO if we have multiple claims for the same tempid, and the first one
-		// is not for a unique identity attr, we must not allocate a new id until
-		// we have checked the other claims for the same tempid.
-		e := conn.resolveEWriteRef(txn, a, v, claim.E)
-		if claim.Retract {
-			if v != nil {
-				err = newIdx.Retract(Datum{E: e, A: a, V: v})
-			} else {
-				iter := conn.idx.Select(Selection{E: e, A: a})
-				for iter.Next() {
-					err = newIdx.Retract(iter.Value().(Datum))
-					if err != nil {
-						break
-					}
-				}
-			}
-		} else {
-			_, err = newIdx.Assert(Datum{E: e, A: a, V: v})
+	conn.pendingLock.Lock()
+	group = conn.pending
+	conn.pending = nil
+	conn.pendingLock.Unlock()
+	if len(group) == 0 {
+		return
+	}
+	tx := newTransactor(conn.idx, conn.nextID, conn.clock, conn.fns)
+	tx.conn = conn
+	before := conn.read()
+	// last is the database of the last accepted request, which shares the new index until
+	// another request is transacted.
+	var last *BTreeDatabase
+	for _, w := range group {
+		if last != nil {
+			last.idx = tx.newIdx.Clone()
+			last = nil
 		}
-		if err != nil {
-			break
+		mark, nextID := tx.newIdx.Mark(), tx.nextID
+		n := len(tx.newIdx.Changes())
+		w.txn, w.err = tx.transact(w.request)
+		if w.err != nil {
+			tx.newIdx.Rollback(mark)
+			tx.nextID = nextID
+			continue
 		}
+		changes := tx.newIdx.Changes()
+		w.changes = changes[n:len(changes):len(changes)]
+		w.before = before
+		last = w.txn.Database.(*BTreeDatabase)
+		before = last
 	}
-	if err != nil {
-		for _, claim := range request.Claims {
-			tempID, ok := claim.V.(TempID)
-			if !ok {
-				continue
-			}
-			v, ok := txn.NewIDs[tempID]
-			if !ok {
-				panic("claims with tempid values not used as entities in the request are invalid")
-			}
-			a := conn.resolveARef(claim.A)
-			e := conn.resolveEWriteRef(txn, a, v, claim.E)
-			_, err = newIdx.Assert(Datum{E: e, A: a, V: v})
+	conn.idx = tx.newIdx
+	conn.nextID = tx.nextID
+	conn.notify.Lock()
+	return
+}
+
+// reportGroup reports the accepted transactions in a group to the listeners, releases
+// their writers, and releases the notify lock.
+func (conn *BTreeConnection) reportGroup(group []*pendingWrite) {
+	defer conn.notify.Unlock()
+	for _, w := range group {
+		if w.err == nil {
+			conn.deliver(w.txn, w.before, w.changes)
 		}
+		close(w.reported)
 	}
-	if err == nil {
-		_, err = newIdx.Assert(Datum{E: txn.ID, A: sys.TxAt, V: Inst(conn.clock.Now()), T: txn.ID})
-	}
-	if err != nil {
-		conn.nextID = id
-		txn.ID = ID(0)
-		txn.NewIDs = nil
-		// TODO specify the failed claim
+}
+
+// commit replaces the connection's state with the transactor's, returning the database
+// before the transaction and its changes. The caller must hold the write lock. This
+// acquires the notify lock before the caller releases the write lock, so transactions
+// are reported in the order in which they are committed.
+func (conn *BTreeConnection) commit(tx *transactor) (before *BTreeDatabase, changes []Change) {
+	before = conn.read()
+	changes = tx.newIdx.Changes()
+	conn.idx = tx.newIdx
+	conn.nextID = tx.nextID
+	conn.notify.Lock()
+	return
+}
+
+// report reports a committed transaction to the listeners and releases the notify lock.
+func (conn *BTreeConnection) report(txn Transaction, before *BTreeDatabase, changes []Change) {
+	defer conn.notify.Unlock()
+	conn.deliver(txn, before, changes)
+}
+
+// deliver reports a committed transaction to the listeners. The caller must hold the
+// notify lock.
+func (conn *BTreeConnection) deliver(txn Transaction, before *BTreeDatabase, changes []Change) {
+	if len(conn.listeners) == 0 {
 		return
 	}
-	conn.idx = newIdx
-	txn.Database = conn.Read()
+	report := TxReport{ID: txn.ID, DbBefore: before, DbAfter: txn.Database, Changes: changes}
+	for _, listener := range conn.listeners {
+		listener.fn(report)
+	}
+}
+
+// Listen calls the listener with a report of each transaction subsequently written, in
+// order, before the write returns. Listeners must not write to the connection, nor start
+// or stop listeners, subscriptions, or watches.
+func (conn *BTreeConnection) Listen(fn func(TxReport)) (stop func()) {
+	conn.notify.Lock()
+	defer conn.notify.Unlock()
+	id := conn.listen(fn)
+	var once sync.Once
+	stop = func() {
+		once.Do(func() {
+			conn.notify.Lock()
+			defer conn.notify.Unlock()
+			conn.unlisten(id)
+		})
+	}
 	return
 }
 
-func (conn *BTreeConnection) Read() Database {
-	return &BTreeDatabase{idx: conn.idx}
+// listen adds the listener, returning its id. The caller must hold the notify lock.
+func (conn *BTreeConnection) listen(fn func(TxReport)) (id uint64) {
+	conn.nextListener++
+	id = conn.nextListener
+	conn.listeners = append(conn.listeners, listener{id: id, fn: fn})
+	return
+}
+
+// unlisten removes the listener, if it has not already been removed. The caller must hold
+// the notify lock. The listeners are replaced rather than changed, so a listener may
+// remove itself while the listeners are being called.
+func (conn *BTreeConnection) unlisten(id uint64) {
+	listeners := make([]listener, 0, len(conn.listeners))
+	for _, listener := range conn.listeners {
+		if listener.id != id {
+			listeners = append(listeners, listener)
+		}
+	}
+	conn.listeners = listeners
 }
 
-func (conn *BTreeConnection) allocID() (id ID) {
-	id = conn.nextID
-	if id == 0xffffffffffffffff {
-		panic("id-space-exhausted")
+// Subscribe delivers the reports of the transactions subsequently written with changes
+// matching the filter, narrowed to those changes. Writes never wait for subscribers: if
+// a report is due while the channel is full, the subscription ends, closing the channel
+// without the report, so subscribers must receive promptly. Canceling closes the channel,
+// if the subscription has not already ended, and may be done any number of times.
+func (conn *BTreeConnection) Subscribe(filter TxFilter) (reports <-chan TxReport, cancel func()) {
+	ch := make(chan TxReport, subscriptionBuffer)
+	// closed is guarded by the notify lock.
+	closed := false
+	end := func(id uint64) {
+		if !closed {
+			closed = true
+			conn.unlisten(id)
+			close(ch)
+		}
 	}
-	conn.nextID++
-	return
+	conn.notify.Lock()
+	var id uint64
+	id = conn.listen(func(report TxReport) {
+		report, ok := filterReport(filter, report)
+		if !ok {
+			return
+		}
+		select {
+		case ch <- report:
+		default:
+			end(id)
+		}
+	})
+	conn.notify.Unlock()
+	cancel = func() {
+		conn.notify.Lock()
+		defer conn.notify.Unlock()
+		end(id)
+	}
+	return ch, cancel
 }
 
-func (conn *BTreeConnection) resolveEWriteRef(txn Transaction, a ID, v Value, eref EWriteRef) ID {
-	switch e := eref.(type) {
-	case ID:
-		return e
-	case LookupRef:
-		return conn.idx.ResolveLookupRef(e)
-	case TempID:
-		id, ok := txn.NewIDs[e]
-		if ok {
-			return id
-		}
-		attr := conn.idx.AttrByID(a)
-		if attr.ID != 0 && attr.Unique == sys.AttrUniqueIdentity {
-			iter := conn.idx.Filter(IndexAVE, Datum{A: a, V: v})
-			if iter.Next() {
-				d := iter.Value().(Datum)
-				id = d.E
-				txn.NewIDs[e] = id
-				return id
+// Watch delivers the datums matching the selection in the database, then again whenever
+// a transaction subsequently committed to its connection changes them, evaluating the
+// selection in the database's window against the database the transaction committed.
+// Only transactions with changed datums satisfying the selection's constraints cause it
+// to be reevaluated, which the watch does on its own goroutine, so the results may be
+// delivered after the write returns. Writes never wait for watchers: a watcher that falls
+// behind receives only the latest results. Views as of a transaction and the databases of
+// speculative transactions never change, so their results are delivered once. Canceling
+// waits for any reevaluation under way, then closes the channel.
+func (db *BTreeDatabase) Watch(sel Selection) (results <-chan []Datum, cancel func()) {
+	ch := make(chan []Datum, 1)
+	var last []Datum
+	evaluate := func(view *BTreeDatabase) {
+		var datums []Datum
+		iter := view.Select(sel)
+		for iter.Next() {
+			datums = append(datums, iter.Value().(Datum))
+		}
+		if last != nil && sameDatums(datums, last) {
+			return
+		}
+		if datums == nil {
+			datums = []Datum{}
+		}
+		last = datums
+		// Only this watch sends, so once any stale results are discarded, the send succeeds.
+		for {
+			select {
+			case ch <- datums:
+				return
+			default:
 			}
+			select {
+			case <-ch:
+			default:
+			}
+		}
+	}
+	var once sync.Once
+	conn := db.conn
+	if conn == nil || db.window.AsOf != 0 {
+		evaluate(db)
+		cancel = func() {
+			once.Do(func() {
+				close(ch)
+			})
 		}
-		id = conn.allocID()
-		txn.NewIDs[e] = id
-		return id
-	case TxnID:
-		return txn.ID
-	case Ident:
-		return conn.idx.ResolveIdent(e)
+		return ch, cancel
 	}
-	return ID(0)
+	// queued holds the latest database to be evaluated, if any. It is sent only while the
+	// notify lock is held, so once any database not yet evaluated is discarded, the send
+	// succeeds, and the listener never waits for the evaluation.
+	queued := make(chan *BTreeDatabase, 1)
+	queue := func(after *BTreeDatabase) {
+		view := *after
+		view.window = db.window
+		for {
+			select {
+			case queued <- &view:
+				return
+			default:
+			}
+			select {
+			case <-queued:
+			default:
+			}
+		}
+	}
+	// Acquiring the notify lock before releasing the write lock, as commit does, ensures
+	// the watch is given every transaction committed after the latest database, which is
+	// evaluated first in the database's window.
+	conn.lock.Lock()
+	latest := conn.read()
+	conn.notify.Lock()
+	conn.lock.Unlock()
+	queue(latest)
+	id := conn.listen(func(report TxReport) {
+		after := report.DbAfter.(*BTreeDatabase)
+		matches := after.idx.Matcher(sel)
+		for _, change := range report.Changes {
+			if matches(change.Datum) {
+				queue(after)
+				return
+			}
+		}
+	})
+	conn.notify.Unlock()
+	done := make(chan Void)
+	go func() {
+		defer close(done)
+		for view := range queued {
+			evaluate(view)
+		}
+		close(ch)
+	}()
+	cancel = func() {
+		once.Do(func() {
+			conn.notify.Lock()
+			conn.unlisten(id)
+			conn.notify.Unlock()
+			close(queued)
+			<-done
+		})
+	}
+	return ch, cancel
+}
+
+// sameDatums is true if the datums are the same, in the same order.
+func sameDatums(a []Datum, b []Datum) bool {
+	if len(a) != len(b) {
+		return false
+	}
+	for i := range a {
+		if a[i].E != b[i].E || a[i].A != b[i].A || a[i].T != b[i].T || Compare(a[i].V, b[i].V) != 0 {
+			return false
+		}
+	}
+	return true
 }
 
-func (conn *BTreeConnection) resolveARef(aref ARef) ID {
-	switch a := aref.(type) {
-	case ID:
-		return a
-	case LookupRef:
-		panic("TODO")
-	case Ident:
-		return conn.idx.ResolveIdent(a)
+// filterReport narrows the report's changes to those matching the filter, returning false
+// if none match.
+func filterReport(filter TxFilter, report TxReport) (TxReport, bool) {
+	var attrs map[ID]Void
+	if len(filter.Attrs) > 0 {
+		attrs = make(map[ID]Void, len(filter.Attrs))
+		for _, ident := range filter.Attrs {
+			attrs[report.DbAfter.AttrByIdent(ident).ID] = Void{}
+		}
+	}
+	var entities map[ID]Void
+	if len(filter.Entities) > 0 {
+		entities = make(map[ID]Void, len(filter.Entities))
+		for _, e := range filter.Entities {
+			entities[e] = Void{}
+		}
+	}
+	changes := make([]Change, 0, len(report.Changes))
+	for _, change := range report.Changes {
+		if attrs != nil {
+			if _, ok := attrs[change.A]; !ok {
+				continue
+			}
+		}
+		if entities != nil {
+			if _, ok := entities[change.E]; !ok {
+				continue
+			}
+		}
+		changes = append(changes, change)
+	}
+	if len(changes) == 0 {
+		return report, false
 	}
-	return ID(0)
+	report.Changes = changes
+	return report, true
+}
+
+func (conn *BTreeConnection) Read() Database {
+	return conn.read()
+}
+
+func (conn *BTreeConnection) read() *BTreeDatabase {
+	return &BTreeDatabase{idx: conn.idx, nextID: conn.nextID, clock: conn.clock, fns: conn.fns, conn: conn}
 }
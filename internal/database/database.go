@@ -8,13 +8,21 @@ import (
 )
 
 type BTreeDatabase struct {
-	idx *index.BTreeIndex
+	idx    *index.BTreeIndex
+	window index.Window
+	// nextID and clock are the state of the connection when the snapshot was taken,
+	// used to speculate about requests.
+	nextID ID
+	clock  Clock
+	fns    map[Ident]TxFn
+	// conn is the connection that committed the database, if any, which watches observe.
+	conn *BTreeConnection
 }
 
 var _ Database = &BTreeDatabase{}
 
 func (db *BTreeDatabase) Select(selection Selection) *iterator.Iterator {
-	return db.idx.Select(selection)
+	return db.idx.SelectWindow(selection, db.window)
 }
 
 func (db *BTreeDatabase) AttrByID(id ID) Attr {
@@ -25,8 +33,16 @@ func (db *BTreeDatabase) AttrByIdent(ident Ident) Attr {
 	return db.idx.AttrByIdent(ident)
 }
 
+func (db *BTreeDatabase) SchemaVersion() SchemaVersion {
+	return db.idx.SchemaVersion()
+}
+
 func (db *BTreeDatabase) ResolveEReadRef(eref EReadRef) (id ID) {
-	return db.idx.ResolveEReadRef(eref)
+	ref, ok := eref.(LookupRef)
+	if !ok {
+		return db.idx.ResolveEReadRef(eref)
+	}
+	return db.ResolveLookupRef(ref)
 }
 
 func (db *BTreeDatabase) ResolveARef(aref ARef) (id ID) {
@@ -34,13 +50,71 @@ func (db *BTreeDatabase) ResolveARef(aref ARef) (id ID) {
 }
 
 func (db *BTreeDatabase) ResolveLookupRef(ref LookupRef) (id ID) {
-	return db.idx.ResolveLookupRef(ref)
+	a := db.idx.ResolveARef(ref.A)
+	if a == 0 {
+		return
+	}
+	iter := db.idx.SelectWindow(Selection{A: a, V: VSelValue(ref.V)}, db.window)
+	if iter.Next() {
+		iter.Stop()
+		id = iter.Value().(Datum).E
+	}
+	return
+}
+
+func (db *BTreeDatabase) AsOf(t TRef) Database {
+	view := *db
+	view.window.AsOf = db.resolveTRef(t)
+	return &view
+}
+
+func (db *BTreeDatabase) Since(t TRef) Database {
+	view := *db
+	view.window.Since = db.resolveTRef(t)
+	return &view
+}
+
+func (db *BTreeDatabase) History() HistoryDatabase {
+	return &BTreeHistoryDatabase{db: *db}
+}
+
+// resolveTRef resolves a transaction ref to a transaction id. Instants resolve to the
+// last transaction recorded at or before them, or to the sys transaction if none was, so
+// that a view as of them has only the sys datums, rather than being unbounded.
+func (db *BTreeDatabase) resolveTRef(tref TRef) (id ID) {
+	switch t := tref.(type) {
+	case ID:
+		id = t
+	case Inst:
+		id = sys.Tx
+		iter := db.idx.Filter(IndexAVE, Datum{A: sys.TxAt})
+		for iter.Next() {
+			datum := iter.Value().(Datum)
+			if Compare(datum.V, t) > 0 {
+				iter.Stop()
+				break
+			}
+			id = datum.E
+		}
+	}
+	return
+}
+
+// With applies the request to a copy of the database as described in BTreeConnection.Write,
+// returning the transaction that would have resulted. The ids assigned are speculative and
+// may be assigned to other entities by the connection. Views may not be written.
+func (db *BTreeDatabase) With(request Request) (txn Transaction, err error) {
+	if db.window != (index.Window{}) {
+		err = ErrWriteToView
+		return
+	}
+	return newTransactor(db.idx, db.nextID, db.clock, db.fns).transact(request)
 }
 
 func (db *BTreeDatabase) Dump() interface{} {
 	eavs := map[ID]map[Ident]interface{}{}
 	var e ID
-	iter := db.idx.Select(Selection{})
+	iter := db.Select(Selection{})
 	for iter.Next() {
 		datum := iter.Value().(Datum)
 		attr := db.AttrByID(datum.A)
@@ -63,3 +137,51 @@ func (db *BTreeDatabase) Dump() interface{} {
 	}
 	return eavs
 }
+
+// BTreeHistoryDatabase is a view of every assertion and retraction in a database's window.
+type BTreeHistoryDatabase struct {
+	db BTreeDatabase
+}
+
+var _ HistoryDatabase = &BTreeHistoryDatabase{}
+
+func (history *BTreeHistoryDatabase) Select(selection Selection) *iterator.Iterator {
+	return history.db.idx.SelectHistory(selection, history.db.window)
+}
+
+func (history *BTreeHistoryDatabase) AttrByID(id ID) Attr {
+	return history.db.AttrByID(id)
+}
+
+func (history *BTreeHistoryDatabase) AttrByIdent(ident Ident) Attr {
+	return history.db.AttrByIdent(ident)
+}
+
+func (history *BTreeHistoryDatabase) ResolveEReadRef(eref EReadRef) ID {
+	return history.db.ResolveEReadRef(eref)
+}
+
+func (history *BTreeHistoryDatabase) ResolveARef(aref ARef) ID {
+	return history.db.ResolveARef(aref)
+}
+
+func (history *BTreeHistoryDatabase) AsOf(t TRef) HistoryDatabase {
+	view := *history
+	view.db.window.AsOf = history.db.resolveTRef(t)
+	return &view
+}
+
+func (history *BTreeHistoryDatabase) Since(t TRef) HistoryDatabase {
+	view := *history
+	view.db.window.Since = history.db.resolveTRef(t)
+	return &view
+}
+
+func (history *BTreeHistoryDatabase) Dump() interface{} {
+	var changes []Change
+	iter := history.Select(Selection{})
+	for iter.Next() {
+		changes = append(changes, iter.Value().(Change))
+	}
+	return changes
+}
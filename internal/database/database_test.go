@@ -1,8 +1,12 @@
 package database
 
 import (
+	"fmt"
+	"sync"
 	"testing"
+	"time"
 
+	"github.com/dball/constructive/internal/iterator"
 	"github.com/dball/constructive/pkg/sys"
 	. "github.com/dball/constructive/pkg/types"
 	"github.com/stretchr/testify/assert"
@@ -137,4 +141,1250 @@ func TestTempIDs(t *testing.T) {
 		})
 		require.NoError(t, err)
 	})
+	t.Run("identity uniqueness resolves regardless of claim order", func(t *testing.T) {
+		conn := OpenConnection()
+		txn, err := conn.Write(Request{
+			Claims: []Claim{
+				{E: TempID("name"), A: sys.DbIdent, V: String("person/name")},
+				{E: TempID("name"), A: sys.AttrType, V: sys.AttrTypeString},
+				{E: TempID("name"), A: sys.AttrUnique, V: sys.AttrUniqueIdentity},
+				{E: TempID("age"), A: sys.DbIdent, V: String("person/age")},
+				{E: TempID("age"), A: sys.AttrType, V: sys.AttrTypeInt},
+			}},
+		)
+		require.NoError(t, err)
+		name := txn.NewIDs[TempID("name")]
+		age := txn.NewIDs[TempID("age")]
+		txn, err = conn.Write(Request{
+			Claims: []Claim{
+				{E: TempID("me"), A: age, V: Int(7)},
+				{E: TempID("me"), A: name, V: String("Donald")},
+			},
+		})
+		require.NoError(t, err)
+		donald := txn.NewIDs[TempID("me")]
+		named := txn.ID
+		txn, err = conn.Write(Request{
+			Claims: []Claim{
+				{E: TempID("me"), A: age, V: Int(17)},
+				{E: TempID("me"), A: name, V: String("Donald")},
+			},
+		})
+		require.NoError(t, err)
+		assert.Equal(t, donald, txn.NewIDs[TempID("me")])
+		assert.Equal(t, []Datum{
+			{E: donald, A: name, V: String("Donald"), T: named},
+			{E: donald, A: age, V: Int(17), T: txn.ID},
+		}, slurp(txn.Database.Select(Selection{E: donald})))
+	})
+	t.Run("conflicting identities are rejected", func(t *testing.T) {
+		conn := OpenConnection()
+		txn, err := conn.Write(Request{
+			Claims: []Claim{
+				{E: TempID("name"), A: sys.DbIdent, V: String("person/name")},
+				{E: TempID("name"), A: sys.AttrType, V: sys.AttrTypeString},
+				{E: TempID("name"), A: sys.AttrUnique, V: sys.AttrUniqueIdentity},
+				{E: TempID("email"), A: sys.DbIdent, V: String("person/email")},
+				{E: TempID("email"), A: sys.AttrType, V: sys.AttrTypeString},
+				{E: TempID("email"), A: sys.AttrUnique, V: sys.AttrUniqueIdentity},
+			}},
+		)
+		require.NoError(t, err)
+		name := txn.NewIDs[TempID("name")]
+		email := txn.NewIDs[TempID("email")]
+		_, err = conn.Write(Request{
+			Claims: []Claim{
+				{E: TempID("donald"), A: name, V: String("Donald")},
+				{E: TempID("stephen"), A: email, V: String("stephen@example.com")},
+			},
+		})
+		require.NoError(t, err)
+		_, err = conn.Write(Request{
+			Claims: []Claim{
+				{E: TempID("me"), A: name, V: String("Donald")},
+				{E: TempID("me"), A: email, V: String("stephen@example.com")},
+			},
+		})
+		assert.ErrorIs(t, err, ErrTempIDConflict)
+		var txErr *TxError
+		require.ErrorAs(t, err, &txErr)
+		assert.Equal(t, 1, txErr.Index)
+	})
+	t.Run("component claims may precede their parent's", func(t *testing.T) {
+		conn := OpenConnection()
+		txn, err := conn.Write(Request{
+			Claims: []Claim{
+				{E: TempID("name"), A: sys.DbIdent, V: String("person/name")},
+				{E: TempID("name"), A: sys.AttrType, V: sys.AttrTypeString},
+				{E: TempID("name"), A: sys.AttrUnique, V: sys.AttrUniqueIdentity},
+				{E: TempID("street"), A: sys.DbIdent, V: String("address/street")},
+				{E: TempID("street"), A: sys.AttrType, V: sys.AttrTypeString},
+				{E: TempID("address"), A: sys.DbIdent, V: String("person/address")},
+				{E: TempID("address"), A: sys.AttrType, V: sys.AttrTypeRef},
+				{E: TempID("address"), A: sys.AttrRefType, V: sys.AttrRefTypeComponent},
+			}},
+		)
+		require.NoError(t, err)
+		name := txn.NewIDs[TempID("name")]
+		street := txn.NewIDs[TempID("street")]
+		address := txn.NewIDs[TempID("address")]
+		txn, err = conn.Write(Request{
+			Claims: []Claim{
+				{E: TempID("me"), A: name, V: String("Donald")},
+				{E: TempID("me"), A: address, V: TempID("home")},
+				{E: TempID("home"), A: street, V: String("Main St")},
+			},
+		})
+		require.NoError(t, err)
+		home := txn.NewIDs[TempID("home")]
+		txn, err = conn.Write(Request{
+			Claims: []Claim{
+				{E: TempID("home"), A: street, V: String("Elm St")},
+				{E: TempID("me"), A: address, V: TempID("home")},
+				{E: TempID("me"), A: name, V: String("Donald")},
+			},
+		})
+		require.NoError(t, err)
+		assert.Equal(t, home, txn.NewIDs[TempID("home")])
+		assert.Equal(t, []Datum{
+			{E: home, A: street, V: String("Elm St"), T: txn.ID},
+		}, slurp(txn.Database.Select(Selection{E: home})))
+	})
+}
+
+func TestViews(t *testing.T) {
+	conn := OpenConnection()
+	conn.SetClock(BuildFixedClock(Instant("2020-03-11T12:00:00Z")))
+	txn, err := conn.Write(Request{
+		Claims: []Claim{
+			{E: TempID("name"), A: sys.DbIdent, V: String("person/name")},
+			{E: TempID("name"), A: sys.AttrType, V: sys.AttrTypeString},
+			{E: TempID("name"), A: sys.AttrUnique, V: sys.AttrUniqueIdentity},
+			{E: TempID("age"), A: sys.DbIdent, V: String("person/age")},
+			{E: TempID("age"), A: sys.AttrType, V: sys.AttrTypeInt},
+		}},
+	)
+	require.NoError(t, err)
+	name := txn.NewIDs[TempID("name")]
+	age := txn.NewIDs[TempID("age")]
+	conn.SetClock(BuildFixedClock(Instant("2020-03-12T12:00:00Z")))
+	txn1, err := conn.Write(Request{
+		Claims: []Claim{
+			{E: TempID("me"), A: name, V: String("Donald")},
+			{E: TempID("me"), A: age, V: Int(47)},
+		},
+	})
+	require.NoError(t, err)
+	donald := txn1.NewIDs[TempID("me")]
+	conn.SetClock(BuildFixedClock(Instant("2020-03-13T12:00:00Z")))
+	txn2, err := conn.Write(Request{
+		Claims: []Claim{
+			{E: donald, A: age, V: Int(48)},
+		},
+	})
+	require.NoError(t, err)
+	conn.SetClock(BuildFixedClock(Instant("2020-03-14T12:00:00Z")))
+	txn3, err := conn.Write(Request{
+		Claims: []Claim{
+			{E: donald, A: age, V: Int(48), Retract: true},
+		},
+	})
+	require.NoError(t, err)
+	db := txn3.Database
+
+	t.Run("as of a transaction id", func(t *testing.T) {
+		assert.Equal(t, []Datum{
+			{E: donald, A: name, V: String("Donald"), T: txn1.ID},
+			{E: donald, A: age, V: Int(47), T: txn1.ID},
+		}, slurp(db.AsOf(txn1.ID).Select(Selection{E: donald})))
+		assert.Equal(t, []Datum{
+			{E: donald, A: name, V: String("Donald"), T: txn1.ID},
+			{E: donald, A: age, V: Int(48), T: txn2.ID},
+		}, slurp(db.AsOf(txn2.ID).Select(Selection{E: donald})))
+		assert.Equal(t, []Datum{
+			{E: donald, A: name, V: String("Donald"), T: txn1.ID},
+		}, slurp(db.AsOf(txn3.ID).Select(Selection{E: donald})))
+		assert.Empty(t, slurp(db.AsOf(txn.ID).Select(Selection{E: donald})))
+	})
+
+	t.Run("as of an instant", func(t *testing.T) {
+		view := db.AsOf(Instant("2020-03-13T18:00:00Z"))
+		assert.Equal(t, []Datum{
+			{E: donald, A: name, V: String("Donald"), T: txn1.ID},
+			{E: donald, A: age, V: Int(48), T: txn2.ID},
+		}, slurp(view.Select(Selection{E: donald})))
+		assert.Equal(t, donald, view.ResolveLookupRef(LookupRef{A: name, V: String("Donald")}))
+		assert.Zero(t, db.AsOf(Instant("2020-03-11T18:00:00Z")).ResolveLookupRef(LookupRef{A: name, V: String("Donald")}))
+	})
+
+	t.Run("as of an instant before every transaction", func(t *testing.T) {
+		view := db.AsOf(Instant("2000-01-01T00:00:00Z"))
+		assert.Empty(t, slurp(view.Select(Selection{E: donald})))
+		assert.Empty(t, slurp(view.Select(Selection{E: name})))
+		assert.Len(t, slurp(db.Since(Instant("2000-01-01T00:00:00Z")).Select(Selection{E: donald})), 1)
+	})
+
+	t.Run("since a transaction", func(t *testing.T) {
+		assert.Equal(t, []Datum{
+			{E: donald, A: age, V: Int(48), T: txn2.ID},
+		}, slurp(db.AsOf(txn2.ID).Since(txn1.ID).Select(Selection{E: donald})))
+		assert.Empty(t, slurp(db.Since(txn1.ID).Select(Selection{E: donald})))
+		assert.Len(t, slurp(db.Since(txn.ID).Select(Selection{E: donald})), 1)
+	})
+}
+
+func TestHistory(t *testing.T) {
+	conn := OpenConnection()
+	txn0, err := conn.Write(Request{
+		Claims: []Claim{
+			{E: TempID("status"), A: sys.DbIdent, V: String("order/status")},
+			{E: TempID("status"), A: sys.AttrType, V: sys.AttrTypeString},
+		}},
+	)
+	require.NoError(t, err)
+	status := txn0.NewIDs[TempID("status")]
+	txn1, err := conn.Write(Request{Claims: []Claim{{E: TempID("order"), A: status, V: String("open")}}})
+	require.NoError(t, err)
+	order := txn1.NewIDs[TempID("order")]
+	txn2, err := conn.Write(Request{Claims: []Claim{{E: order, A: status, V: String("shipped")}}})
+	require.NoError(t, err)
+	txn3, err := conn.Write(Request{Claims: []Claim{{E: order, A: status, V: String("shipped"), Retract: true}}})
+	require.NoError(t, err)
+	history := txn3.Database.History()
+	var changes []Change
+	iter := history.Select(Selection{E: order})
+	for iter.Next() {
+		changes = append(changes, iter.Value().(Change))
+	}
+	assert.Equal(t, []Change{
+		{Datum: Datum{E: order, A: status, V: String("open"), T: txn1.ID}, Added: true},
+		{Datum: Datum{E: order, A: status, V: String("open"), T: txn2.ID}, Added: false},
+		{Datum: Datum{E: order, A: status, V: String("shipped"), T: txn2.ID}, Added: true},
+		{Datum: Datum{E: order, A: status, V: String("shipped"), T: txn3.ID}, Added: false},
+	}, changes)
+	// the status changes and the transaction instant
+	assert.Len(t, history.Since(txn1.ID).AsOf(txn2.ID).Dump(), 3)
+}
+
+func TestWith(t *testing.T) {
+	conn := OpenConnection()
+	txn, err := conn.Write(Request{
+		Claims: []Claim{
+			{E: TempID("name"), A: sys.DbIdent, V: String("person/name")},
+			{E: TempID("name"), A: sys.AttrType, V: sys.AttrTypeString},
+			{E: TempID("name"), A: sys.AttrUnique, V: sys.AttrUniqueValue},
+		}},
+	)
+	require.NoError(t, err)
+	name := txn.NewIDs[TempID("name")]
+	db := conn.Read()
+	t.Run("speculates without writing", func(t *testing.T) {
+		spec, err := db.With(Request{Claims: []Claim{{E: TempID("me"), A: name, V: String("Donald")}}})
+		require.NoError(t, err)
+		me := spec.NewIDs[TempID("me")]
+		assert.Equal(t, me, spec.Database.ResolveLookupRef(LookupRef{A: name, V: String("Donald")}))
+		assert.Zero(t, db.ResolveLookupRef(LookupRef{A: name, V: String("Donald")}))
+		assert.Zero(t, conn.Read().ResolveLookupRef(LookupRef{A: name, V: String("Donald")}))
+		spec2, err := spec.Database.With(Request{Claims: []Claim{{E: TempID("you"), A: name, V: String("Stephen")}}})
+		require.NoError(t, err)
+		assert.Greater(t, spec2.NewIDs[TempID("you")], me)
+	})
+	t.Run("speculates schema without writing", func(t *testing.T) {
+		spec, err := db.With(Request{Claims: []Claim{
+			{E: TempID("attr"), A: sys.DbIdent, V: String("spec/attr")},
+			{E: TempID("attr"), A: sys.AttrType, V: sys.AttrTypeString},
+		}})
+		require.NoError(t, err)
+		attr := spec.NewIDs[TempID("attr")]
+		assert.Equal(t, attr, spec.Database.AttrByIdent("spec/attr").ID)
+		assert.Equal(t, Attr{}, db.AttrByIdent("spec/attr"))
+		assert.Equal(t, Attr{}, conn.Read().AttrByIdent("spec/attr"))
+		assert.NotEqual(t, spec.Database.SchemaVersion(), conn.Read().SchemaVersion())
+		txn, err := conn.Write(Request{Claims: []Claim{{E: TempID("other"), A: name, V: String("Other")}}})
+		require.NoError(t, err)
+		assert.Equal(t, Attr{}, txn.Database.AttrByID(txn.NewIDs[TempID("other")]))
+	})
+	t.Run("rejects invalid claims", func(t *testing.T) {
+		_, err := conn.Write(Request{Claims: []Claim{{E: TempID("me"), A: name, V: String("Donald")}}})
+		require.NoError(t, err)
+		_, err = db.With(Request{Claims: []Claim{{E: TempID("you"), A: name, V: String("Donald")}}})
+		require.NoError(t, err)
+		_, err = conn.Read().With(Request{Claims: []Claim{{E: TempID("you"), A: name, V: String("Donald")}}})
+		assert.ErrorIs(t, err, ErrInvalidValue)
+	})
+	t.Run("rejects views", func(t *testing.T) {
+		_, err := db.AsOf(txn.ID).With(Request{})
+		assert.ErrorIs(t, err, ErrWriteToView)
+	})
+}
+
+func TestCAS(t *testing.T) {
+	conn := OpenConnection()
+	txn, err := conn.Write(Request{
+		Claims: []Claim{
+			{E: TempID("count"), A: sys.DbIdent, V: String("counter/count")},
+			{E: TempID("count"), A: sys.AttrType, V: sys.AttrTypeInt},
+			{E: TempID("tag"), A: sys.DbIdent, V: String("counter/tag")},
+			{E: TempID("tag"), A: sys.AttrType, V: sys.AttrTypeString},
+			{E: TempID("tag"), A: sys.AttrCardinality, V: sys.AttrCardinalityMany},
+			{E: TempID("status"), A: sys.DbIdent, V: String("counter/status")},
+			{E: TempID("status"), A: sys.AttrType, V: sys.AttrTypeRef},
+			{E: TempID("open"), A: sys.DbIdent, V: String("status/open")},
+			{E: TempID("closed"), A: sys.DbIdent, V: String("status/closed")},
+		}},
+	)
+	require.NoError(t, err)
+	count := txn.NewIDs[TempID("count")]
+	tag := txn.NewIDs[TempID("tag")]
+	status := txn.NewIDs[TempID("status")]
+	open := txn.NewIDs[TempID("open")]
+	closed := txn.NewIDs[TempID("closed")]
+	txn, err = conn.Write(Request{Claims: []Claim{{E: TempID("counter"), A: count, V: Int(0), CAS: true}}})
+	require.NoError(t, err)
+	counter := txn.NewIDs[TempID("counter")]
+
+	t.Run("swaps the expected value", func(t *testing.T) {
+		txn, err := conn.Write(Request{Claims: []Claim{{E: counter, A: count, V: Int(1), CAS: true, Expect: Int(0)}}})
+		require.NoError(t, err)
+		assert.Equal(t, []Datum{{E: counter, A: count, V: Int(1), T: txn.ID}}, slurp(txn.Database.Select(Selection{E: counter})))
+	})
+	t.Run("rejects a stale value", func(t *testing.T) {
+		_, err := conn.Write(Request{Claims: []Claim{
+			{E: counter, A: tag, V: String("stale")},
+			{E: counter, A: count, V: Int(1), CAS: true, Expect: Int(0)},
+		}})
+		assert.ErrorIs(t, err, ErrCASFailed)
+		assert.Empty(t, slurp(conn.Read().Select(Selection{E: counter, A: tag})))
+	})
+	t.Run("rejects an absent value", func(t *testing.T) {
+		_, err := conn.Write(Request{Claims: []Claim{{E: counter, A: count, V: Int(2), CAS: true}}})
+		assert.ErrorIs(t, err, ErrCASFailed)
+	})
+	t.Run("sees earlier claims in the request", func(t *testing.T) {
+		_, err := conn.Write(Request{Claims: []Claim{
+			{E: counter, A: count, V: Int(2), CAS: true, Expect: Int(1)},
+			{E: counter, A: count, V: Int(3), CAS: true, Expect: Int(2)},
+		}})
+		assert.NoError(t, err)
+	})
+	t.Run("swaps one of many values", func(t *testing.T) {
+		_, err := conn.Write(Request{Claims: []Claim{
+			{E: counter, A: tag, V: String("a")},
+			{E: counter, A: tag, V: String("b")},
+		}})
+		require.NoError(t, err)
+		txn, err := conn.Write(Request{Claims: []Claim{{E: counter, A: tag, V: String("c"), CAS: true, Expect: String("a")}}})
+		require.NoError(t, err)
+		datums := slurp(txn.Database.Select(Selection{E: counter, A: tag}))
+		require.Len(t, datums, 2)
+		assert.Equal(t, String("b"), datums[0].V)
+		assert.Equal(t, String("c"), datums[1].V)
+	})
+	t.Run("expects a ref by ident", func(t *testing.T) {
+		_, err := conn.Write(Request{Claims: []Claim{{E: counter, A: status, V: Ident("status/open")}}})
+		require.NoError(t, err)
+		txn, err := conn.Write(Request{Claims: []Claim{
+			{E: counter, A: status, V: Ident("status/closed"), CAS: true, Expect: Ident("status/open")},
+		}})
+		require.NoError(t, err)
+		assert.Equal(t, []Datum{{E: counter, A: status, V: closed, T: txn.ID}}, slurp(txn.Database.Select(Selection{E: counter, A: status})))
+		_, err = conn.Write(Request{Claims: []Claim{
+			{E: counter, A: status, V: Ident("status/open"), CAS: true, Expect: Ident("status/missing")},
+		}})
+		assert.ErrorIs(t, err, ErrInvalidValue)
+	})
+	t.Run("expects a ref by tempid", func(t *testing.T) {
+		_, err := conn.Write(Request{Claims: []Claim{
+			{E: TempID("paused"), A: sys.DbIdent, V: String("status/paused")},
+			{E: counter, A: status, V: open, CAS: true, Expect: TempID("paused")},
+		}})
+		assert.ErrorIs(t, err, ErrCASFailed)
+	})
+}
+
+func TestRetractAll(t *testing.T) {
+	conn := OpenConnection()
+	txn, err := conn.Write(Request{
+		Claims: []Claim{
+			{E: TempID("tag"), A: sys.DbIdent, V: String("post/tag")},
+			{E: TempID("tag"), A: sys.AttrType, V: sys.AttrTypeString},
+			{E: TempID("tag"), A: sys.AttrCardinality, V: sys.AttrCardinalityMany},
+		}},
+	)
+	require.NoError(t, err)
+	tag := txn.NewIDs[TempID("tag")]
+	txn, err = conn.Write(Request{Claims: []Claim{
+		{E: TempID("post"), A: tag, V: String("a")},
+		{E: TempID("post"), A: tag, V: String("b")},
+	}})
+	require.NoError(t, err)
+	post := txn.NewIDs[TempID("post")]
+	txn, err = conn.Write(Request{Claims: []Claim{
+		{E: post, A: tag, Retract: true},
+		{E: post, A: tag, V: String("b")},
+		{E: post, A: tag, V: String("c")},
+	}})
+	require.NoError(t, err)
+	datums := slurp(txn.Database.Select(Selection{E: post, A: tag}))
+	require.Len(t, datums, 2)
+	assert.Equal(t, String("b"), datums[0].V)
+	assert.Less(t, datums[0].T, txn.ID)
+	assert.Equal(t, String("c"), datums[1].V)
+	iter := txn.Database.History().Select(Selection{E: post, A: tag, V: String("a")})
+	var changes []Change
+	for iter.Next() {
+		changes = append(changes, iter.Value().(Change))
+	}
+	require.Len(t, changes, 2)
+	assert.Equal(t, Change{Datum: Datum{E: post, A: tag, V: String("a"), T: txn.ID}, Added: false}, changes[1])
+
+	// spares only the values asserted for each entity
+	txn, err = conn.Write(Request{Claims: []Claim{
+		{E: TempID("other"), A: tag, V: String("c")},
+		{E: post, A: tag, Retract: true},
+		{E: TempID("other"), A: tag, Retract: true},
+		{E: post, A: tag, V: String("b")},
+		{E: TempID("other"), A: tag, V: String("d")},
+	}})
+	require.NoError(t, err)
+	other := txn.NewIDs[TempID("other")]
+	datums = slurp(txn.Database.Select(Selection{E: post, A: tag}))
+	require.Len(t, datums, 1)
+	assert.Equal(t, String("b"), datums[0].V)
+	datums = slurp(txn.Database.Select(Selection{E: other, A: tag}))
+	require.Len(t, datums, 2)
+	assert.Equal(t, String("c"), datums[0].V)
+	assert.Equal(t, String("d"), datums[1].V)
+}
+
+func TestTxFns(t *testing.T) {
+	conn := OpenConnection()
+	txn, err := conn.Write(Request{
+		Claims: []Claim{
+			{E: TempID("count"), A: sys.DbIdent, V: String("counter/count")},
+			{E: TempID("count"), A: sys.AttrType, V: sys.AttrTypeInt},
+		}},
+	)
+	require.NoError(t, err)
+	count := txn.NewIDs[TempID("count")]
+	txn, err = conn.Write(Request{Claims: []Claim{{E: TempID("counter"), A: count, V: Int(0)}}})
+	require.NoError(t, err)
+	counter := txn.NewIDs[TempID("counter")]
+	require.NoError(t, conn.Register(Ident("counter/inc"), func(db Database, claim Claim) ([]Claim, error) {
+		e := db.ResolveEReadRef(claim.E.(EReadRef))
+		a := db.ResolveARef(claim.A)
+		iter := db.Select(Selection{E: e, A: a})
+		if !iter.Next() {
+			return nil, ErrInvalidValue
+		}
+		n := iter.Value().(Datum).V.(Int)
+		return []Claim{{E: e, A: a, V: n + claim.V.(Int)}}, nil
+	}))
+
+	t.Run("functions see the transaction's claims", func(t *testing.T) {
+		txn, err := conn.Write(Request{Claims: []Claim{
+			{E: counter, A: count, V: Int(1), Fn: Ident("counter/inc")},
+			{E: counter, A: count, V: Int(2), Fn: Ident("counter/inc")},
+		}})
+		require.NoError(t, err)
+		assert.Equal(t, []Datum{{E: counter, A: count, V: Int(3), T: txn.ID}}, slurp(txn.Database.Select(Selection{E: counter})))
+	})
+	t.Run("function errors reject the request", func(t *testing.T) {
+		_, err := conn.Write(Request{Claims: []Claim{
+			{E: counter, A: count, V: Int(1), Fn: Ident("counter/inc")},
+			{E: ID(sys.FirstUserID + 1000), A: count, V: Int(1), Fn: Ident("counter/inc")},
+		}})
+		assert.ErrorIs(t, err, ErrInvalidValue)
+		datums := slurp(conn.Read().Select(Selection{E: counter}))
+		require.Len(t, datums, 1)
+		assert.Equal(t, Int(3), datums[0].V)
+	})
+	t.Run("functions must be registered", func(t *testing.T) {
+		_, err := conn.Write(Request{Claims: []Claim{{E: counter, Fn: Ident("counter/dec")}}})
+		assert.ErrorIs(t, err, ErrUnknownTxFn)
+		assert.ErrorIs(t, conn.Register(Ident("sys/fn/inc"), nil), ErrInvalidUserIdent)
+	})
+	t.Run("functions may not recur without bound", func(t *testing.T) {
+		require.NoError(t, conn.Register(Ident("loop"), func(db Database, claim Claim) ([]Claim, error) {
+			return []Claim{claim}, nil
+		}))
+		_, err := conn.Write(Request{Claims: []Claim{{Fn: Ident("loop")}}})
+		assert.ErrorIs(t, err, ErrTxFnDepth)
+	})
+}
+
+func TestRetractEntity(t *testing.T) {
+	conn := OpenConnection()
+	txn, err := conn.Write(Request{
+		Claims: []Claim{
+			{E: TempID("name"), A: sys.DbIdent, V: String("node/name")},
+			{E: TempID("name"), A: sys.AttrType, V: sys.AttrTypeString},
+			{E: TempID("link"), A: sys.DbIdent, V: String("node/link")},
+			{E: TempID("link"), A: sys.AttrType, V: sys.AttrTypeRef},
+			{E: TempID("part"), A: sys.DbIdent, V: String("node/part")},
+			{E: TempID("part"), A: sys.AttrType, V: sys.AttrTypeRef},
+			{E: TempID("part"), A: sys.AttrRefType, V: sys.AttrRefTypeComponent},
+		}},
+	)
+	require.NoError(t, err)
+	name := txn.NewIDs[TempID("name")]
+	link := txn.NewIDs[TempID("link")]
+	part := txn.NewIDs[TempID("part")]
+	txn, err = conn.Write(Request{
+		Claims: []Claim{
+			{E: TempID("a"), A: name, V: String("a")},
+			{E: TempID("b"), A: name, V: String("b")},
+			{E: TempID("c"), A: name, V: String("c")},
+			{E: TempID("d"), A: name, V: String("d")},
+		},
+	})
+	require.NoError(t, err)
+	a := txn.NewIDs[TempID("a")]
+	b := txn.NewIDs[TempID("b")]
+	c := txn.NewIDs[TempID("c")]
+	d := txn.NewIDs[TempID("d")]
+	named := txn.ID
+	_, err = conn.Write(Request{
+		Claims: []Claim{
+			{E: a, A: link, V: b},
+			{E: b, A: part, V: c},
+			{E: c, A: link, V: b},
+			{E: d, A: link, V: c},
+		},
+	})
+	require.NoError(t, err)
+	txn, err = conn.Write(Request{Claims: []Claim{{E: b, Retract: true}}})
+	require.NoError(t, err)
+	db := txn.Database
+	assert.Equal(t, []Datum{{E: a, A: name, V: String("a"), T: named}}, slurp(db.Select(Selection{E: a})))
+	assert.Empty(t, slurp(db.Select(Selection{E: b})))
+	assert.Empty(t, slurp(db.Select(Selection{E: c})))
+	assert.Equal(t, []Datum{{E: d, A: name, V: String("d"), T: named}}, slurp(db.Select(Selection{E: d})))
+
+	t.Run("only ref attrs may be components", func(t *testing.T) {
+		_, err := conn.Write(Request{Claims: []Claim{{E: name, A: sys.AttrRefType, V: sys.AttrRefTypeComponent}}})
+		assert.ErrorIs(t, err, ErrInvalidAttrRefType)
+	})
+	t.Run("sys entities may not be retracted", func(t *testing.T) {
+		_, err := conn.Write(Request{Claims: []Claim{{E: sys.AttrTypeRef, Retract: true}}})
+		assert.ErrorIs(t, err, ErrInvalidValue)
+	})
+}
+
+func TestComponents(t *testing.T) {
+	conn := OpenConnection()
+	txn, err := conn.Write(Request{
+		Claims: []Claim{
+			{E: TempID("name"), A: sys.DbIdent, V: String("player/name")},
+			{E: TempID("name"), A: sys.AttrType, V: sys.AttrTypeString},
+			{E: TempID("name"), A: sys.AttrUnique, V: sys.AttrUniqueIdentity},
+			{E: TempID("focus"), A: sys.DbIdent, V: String("player/focus")},
+			{E: TempID("focus"), A: sys.AttrType, V: sys.AttrTypeRef},
+			{E: TempID("focus"), A: sys.AttrRefType, V: sys.AttrRefTypeComponent},
+			{E: TempID("rank"), A: sys.DbIdent, V: String("skill/rank")},
+			{E: TempID("rank"), A: sys.AttrType, V: sys.AttrTypeFloat},
+		}},
+	)
+	require.NoError(t, err)
+	name := txn.NewIDs[TempID("name")]
+	focus := txn.NewIDs[TempID("focus")]
+	rank := txn.NewIDs[TempID("rank")]
+	txn, err = conn.Write(Request{
+		Claims: []Claim{
+			{E: TempID("player"), A: name, V: String("Gerhard")},
+			{E: TempID("player"), A: focus, V: TempID("skill")},
+			{E: TempID("skill"), A: rank, V: Float(0.8)},
+		},
+	})
+	require.NoError(t, err)
+	player := txn.NewIDs[TempID("player")]
+	skill := txn.NewIDs[TempID("skill")]
+	assert.Equal(t, []Datum{{E: player, A: focus, V: skill, T: txn.ID}}, slurp(txn.Database.Select(Selection{E: player, A: focus})))
+
+	t.Run("tempids resolve to extant components through identity", func(t *testing.T) {
+		txn, err := conn.Write(Request{
+			Claims: []Claim{
+				{E: TempID("player"), A: name, V: String("Gerhard")},
+				{E: TempID("player"), A: focus, V: TempID("skill")},
+				{E: TempID("skill"), A: rank, V: Float(0.99)},
+			},
+		})
+		require.NoError(t, err)
+		assert.Equal(t, player, txn.NewIDs[TempID("player")])
+		assert.Equal(t, skill, txn.NewIDs[TempID("skill")])
+		assert.Equal(t, []Datum{{E: skill, A: rank, V: Float(0.99), T: txn.ID}}, slurp(txn.Database.Select(Selection{E: skill})))
+	})
+	t.Run("components may not form cycles", func(t *testing.T) {
+		_, err := conn.Write(Request{Claims: []Claim{{E: skill, A: focus, V: player}}})
+		assert.ErrorIs(t, err, ErrComponentCycle)
+		_, err = conn.Write(Request{Claims: []Claim{{E: skill, A: focus, V: skill}}})
+		assert.ErrorIs(t, err, ErrComponentCycle)
+	})
+	t.Run("retracting a component ref retracts the component", func(t *testing.T) {
+		txn, err := conn.Write(Request{Claims: []Claim{{E: player, A: focus, Retract: true}}})
+		require.NoError(t, err)
+		assert.Empty(t, slurp(txn.Database.Select(Selection{E: skill})))
+		assert.Len(t, slurp(txn.Database.Select(Selection{E: player})), 1)
+	})
+}
+
+func TestComponentKeys(t *testing.T) {
+	conn := OpenConnection()
+	txn, err := conn.Write(Request{
+		Claims: []Claim{
+			{E: TempID("number"), A: sys.DbIdent, V: String("order/number")},
+			{E: TempID("number"), A: sys.AttrType, V: sys.AttrTypeInt},
+			{E: TempID("number"), A: sys.AttrUnique, V: sys.AttrUniqueIdentity},
+			{E: TempID("sku"), A: sys.DbIdent, V: String("line/sku")},
+			{E: TempID("sku"), A: sys.AttrType, V: sys.AttrTypeString},
+			{E: TempID("qty"), A: sys.DbIdent, V: String("line/qty")},
+			{E: TempID("qty"), A: sys.AttrType, V: sys.AttrTypeInt},
+			{E: TempID("lines"), A: sys.DbIdent, V: String("order/lines")},
+			{E: TempID("lines"), A: sys.AttrType, V: sys.AttrTypeRef},
+			{E: TempID("lines"), A: sys.AttrCardinality, V: sys.AttrCardinalityMany},
+			{E: TempID("lines"), A: sys.AttrRefType, V: sys.AttrRefTypeComponent},
+			{E: TempID("lines"), A: sys.AttrRefTypeComponentKey, V: Ident("line/sku")},
+			{E: TempID("notes"), A: sys.DbIdent, V: String("order/notes")},
+			{E: TempID("notes"), A: sys.AttrType, V: sys.AttrTypeRef},
+			{E: TempID("notes"), A: sys.AttrCardinality, V: sys.AttrCardinalityMany},
+			{E: TempID("notes"), A: sys.AttrRefType, V: sys.AttrRefTypeComponent},
+		}},
+	)
+	require.NoError(t, err)
+	number := txn.NewIDs[TempID("number")]
+	sku := txn.NewIDs[TempID("sku")]
+	qty := txn.NewIDs[TempID("qty")]
+	lines := txn.NewIDs[TempID("lines")]
+	notes := txn.NewIDs[TempID("notes")]
+	assert.Equal(t, sku, conn.Read().AttrByID(lines).ComponentKey)
+	txn, err = conn.Write(Request{
+		Claims: []Claim{
+			{E: TempID("order"), A: number, V: Int(1)},
+			{E: TempID("order"), A: lines, V: TempID("a")},
+			{E: TempID("order"), A: lines, V: TempID("b")},
+			{E: TempID("order"), A: notes, V: TempID("note")},
+			{E: TempID("a"), A: sku, V: String("apple")},
+			{E: TempID("a"), A: qty, V: Int(1)},
+			{E: TempID("b"), A: sku, V: String("banana")},
+			{E: TempID("b"), A: qty, V: Int(2)},
+			{E: TempID("note"), A: sku, V: String("fragile")},
+		},
+	})
+	require.NoError(t, err)
+	order := txn.NewIDs[TempID("order")]
+	apple := txn.NewIDs[TempID("a")]
+	banana := txn.NewIDs[TempID("b")]
+	note := txn.NewIDs[TempID("note")]
+	ordered := txn.ID
+	txn, err = conn.Write(Request{
+		Claims: []Claim{
+			{E: TempID("order"), A: number, V: Int(1)},
+			{E: TempID("order"), A: lines, V: TempID("b")},
+			{E: TempID("order"), A: lines, V: TempID("c")},
+			{E: TempID("order"), A: notes, V: TempID("note")},
+			{E: TempID("b"), A: sku, V: String("banana")},
+			{E: TempID("b"), A: qty, V: Int(3)},
+			{E: TempID("c"), A: sku, V: String("cherry")},
+			{E: TempID("c"), A: qty, V: Int(4)},
+			{E: TempID("note"), A: sku, V: String("fragile")},
+		},
+	})
+	require.NoError(t, err)
+	db := txn.Database
+	assert.Equal(t, order, txn.NewIDs[TempID("order")])
+
+	t.Run("matched components are updated", func(t *testing.T) {
+		assert.Equal(t, banana, txn.NewIDs[TempID("b")])
+		assert.Equal(t, []Datum{
+			{E: banana, A: sku, V: String("banana"), T: ordered},
+			{E: banana, A: qty, V: Int(3), T: txn.ID},
+		}, slurp(db.Select(Selection{E: banana})))
+	})
+	t.Run("unmatched components are retracted", func(t *testing.T) {
+		assert.Empty(t, slurp(db.Select(Selection{E: apple})))
+		cherry := txn.NewIDs[TempID("c")]
+		assert.NotEqual(t, apple, cherry)
+		var components []ID
+		for _, datum := range slurp(db.Select(Selection{E: order, A: lines})) {
+			components = append(components, datum.V.(ID))
+		}
+		assert.ElementsMatch(t, []ID{banana, cherry}, components)
+	})
+	t.Run("unkeyed components are replaced", func(t *testing.T) {
+		assert.Empty(t, slurp(db.Select(Selection{E: note})))
+		assert.NotEqual(t, note, txn.NewIDs[TempID("note")])
+	})
+}
+
+func TestTxErrors(t *testing.T) {
+	conn := OpenConnection()
+	txn, err := conn.Write(Request{
+		Claims: []Claim{
+			{E: TempID("name"), A: sys.DbIdent, V: String("person/name")},
+			{E: TempID("name"), A: sys.AttrType, V: sys.AttrTypeString},
+			{E: TempID("age"), A: sys.DbIdent, V: String("person/age")},
+			{E: TempID("age"), A: sys.AttrType, V: sys.AttrTypeInt},
+		}},
+	)
+	require.NoError(t, err)
+	name := txn.NewIDs[TempID("name")]
+	age := txn.NewIDs[TempID("age")]
+	require.NoError(t, conn.Register(Ident("person/birth"), func(db Database, claim Claim) ([]Claim, error) {
+		return []Claim{{E: claim.E, A: age, V: String("newborn")}}, nil
+	}))
+
+	t.Run("identifies the rejected claim", func(t *testing.T) {
+		claim := Claim{E: TempID("me"), A: Ident("person/age"), V: String("old")}
+		_, err := conn.Write(Request{Claims: []Claim{{E: TempID("me"), A: name, V: String("Donald")}, claim}})
+		assert.ErrorIs(t, err, ErrInvalidValue)
+		var txErr *TxError
+		require.ErrorAs(t, err, &txErr)
+		assert.Equal(t, 1, txErr.Index)
+		assert.Equal(t, claim, txErr.Claim)
+		assert.Equal(t, Ident("person/age"), txErr.Attr)
+		assert.Equal(t, age, txErr.Datum.A)
+		assert.Equal(t, String("old"), txErr.Datum.V)
+		assert.NotZero(t, txErr.Datum.E)
+	})
+	t.Run("identifies claims returned by functions", func(t *testing.T) {
+		_, err := conn.Write(Request{Claims: []Claim{
+			{E: TempID("me"), A: name, V: String("Donald")},
+			{E: TempID("me"), A: name, V: String("Donald")},
+			{E: TempID("me"), Fn: Ident("person/birth")},
+		}})
+		var txErr *TxError
+		require.ErrorAs(t, err, &txErr)
+		assert.Equal(t, 2, txErr.Index)
+		assert.Equal(t, Claim{E: TempID("me"), A: age, V: String("newborn")}, txErr.Claim)
+		assert.ErrorIs(t, err, ErrInvalidValue)
+	})
+	t.Run("identifies unknown attrs", func(t *testing.T) {
+		_, err := conn.Write(Request{Claims: []Claim{{E: TempID("me"), A: Ident("person/shoe"), V: Int(9)}}})
+		var txErr *TxError
+		require.ErrorAs(t, err, &txErr)
+		assert.Equal(t, Ident("person/shoe"), txErr.Attr)
+		assert.Zero(t, txErr.Datum.A)
+	})
+}
+
+func slurp(iter *iterator.Iterator) (datums []Datum) {
+	for iter.Next() {
+		datums = append(datums, iter.Value().(Datum))
+	}
+	return datums
+}
+
+func TestListen(t *testing.T) {
+	conn := OpenConnection()
+	txn, err := conn.Write(Request{
+		Claims: []Claim{
+			{E: TempID("name"), A: sys.DbIdent, V: String("person/name")},
+			{E: TempID("name"), A: sys.AttrType, V: sys.AttrTypeString},
+			{E: TempID("name"), A: sys.AttrUnique, V: sys.AttrUniqueIdentity},
+			{E: TempID("age"), A: sys.DbIdent, V: String("person/age")},
+			{E: TempID("age"), A: sys.AttrType, V: sys.AttrTypeInt},
+		}},
+	)
+	require.NoError(t, err)
+	name := txn.NewIDs[TempID("name")]
+	age := txn.NewIDs[TempID("age")]
+	var reports []TxReport
+	stop := conn.Listen(func(report TxReport) {
+		reports = append(reports, report)
+	})
+	txn1, err := conn.Write(Request{
+		Claims: []Claim{
+			{E: TempID("me"), A: name, V: String("Donald")},
+			{E: TempID("me"), A: age, V: Int(47)},
+		},
+	})
+	require.NoError(t, err)
+	donald := txn1.NewIDs[TempID("me")]
+	txn2, err := conn.Write(Request{
+		Claims: []Claim{
+			{E: donald, A: age, V: Int(48)},
+		},
+	})
+	require.NoError(t, err)
+	stop()
+	_, err = conn.Write(Request{
+		Claims: []Claim{
+			{E: donald, A: age, V: Int(49)},
+		},
+	})
+	require.NoError(t, err)
+	require.Len(t, reports, 2)
+
+	t.Run("reports the changes", func(t *testing.T) {
+		report := reports[0]
+		assert.Equal(t, txn1.ID, report.ID)
+		require.Len(t, report.Changes, 3)
+		assert.Equal(t, []Change{
+			{Datum: Datum{E: donald, A: name, V: String("Donald"), T: txn1.ID}, Added: true},
+			{Datum: Datum{E: donald, A: age, V: Int(47), T: txn1.ID}, Added: true},
+		}, report.Changes[:2])
+		assert.Equal(t, sys.TxAt, report.Changes[2].A)
+		assert.Equal(t, []Change{
+			{Datum: Datum{E: donald, A: age, V: Int(47), T: txn2.ID}, Added: false},
+			{Datum: Datum{E: donald, A: age, V: Int(48), T: txn2.ID}, Added: true},
+		}, reports[1].Changes[:2])
+	})
+	t.Run("reports the databases before and after", func(t *testing.T) {
+		report := reports[0]
+		assert.Empty(t, slurp(report.DbBefore.Select(Selection{E: donald})))
+		assert.Len(t, slurp(report.DbAfter.Select(Selection{E: donald})), 2)
+	})
+}
+
+func TestSubscribe(t *testing.T) {
+	conn := OpenConnection()
+	txn, err := conn.Write(Request{
+		Claims: []Claim{
+			{E: TempID("name"), A: sys.DbIdent, V: String("person/name")},
+			{E: TempID("name"), A: sys.AttrType, V: sys.AttrTypeString},
+			{E: TempID("name"), A: sys.AttrUnique, V: sys.AttrUniqueIdentity},
+			{E: TempID("age"), A: sys.DbIdent, V: String("person/age")},
+			{E: TempID("age"), A: sys.AttrType, V: sys.AttrTypeInt},
+		}},
+	)
+	require.NoError(t, err)
+	name := txn.NewIDs[TempID("name")]
+	age := txn.NewIDs[TempID("age")]
+	txn, err = conn.Write(Request{
+		Claims: []Claim{
+			{E: TempID("donald"), A: name, V: String("Donald")},
+			{E: TempID("stephen"), A: name, V: String("Stephen")},
+		},
+	})
+	require.NoError(t, err)
+	donald := txn.NewIDs[TempID("donald")]
+	stephen := txn.NewIDs[TempID("stephen")]
+	ages, cancelAges := conn.Subscribe(TxFilter{Attrs: []Ident{"person/age"}})
+	donalds, cancelDonalds := conn.Subscribe(TxFilter{Entities: []ID{donald}})
+	txn1, err := conn.Write(Request{
+		Claims: []Claim{
+			{E: stephen, A: age, V: Int(44)},
+		},
+	})
+	require.NoError(t, err)
+	txn2, err := conn.Write(Request{
+		Claims: []Claim{
+			{E: donald, A: age, V: Int(48)},
+		},
+	})
+	require.NoError(t, err)
+	cancelAges()
+	cancelDonalds()
+
+	t.Run("attr filter", func(t *testing.T) {
+		var reports []TxReport
+		for report := range ages {
+			reports = append(reports, report)
+		}
+		require.Len(t, reports, 2)
+		assert.Equal(t, txn1.ID, reports[0].ID)
+		assert.Equal(t, []Change{
+			{Datum: Datum{E: stephen, A: age, V: Int(44), T: txn1.ID}, Added: true},
+		}, reports[0].Changes)
+		assert.Equal(t, txn2.ID, reports[1].ID)
+	})
+	t.Run("entity filter", func(t *testing.T) {
+		var reports []TxReport
+		for report := range donalds {
+			reports = append(reports, report)
+		}
+		require.Len(t, reports, 1)
+		assert.Equal(t, txn2.ID, reports[0].ID)
+		assert.Equal(t, []Change{
+			{Datum: Datum{E: donald, A: age, V: Int(48), T: txn2.ID}, Added: true},
+		}, reports[0].Changes)
+	})
+	t.Run("ends rather than blocking writes when full", func(t *testing.T) {
+		listeners := len(conn.(*BTreeConnection).listeners)
+		reports, cancel := conn.Subscribe(TxFilter{Entities: []ID{stephen}})
+		defer cancel()
+		for i := 0; i <= subscriptionBuffer; i++ {
+			_, err := conn.Write(Request{Claims: []Claim{{E: stephen, A: age, V: Int(i)}}})
+			require.NoError(t, err)
+		}
+		n := 0
+		for range reports {
+			n++
+		}
+		assert.Equal(t, subscriptionBuffer, n)
+		assert.Len(t, conn.(*BTreeConnection).listeners, listeners)
+		cancel()
+		cancel()
+	})
+}
+
+func TestWatch(t *testing.T) {
+	conn := OpenConnection()
+	txn, err := conn.Write(Request{
+		Claims: []Claim{
+			{E: TempID("name"), A: sys.DbIdent, V: String("person/name")},
+			{E: TempID("name"), A: sys.AttrType, V: sys.AttrTypeString},
+			{E: TempID("name"), A: sys.AttrUnique, V: sys.AttrUniqueIdentity},
+			{E: TempID("age"), A: sys.DbIdent, V: String("person/age")},
+			{E: TempID("age"), A: sys.AttrType, V: sys.AttrTypeInt},
+		}},
+	)
+	require.NoError(t, err)
+	name := txn.NewIDs[TempID("name")]
+	age := txn.NewIDs[TempID("age")]
+	txn, err = conn.Write(Request{
+		Claims: []Claim{
+			{E: TempID("donald"), A: name, V: String("Donald")},
+		},
+	})
+	require.NoError(t, err)
+	donald := txn.NewIDs[TempID("donald")]
+	db := conn.Read()
+	// received returns the results delivered since it was last called, if any. Watches
+	// evaluate on their own goroutines, but are given only the transactions whose changes
+	// match, so once the watch has delivered, nothing more is delivered until such a write.
+	received := func(results <-chan []Datum) []Datum {
+		select {
+		case datums := <-results:
+			return datums
+		default:
+			return nil
+		}
+	}
+	// next returns the next results delivered, waiting for them.
+	next := func(t *testing.T, results <-chan []Datum) []Datum {
+		select {
+		case datums := <-results:
+			return datums
+		case <-time.After(time.Second):
+			t.Fatal("no results delivered")
+			return nil
+		}
+	}
+
+	t.Run("reevaluates when matching datums change", func(t *testing.T) {
+		results, cancel := db.Watch(Selection{A: age})
+		defer cancel()
+		assert.Equal(t, []Datum{}, next(t, results))
+		txn1, err := conn.Write(Request{Claims: []Claim{{E: donald, A: age, V: Int(48)}}})
+		require.NoError(t, err)
+		assert.Equal(t, []Datum{{E: donald, A: age, V: Int(48), T: txn1.ID}}, next(t, results))
+		_, err = conn.Write(Request{Claims: []Claim{{E: TempID("stephen"), A: name, V: String("Stephen")}}})
+		require.NoError(t, err)
+		assert.Nil(t, received(results))
+		_, err = conn.Write(Request{Claims: []Claim{{E: donald, A: age, V: Int(48)}}})
+		require.NoError(t, err)
+		assert.Nil(t, received(results))
+		txn2, err := conn.Write(Request{Claims: []Claim{{E: donald, A: age, V: Int(49)}}})
+		require.NoError(t, err)
+		assert.Equal(t, []Datum{{E: donald, A: age, V: Int(49), T: txn2.ID}}, next(t, results))
+	})
+	t.Run("catches up with transactions since the database", func(t *testing.T) {
+		results, cancel := db.Watch(Selection{E: donald, A: age})
+		defer cancel()
+		datums := next(t, results)
+		require.Len(t, datums, 1)
+		assert.Equal(t, Int(49), datums[0].V)
+		assert.Nil(t, received(results))
+	})
+	t.Run("delivers only the latest results to watchers that fall behind", func(t *testing.T) {
+		results, cancel := conn.Read().Watch(Selection{E: donald, A: age})
+		for i := 50; i < 50+subscriptionBuffer; i++ {
+			_, err := conn.Write(Request{Claims: []Claim{{E: donald, A: age, V: Int(i)}}})
+			require.NoError(t, err)
+		}
+		cancel()
+		var all [][]Datum
+		for datums := range results {
+			all = append(all, datums)
+		}
+		require.Len(t, all, 1)
+		assert.Equal(t, Int(49+subscriptionBuffer), all[0][0].V)
+	})
+	t.Run("views as of a transaction do not change", func(t *testing.T) {
+		results, cancel := db.AsOf(txn.ID).Watch(Selection{A: name})
+		_, err := conn.Write(Request{Claims: []Claim{{E: TempID("ada"), A: name, V: String("Ada")}}})
+		require.NoError(t, err)
+		cancel()
+		var all [][]Datum
+		for datums := range results {
+			all = append(all, datums)
+		}
+		assert.Equal(t, [][]Datum{{{E: donald, A: name, V: String("Donald"), T: txn.ID}}}, all)
+	})
+}
+
+func TestBulkLoader(t *testing.T) {
+	schema := []Claim{
+		{E: TempID("name"), A: sys.DbIdent, V: String("person/name")},
+		{E: TempID("name"), A: sys.AttrType, V: sys.AttrTypeString},
+		{E: TempID("name"), A: sys.AttrUnique, V: sys.AttrUniqueIdentity},
+		{E: TempID("age"), A: sys.DbIdent, V: String("person/age")},
+		{E: TempID("age"), A: sys.AttrType, V: sys.AttrTypeInt},
+		{E: TempID("friends"), A: sys.DbIdent, V: String("person/friends")},
+		{E: TempID("friends"), A: sys.AttrType, V: sys.AttrTypeRef},
+		{E: TempID("friends"), A: sys.AttrCardinality, V: sys.AttrCardinalityMany},
+	}
+
+	t.Run("loads across batches", func(t *testing.T) {
+		conn := OpenConnection()
+		txn, err := conn.Write(Request{Claims: append(schema,
+			Claim{E: TempID("donald"), A: Ident("person/name"), V: String("Donald")},
+			Claim{E: TempID("donald"), A: Ident("person/age"), V: Int(48)},
+		)})
+		require.NoError(t, err)
+		donald := txn.NewIDs[TempID("donald")]
+		var reports []TxReport
+		conn.Listen(func(report TxReport) {
+			reports = append(reports, report)
+		})
+		loader := conn.BulkLoader()
+		n := 2*bulkBatchSize + 1
+		for i := 0; i < n; i++ {
+			tempID := TempID(fmt.Sprintf("p%d", i))
+			require.NoError(t, loader.Add(
+				Claim{E: tempID, A: Ident("person/age"), V: Int(i)},
+				Claim{E: tempID, A: Ident("person/name"), V: String(fmt.Sprintf("person %d", i))},
+			))
+		}
+		require.NoError(t, loader.Add(
+			Claim{E: TempID("again"), A: Ident("person/name"), V: String("person 0")},
+			Claim{E: TempID("again"), A: Ident("person/friends"), V: TempID("p1")},
+			Claim{E: TempID("again"), A: Ident("person/friends"), V: TempID("p1")},
+			Claim{E: TempID("me"), A: Ident("person/name"), V: String("Donald")},
+			Claim{E: TempID("me"), A: Ident("person/age"), V: Int(49)},
+		))
+		txn, err = loader.Load()
+		require.NoError(t, err)
+		db := txn.Database
+		p0 := txn.NewIDs[TempID("p0")]
+		p1 := txn.NewIDs[TempID("p1")]
+		assert.Equal(t, p0, txn.NewIDs[TempID("again")])
+		assert.Equal(t, donald, txn.NewIDs[TempID("me")])
+		assert.Equal(t, []Datum{
+			{E: p0, A: db.AttrByIdent("person/name").ID, V: String("person 0"), T: txn.ID},
+			{E: p0, A: db.AttrByIdent("person/age").ID, V: Int(0), T: txn.ID},
+			{E: p0, A: db.AttrByIdent("person/friends").ID, V: p1, T: txn.ID},
+		}, slurp(db.Select(Selection{E: p0})))
+		ages := slurp(db.Select(Selection{E: donald, A: db.AttrByIdent("person/age").ID}))
+		assert.Equal(t, []Datum{{E: donald, A: db.AttrByIdent("person/age").ID, V: Int(49), T: txn.ID}}, ages)
+		assert.Len(t, slurp(db.Select(Selection{A: db.AttrByIdent("person/name").ID})), n+1)
+		require.Len(t, reports, 1)
+		assert.Equal(t, txn.ID, reports[0].ID)
+	})
+	t.Run("rejects unique conflicts", func(t *testing.T) {
+		conn := OpenConnection()
+		loader := conn.BulkLoader()
+		require.NoError(t, loader.Add(schema...))
+		require.NoError(t, loader.Add(
+			Claim{E: TempID("a"), A: Ident("person/name"), V: String("Donald")},
+			Claim{E: TempID("a"), A: Ident("person/age"), V: Int(1)},
+			Claim{E: TempID("b"), A: Ident("person/age"), V: Int(2)},
+			Claim{E: TempID("b"), A: Ident("person/age"), V: Int(3)},
+			Claim{E: TempID("c"), A: Ident("person/age"), V: Int(4)},
+		))
+		txn, err := loader.Load()
+		require.NoError(t, err)
+		age := txn.Database.AttrByIdent("person/age").ID
+		assert.Equal(t, Int(3), txn.Database.(*BTreeDatabase).idx.SelectOne(Selection{E: txn.NewIDs[TempID("b")], A: age}).V)
+		loader = conn.BulkLoader()
+		require.NoError(t, loader.Add(
+			Claim{E: TempID("b"), A: Ident("person/age"), V: Int(2)},
+			Claim{E: ID(sys.FirstUserID + 10), A: Ident("person/name"), V: String("Donald")},
+		))
+		_, err = loader.Load()
+		assert.ErrorIs(t, err, ErrInvalidValue)
+		var txErr *TxError
+		require.ErrorAs(t, err, &txErr)
+		assert.Equal(t, 1, txErr.Index)
+		assert.ErrorIs(t, loader.Add(Claim{E: TempID("c"), A: Ident("person/age"), V: Int(4)}), ErrInvalidValue)
+	})
+	t.Run("resolves tempids across batches", func(t *testing.T) {
+		conn := OpenConnection()
+		txn, err := conn.Write(Request{Claims: append(schema,
+			Claim{E: TempID("donald"), A: Ident("person/name"), V: String("Donald")},
+		)})
+		require.NoError(t, err)
+		donald := txn.NewIDs[TempID("donald")]
+		loader := conn.BulkLoader()
+		require.NoError(t, loader.Add(Claim{E: TempID("stephen"), A: Ident("person/friends"), V: TempID("me")}))
+		for i := 0; i < bulkBatchSize; i++ {
+			require.NoError(t, loader.Add(Claim{E: TempID(fmt.Sprintf("p%d", i)), A: Ident("person/age"), V: Int(i)}))
+		}
+		require.NoError(t, loader.Add(Claim{E: TempID("me"), A: Ident("person/name"), V: String("Donald")}))
+		txn, err = loader.Load()
+		require.NoError(t, err)
+		assert.Equal(t, donald, txn.NewIDs[TempID("me")])
+		friends := txn.Database.AttrByIdent("person/friends").ID
+		assert.Equal(t, []Datum{{E: txn.NewIDs[TempID("stephen")], A: friends, V: donald, T: txn.ID}},
+			slurp(txn.Database.Select(Selection{A: friends})))
+	})
+	t.Run("reports the attrs of rejected claims", func(t *testing.T) {
+		conn := OpenConnection()
+		loader := conn.BulkLoader()
+		require.NoError(t, loader.Add(schema...))
+		age := loader.(*BTreeBulkLoader).tx.newIdx.AttrByIdent("person/age").ID
+		require.NoError(t, loader.Add(Claim{E: TempID("a"), A: age, V: String("old")}))
+		_, err := loader.Load()
+		var txErr *TxError
+		require.ErrorAs(t, err, &txErr)
+		assert.Equal(t, len(schema), txErr.Index)
+		assert.Equal(t, Ident("person/age"), txErr.Attr)
+	})
+	t.Run("rejects retractions", func(t *testing.T) {
+		conn := OpenConnection()
+		loader := conn.BulkLoader()
+		assert.ErrorIs(t, loader.Add(Claim{E: ID(sys.FirstUserID), Retract: true}), ErrBulkClaim)
+		_, err := loader.Load()
+		assert.ErrorIs(t, err, ErrBulkClaim)
+	})
+	t.Run("rejects concurrent writes", func(t *testing.T) {
+		conn := OpenConnection()
+		loader := conn.BulkLoader()
+		require.NoError(t, loader.Add(schema...))
+		_, err := conn.Write(Request{Claims: schema})
+		require.NoError(t, err)
+		_, err = loader.Load()
+		assert.ErrorIs(t, err, ErrConcurrentWrite)
+	})
+	t.Run("publishes schema only when loaded", func(t *testing.T) {
+		conn := OpenConnection()
+		abandoned := conn.BulkLoader()
+		require.NoError(t, abandoned.Add(schema...))
+		failed := conn.BulkLoader()
+		require.NoError(t, failed.Add(schema...))
+		require.NoError(t, failed.Add(Claim{E: TempID("x"), A: Ident("person/age"), V: String("old")}))
+		_, err := failed.Load()
+		assert.ErrorIs(t, err, ErrInvalidValue)
+		assert.Equal(t, Attr{}, conn.Read().AttrByIdent("person/name"))
+		loader := conn.BulkLoader()
+		require.NoError(t, loader.Add(schema...))
+		_, err = loader.Load()
+		require.NoError(t, err)
+		assert.Equal(t, sys.AttrUniqueIdentity, conn.Read().AttrByIdent("person/name").Unique)
+	})
+}
+
+func TestGroupCommit(t *testing.T) {
+	schema := []Claim{
+		{E: TempID("name"), A: sys.DbIdent, V: String("person/name")},
+		{E: TempID("name"), A: sys.AttrType, V: sys.AttrTypeString},
+		{E: TempID("name"), A: sys.AttrUnique, V: sys.AttrUniqueValue},
+	}
+
+	t.Run("pending requests are written as a group", func(t *testing.T) {
+		conn := OpenConnection().(*BTreeConnection)
+		_, err := conn.Write(Request{Claims: schema})
+		require.NoError(t, err)
+		var reports []TxReport
+		conn.Listen(func(report TxReport) {
+			reports = append(reports, report)
+		})
+		donald := &pendingWrite{request: Request{Claims: []Claim{
+			{E: TempID("p"), A: Ident("person/name"), V: String("Donald")},
+		}}, reported: make(chan Void)}
+		duplicate := &pendingWrite{request: Request{Claims: []Claim{
+			{E: TempID("p"), A: Ident("person/name"), V: String("Donald")},
+		}}, reported: make(chan Void)}
+		conn.pending = []*pendingWrite{donald, duplicate}
+		txn, err := conn.Write(Request{Claims: []Claim{
+			{E: TempID("p"), A: Ident("person/name"), V: String("Stephen")},
+		}})
+		require.NoError(t, err)
+		<-donald.reported
+		<-duplicate.reported
+		require.NoError(t, donald.err)
+		assert.ErrorIs(t, duplicate.err, ErrInvalidValue)
+		assert.Less(t, donald.txn.ID, txn.ID)
+		require.Len(t, reports, 2)
+		assert.Equal(t, donald.txn.ID, reports[0].ID)
+		assert.Equal(t, txn.ID, reports[1].ID)
+		lookup := LookupRef{A: Ident("person/name"), V: String("Donald")}
+		assert.Equal(t, donald.txn.NewIDs[TempID("p")], reports[1].DbBefore.ResolveLookupRef(lookup))
+		assert.Zero(t, reports[0].DbBefore.ResolveLookupRef(lookup))
+	})
+	t.Run("rejected requests in a group are rolled back", func(t *testing.T) {
+		conn := OpenConnection().(*BTreeConnection)
+		_, err := conn.Write(Request{Claims: schema})
+		require.NoError(t, err)
+		donald := &pendingWrite{request: Request{Claims: []Claim{
+			{E: TempID("p"), A: Ident("person/name"), V: String("Donald")},
+		}}, reported: make(chan Void)}
+		rejected := &pendingWrite{request: Request{Claims: []Claim{
+			{E: TempID("age"), A: sys.DbIdent, V: String("person/age")},
+			{E: TempID("age"), A: sys.AttrType, V: sys.AttrTypeInt},
+			{E: TempID("ada"), A: Ident("person/name"), V: String("Ada")},
+			{E: LookupRef{A: Ident("person/name"), V: String("Donald")}, A: Ident("person/name"), V: String("Donny")},
+			{E: TempID("other"), A: Ident("person/name"), V: String("Donny")},
+		}}, reported: make(chan Void)}
+		conn.pending = []*pendingWrite{donald, rejected}
+		txn, err := conn.Write(Request{Claims: []Claim{
+			{E: TempID("p"), A: Ident("person/name"), V: String("Stephen")},
+		}})
+		require.NoError(t, err)
+		<-donald.reported
+		<-rejected.reported
+		require.NoError(t, donald.err)
+		assert.ErrorIs(t, rejected.err, ErrInvalidValue)
+		db := txn.Database
+		id := donald.txn.NewIDs[TempID("p")]
+		assert.Equal(t, id, db.ResolveLookupRef(LookupRef{A: Ident("person/name"), V: String("Donald")}))
+		assert.Zero(t, db.ResolveLookupRef(LookupRef{A: Ident("person/name"), V: String("Donny")}))
+		assert.Zero(t, db.ResolveLookupRef(LookupRef{A: Ident("person/name"), V: String("Ada")}))
+		assert.Equal(t, Attr{}, db.AttrByIdent("person/age"))
+		assert.Equal(t, donald.txn.Database.SchemaVersion(), db.SchemaVersion())
+		changes := 0
+		iter := db.History().Select(Selection{E: id})
+		for iter.Next() {
+			changes++
+		}
+		assert.Equal(t, 1, changes)
+		// each transaction's database excludes the transactions after it
+		assert.Zero(t, donald.txn.Database.ResolveLookupRef(LookupRef{A: Ident("person/name"), V: String("Stephen")}))
+		assert.Equal(t, txn.NewIDs[TempID("p")], db.ResolveLookupRef(LookupRef{A: Ident("person/name"), V: String("Stephen")}))
+	})
+	t.Run("concurrent writers each get their own transactions", func(t *testing.T) {
+		conn := OpenConnection()
+		_, err := conn.Write(Request{Claims: schema})
+		require.NoError(t, err)
+		var ids []ID
+		conn.Listen(func(report TxReport) {
+			ids = append(ids, report.ID)
+		})
+		n := 64
+		txns := make([]Transaction, n)
+		errs := make([]error, n)
+		var wg sync.WaitGroup
+		for i := 0; i < n; i++ {
+			wg.Add(1)
+			go func(i int) {
+				defer wg.Done()
+				// every other writer claims a name already claimed
+				name := String(fmt.Sprintf("person %d", i/2*2))
+				txns[i], errs[i] = conn.Write(Request{Claims: []Claim{
+					{E: TempID("p"), A: Ident("person/name"), V: name},
+				}})
+			}(i)
+		}
+		wg.Wait()
+		accepted := map[ID]Void{}
+		for i := 0; i < n; i += 2 {
+			if errs[i] == nil && errs[i+1] == nil {
+				t.Fatalf("both writers of a name were accepted")
+			}
+			for _, j := range []int{i, i + 1} {
+				if errs[j] == nil {
+					accepted[txns[j].ID] = Void{}
+				} else {
+					assert.ErrorIs(t, errs[j], ErrInvalidValue)
+				}
+			}
+		}
+		assert.Len(t, accepted, n/2)
+		require.Len(t, ids, n/2)
+		for i := 1; i < len(ids); i++ {
+			assert.Less(t, ids[i-1], ids[i])
+		}
+		assert.Len(t, slurp(conn.Read().Select(Selection{A: conn.Read().AttrByIdent("person/name").ID})), n/2)
+	})
 }
@@ -0,0 +1,203 @@
+package database
+
+import (
+	"github.com/dball/constructive/pkg/sys"
+	. "github.com/dball/constructive/pkg/types"
+)
+
+// resolveTempIDs resolves the tempids in the claims that have not already been resolved,
+// before any of the claims are applied, so the order of the claims is immaterial.
+//
+// A tempid resolves to an extant entity if any claim about it asserts a value of an
+// identity unique attr held by that entity. A tempid claimed as the value of an extant
+// entity's component ref may resolve to an extant component. Since either may allow
+// more tempids to resolve, these proceed until no more tempids resolve. The remaining
+// tempids are allocated new ids in order of appearance.
+//
+// Tempids that would resolve to more than one entity are rejected.
+func (tx *transactor) resolveTempIDs(txn Transaction, claims []Claim) (err error) {
+	for {
+		var identities, components bool
+		identities, err = tx.resolveIdentities(txn, claims)
+		if err != nil {
+			return
+		}
+		components, err = tx.resolveComponents(txn, claims)
+		if err != nil {
+			return
+		}
+		if !identities && !components {
+			break
+		}
+	}
+	for _, claim := range claims {
+		if claim.Fn != "" {
+			continue
+		}
+		if tempID, ok := claim.E.(TempID); ok {
+			tx.allocTempID(txn, tempID)
+		}
+		if tempID, ok := claim.V.(TempID); ok {
+			tx.allocTempID(txn, tempID)
+		}
+	}
+	return
+}
+
+// allocTempID allocates a new id for the tempid if it has not been resolved.
+func (tx *transactor) allocTempID(txn Transaction, tempID TempID) {
+	if _, ok := txn.NewIDs[tempID]; !ok {
+		txn.NewIDs[tempID] = tx.allocID()
+	}
+}
+
+// resolveIdentities resolves the tempids with claims asserting values of identity unique
+// attrs held by extant entities.
+func (tx *transactor) resolveIdentities(txn Transaction, claims []Claim) (resolved bool, err error) {
+	for i, claim := range claims {
+		tempID, ok := claim.E.(TempID)
+		if !ok || claim.Fn != "" {
+			continue
+		}
+		v, ok := claim.V.(Value)
+		if !ok || v == nil {
+			continue
+		}
+		attr := tx.newIdx.AttrByID(tx.resolveARef(claim.A))
+		if attr.Unique != sys.AttrUniqueIdentity {
+			continue
+		}
+		iter := tx.newIdx.Filter(IndexAVE, Datum{A: attr.ID, V: v})
+		if !iter.Next() {
+			continue
+		}
+		e := iter.Value().(Datum).E
+		iter.Stop()
+		id, ok := txn.NewIDs[tempID]
+		switch {
+		case !ok:
+			txn.NewIDs[tempID] = e
+			resolved = true
+		case id != e:
+			err = &TxError{Index: i, Claim: claim, Datum: Datum{E: e, A: attr.ID, V: v}, Attr: attr.Ident, Err: ErrTempIDConflict}
+			return
+		}
+	}
+	return
+}
+
+// resolveComponents resolves the tempids claimed as the values of component refs of
+// extant entities, as described in the README.
+func (tx *transactor) resolveComponents(txn Transaction, claims []Claim) (resolved bool, err error) {
+	for i, claim := range claims {
+		if claim.Retract || claim.Fn != "" {
+			continue
+		}
+		attr := tx.newIdx.AttrByID(tx.resolveARef(claim.A))
+		if attr.RefType != sys.AttrRefTypeComponent {
+			continue
+		}
+		e := tx.resolveEWriteRef(txn, claim.E)
+		if e == 0 {
+			continue
+		}
+		if attr.Cardinality == sys.AttrCardinalityMany {
+			var set bool
+			set, err = tx.resolveComponentSet(txn, e, attr, claims)
+			if err != nil {
+				err = &TxError{Index: i, Claim: claim, Datum: Datum{E: e, A: attr.ID}, Attr: attr.Ident, Err: err}
+				return
+			}
+			resolved = resolved || set
+			continue
+		}
+		tempID, ok := claim.V.(TempID)
+		if !ok {
+			continue
+		}
+		if _, ok := txn.NewIDs[tempID]; ok {
+			continue
+		}
+		extant := tx.newIdx.SelectOne(Selection{E: e, A: attr.ID})
+		if extant.E != 0 {
+			txn.NewIDs[tempID] = extant.V.(ID)
+			resolved = true
+		}
+	}
+	return
+}
+
+// resolveComponentSet resolves the components claimed for an extant entity's cardinality
+// many component attr, once per transaction. If the attr has a component key, the tempids
+// claimed as components resolve to the extant components with the same key values. Extant
+// components that are neither so matched nor claimed by id are retracted.
+func (tx *transactor) resolveComponentSet(txn Transaction, e ID, attr Attr, claims []Claim) (resolved bool, err error) {
+	set := componentSet{e: e, a: attr.ID}
+	if _, ok := tx.componentSets[set]; ok {
+		return
+	}
+	tx.componentSets[set] = Void{}
+	var extant []ID
+	iter := tx.newIdx.Select(Selection{E: e, A: attr.ID})
+	for iter.Next() {
+		extant = append(extant, iter.Value().(Datum).V.(ID))
+	}
+	if len(extant) == 0 {
+		return
+	}
+	kept := map[ID]Void{}
+	claimed := map[TempID]Void{}
+	for _, claim := range claims {
+		if claim.Retract || claim.Fn != "" || tx.resolveARef(claim.A) != attr.ID || tx.resolveEWriteRef(txn, claim.E) != e {
+			continue
+		}
+		switch v := claim.V.(type) {
+		case TempID:
+			claimed[v] = Void{}
+		case ID:
+			kept[v] = Void{}
+		}
+	}
+	if attr.ComponentKey != 0 {
+		keys := make(map[Value]ID, len(extant))
+		for _, component := range extant {
+			key := tx.newIdx.SelectOne(Selection{E: component, A: attr.ComponentKey})
+			if key.E != 0 {
+				keys[key.V] = component
+			}
+		}
+		for _, claim := range claims {
+			tempID, ok := claim.E.(TempID)
+			if !ok || claim.Retract || tx.resolveARef(claim.A) != attr.ComponentKey {
+				continue
+			}
+			if _, ok := claimed[tempID]; !ok {
+				continue
+			}
+			if _, ok := txn.NewIDs[tempID]; ok {
+				continue
+			}
+			v, ok := claim.V.(Value)
+			if !ok {
+				continue
+			}
+			component, ok := keys[v]
+			if !ok {
+				continue
+			}
+			txn.NewIDs[tempID] = component
+			kept[component] = Void{}
+			resolved = true
+		}
+	}
+	for _, component := range extant {
+		if _, ok := kept[component]; ok {
+			continue
+		}
+		err = tx.retractEntity(txn, component, map[ID]Void{})
+		if err != nil {
+			return
+		}
+	}
+	return
+}
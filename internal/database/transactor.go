@@ -0,0 +1,373 @@
+package database
+
+import (
+	"errors"
+
+	"github.com/dball/constructive/internal/index"
+	"github.com/dball/constructive/pkg/sys"
+	. "github.com/dball/constructive/pkg/types"
+)
+
+// transactor applies the claims in a request to a clone of an index. The original
+// index is never changed, so a transactor may be discarded on failure or used to
+// speculate about the consequences of a request.
+type transactor struct {
+	idx    *index.BTreeIndex
+	newIdx *index.BTreeIndex
+	nextID ID
+	clock  Clock
+	fns    map[Ident]TxFn
+	// conn is the connection to which the transaction will be committed, if any.
+	conn *BTreeConnection
+	// componentSets records the component sets that have been resolved in the transaction.
+	componentSets map[componentSet]Void
+}
+
+// componentSet identifies the components of an entity for a cardinality many component attr.
+type componentSet struct {
+	e ID
+	a ID
+}
+
+// maxTxFnDepth limits the nesting of transaction functions invoked by the claims
+// returned by transaction functions.
+const maxTxFnDepth = 64
+
+func newTransactor(idx *index.BTreeIndex, nextID ID, clock Clock, fns map[Ident]TxFn) *transactor {
+	return &transactor{
+		idx:           idx,
+		newIdx:        idx.Clone(),
+		nextID:        nextID,
+		clock:         clock,
+		fns:           fns,
+		componentSets: map[componentSet]Void{},
+	}
+}
+
+// transact applies the request as described in BTreeConnection.Write. On success,
+// the transactor's new index and next id reflect the transaction.
+func (tx *transactor) transact(request Request) (txn Transaction, err error) {
+	tx.componentSets = map[componentSet]Void{}
+	txn.NewIDs = make(map[TempID]ID)
+	txn.ID = tx.allocID()
+	err = tx.resolveTempIDs(txn, request.Claims)
+	if err == nil {
+		err = tx.applyClaims(txn, request.Claims, 0)
+	}
+	if err == nil {
+		_, err = tx.newIdx.Assert(Datum{E: txn.ID, A: sys.TxAt, V: Inst(tx.clock.Now()), T: txn.ID})
+	}
+	if err != nil {
+		txn.ID = ID(0)
+		txn.NewIDs = nil
+		return
+	}
+	txn.Database = tx.database()
+	return
+}
+
+// applyClaims applies the claims in order, replacing the claims that invoke transaction
+// functions with the claims they return. A rejected claim is reported by a TxError whose
+// index is that of the claim in the given claims, or of the claim invoking the function
+// that returned it.
+func (tx *transactor) applyClaims(txn Transaction, claims []Claim, depth int) (err error) {
+	asserted := &assertions{claims: claims}
+	for i, claim := range claims {
+		var datum Datum
+		if claim.Fn != "" {
+			err = tx.invoke(txn, claim, depth)
+		} else {
+			datum, err = tx.applyClaim(txn, claim, asserted)
+		}
+		if err == nil {
+			continue
+		}
+		var txErr *TxError
+		if errors.As(err, &txErr) {
+			txErr.Index = i
+			return txErr
+		}
+		attr := tx.newIdx.AttrByID(datum.A).Ident
+		if attr == "" {
+			attr, _ = claim.A.(Ident)
+		}
+		return &TxError{Index: i, Claim: claim, Datum: datum, Attr: attr, Err: err}
+	}
+	return
+}
+
+// applyClaim applies the claim, which is one of the asserted claims, returning the datum
+// to which the claim resolved, as far as it resolved.
+func (tx *transactor) applyClaim(txn Transaction, claim Claim, asserted *assertions) (datum Datum, err error) {
+	datum.T = txn.ID
+	if claim.Retract && claim.A == nil {
+		datum.E = tx.resolveEWriteRef(txn, claim.E)
+		err = tx.retractEntity(txn, datum.E, map[ID]Void{})
+		return
+	}
+	a := tx.resolveARef(claim.A)
+	datum.A = a
+	attr := tx.newIdx.AttrByID(a)
+	v, _ := claim.V.(Value)
+	e := tx.resolveEWriteRef(txn, claim.E)
+	datum.E = e
+	switch vref := claim.V.(type) {
+	case TempID:
+		v = txn.NewIDs[vref]
+	case Ident:
+		id := tx.newIdx.ResolveIdent(vref)
+		if id == 0 {
+			err = ErrInvalidValue
+			return
+		}
+		v = id
+	}
+	datum.V = v
+	if claim.CAS {
+		err = tx.compareAndSwap(txn, e, a, claim.Expect)
+		if err != nil {
+			return
+		}
+	}
+	if claim.Retract {
+		var datums []Datum
+		iter := tx.newIdx.Select(Selection{E: e, A: a})
+		for iter.Next() {
+			datum := iter.Value().(Datum)
+			if v == nil && !tx.asserts(txn, asserted, datum) || v != nil && Compare(datum.V, v) == 0 {
+				datums = append(datums, datum)
+			}
+		}
+		for _, retraction := range datums {
+			retraction.T = txn.ID
+			err = tx.newIdx.Retract(retraction)
+			if err == nil && attr.RefType == sys.AttrRefTypeComponent {
+				err = tx.retractEntity(txn, retraction.V.(ID), map[ID]Void{})
+			}
+			if err != nil {
+				return
+			}
+		}
+		return
+	}
+	_, err = tx.newIdx.Assert(datum)
+	if err == nil && attr.RefType == sys.AttrRefTypeComponent {
+		err = tx.checkComponentCycle(e, v.(ID))
+	}
+	return
+}
+
+// assertions indexes the datums asserted by a list of claims, so that claims to retract
+// every value of an entity's attr spare the values the other claims assert. The index is
+// built when first needed, and then only once for the list.
+type assertions struct {
+	claims []Claim
+	values map[entityAttrValue]Void
+}
+
+// asserts is true if the claims assert the datum's value for its entity and attr.
+func (tx *transactor) asserts(txn Transaction, asserted *assertions, datum Datum) bool {
+	if asserted.values == nil {
+		asserted.values = make(map[entityAttrValue]Void, len(asserted.claims))
+		for _, claim := range asserted.claims {
+			if claim.Retract || claim.Fn != "" {
+				continue
+			}
+			var v Value
+			switch vref := claim.V.(type) {
+			case TempID:
+				v = txn.NewIDs[vref]
+			case Ident:
+				v = tx.newIdx.ResolveIdent(vref)
+			case Value:
+				v = vref
+			default:
+				continue
+			}
+			key := entityAttrValue{e: tx.resolveEWriteRef(txn, claim.E), a: tx.resolveARef(claim.A), v: valueKey(v)}
+			asserted.values[key] = Void{}
+		}
+	}
+	_, ok := asserted.values[entityAttrValue{e: datum.E, a: datum.A, v: valueKey(datum.V)}]
+	return ok
+}
+
+// checkComponentCycle rejects a component ref from e to v if e is v or is, recursively,
+// one of v's components.
+func (tx *transactor) checkComponentCycle(e ID, v ID) error {
+	visited := map[ID]Void{}
+	pending := []ID{v}
+	for len(pending) > 0 {
+		x := pending[len(pending)-1]
+		pending = pending[:len(pending)-1]
+		if x == e {
+			return ErrComponentCycle
+		}
+		if _, ok := visited[x]; ok {
+			continue
+		}
+		visited[x] = Void{}
+		iter := tx.newIdx.Select(Selection{E: x})
+		for iter.Next() {
+			datum := iter.Value().(Datum)
+			if tx.newIdx.AttrByID(datum.A).RefType == sys.AttrRefTypeComponent {
+				pending = append(pending, datum.V.(ID))
+			}
+		}
+	}
+	return nil
+}
+
+// retractEntity retracts every datum about the entity and every ref datum whose value
+// is the entity, then recursively retracts the entity's components.
+func (tx *transactor) retractEntity(txn Transaction, e ID, retracted map[ID]Void) (err error) {
+	if e < sys.FirstUserID {
+		return ErrInvalidValue
+	}
+	if _, ok := retracted[e]; ok {
+		return
+	}
+	retracted[e] = Void{}
+	var datums []Datum
+	var components []ID
+	iter := tx.newIdx.Select(Selection{E: e})
+	for iter.Next() {
+		datum := iter.Value().(Datum)
+		datums = append(datums, datum)
+		if tx.newIdx.AttrByID(datum.A).RefType == sys.AttrRefTypeComponent {
+			components = append(components, datum.V.(ID))
+		}
+	}
+	iter = tx.newIdx.Referrers(e)
+	for iter.Next() {
+		datums = append(datums, iter.Value().(Datum))
+	}
+	for _, datum := range datums {
+		datum.T = txn.ID
+		err = tx.newIdx.Retract(datum)
+		if err != nil {
+			return
+		}
+	}
+	for _, component := range components {
+		err = tx.retractEntity(txn, component, retracted)
+		if err != nil {
+			return
+		}
+	}
+	return
+}
+
+// invoke applies the claims returned by the transaction function the claim invokes,
+// given the database as it stands in the transaction. The function is given a clone of
+// the new index, so any iterators it leaves running do not read the index as it changes.
+func (tx *transactor) invoke(txn Transaction, claim Claim, depth int) (err error) {
+	if depth >= maxTxFnDepth {
+		return ErrTxFnDepth
+	}
+	fn, ok := tx.fns[claim.Fn]
+	if !ok {
+		return ErrUnknownTxFn
+	}
+	db := tx.database()
+	db.idx = db.idx.Clone()
+	db.conn = nil
+	claims, err := fn(db, claim)
+	if err != nil {
+		return
+	}
+	err = tx.resolveTempIDs(txn, claims)
+	if err != nil {
+		return
+	}
+	return tx.applyClaims(txn, claims, depth+1)
+}
+
+// database returns a snapshot of the transactor's new index.
+func (tx *transactor) database() *BTreeDatabase {
+	return &BTreeDatabase{idx: tx.newIdx, nextID: tx.nextID, clock: tx.clock, fns: tx.fns, conn: tx.conn}
+}
+
+// compareAndSwap verifies the expected value of a compare-and-swap claim is current
+// in the transaction, retracting it if the attribute has cardinality many. The expected
+// value resolves as the claim's value does, so a ref may be expected by Ident or TempID.
+func (tx *transactor) compareAndSwap(txn Transaction, e ID, a ID, expect VRef) (err error) {
+	attr := tx.newIdx.AttrByID(a)
+	if attr.ID == 0 {
+		return ErrInvalidAttr
+	}
+	var expected Value
+	switch vref := expect.(type) {
+	case nil:
+	case Value:
+		expected = vref
+	case TempID:
+		expected = txn.NewIDs[vref]
+	case Ident:
+		id := tx.newIdx.ResolveIdent(vref)
+		if id == 0 {
+			return ErrInvalidValue
+		}
+		expected = id
+	default:
+		return ErrInvalidValue
+	}
+	found := false
+	iter := tx.newIdx.Select(Selection{E: e, A: a})
+	for iter.Next() {
+		datum := iter.Value().(Datum)
+		if expected == nil || Compare(datum.V, expected) == 0 {
+			found = true
+			iter.Stop()
+			break
+		}
+	}
+	switch {
+	case expected == nil && found:
+		return ErrCASFailed
+	case expected != nil && !found:
+		return ErrCASFailed
+	case expected != nil && attr.Cardinality == sys.AttrCardinalityMany:
+		return tx.newIdx.Retract(Datum{E: e, A: a, V: expected, T: txn.ID})
+	}
+	return
+}
+
+func (tx *transactor) allocID() (id ID) {
+	id = tx.nextID
+	if id == 0xffffffffffffffff {
+		panic("id-space-exhausted")
+	}
+	tx.nextID++
+	return
+}
+
+// resolveEWriteRef resolves an entity ref, returning 0 if it cannot be resolved. TempIDs
+// must have been resolved by resolveTempIDs.
+func (tx *transactor) resolveEWriteRef(txn Transaction, eref EWriteRef) ID {
+	switch e := eref.(type) {
+	case ID:
+		return e
+	case LookupRef:
+		return tx.newIdx.ResolveLookupRef(e)
+	case TempID:
+		return txn.NewIDs[e]
+	case TxnID:
+		return txn.ID
+	case Ident:
+		return tx.newIdx.ResolveIdent(e)
+	}
+	return ID(0)
+}
+
+func (tx *transactor) resolveARef(aref ARef) ID {
+	switch a := aref.(type) {
+	case ID:
+		return a
+	case LookupRef:
+		panic("TODO")
+	case Ident:
+		return tx.newIdx.ResolveIdent(a)
+	}
+	return ID(0)
+}
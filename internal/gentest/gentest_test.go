@@ -0,0 +1,183 @@
+package gentest
+
+import (
+	"fmt"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/dball/constructive/internal/database"
+	"github.com/dball/constructive/pkg/destruct"
+	"github.com/dball/constructive/pkg/types"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+// normalize renames the tempids in the claims by their order of appearance.
+func normalize(claims []types.Claim) []types.Claim {
+	names := map[types.TempID]types.TempID{}
+	normalized := make([]types.Claim, len(claims))
+	for i, claim := range claims {
+		if tempid, ok := claim.E.(types.TempID); ok {
+			name, ok := names[tempid]
+			if !ok {
+				name = types.TempID(fmt.Sprint(len(names)))
+				names[tempid] = name
+			}
+			claim.E = name
+		}
+		normalized[i] = claim
+	}
+	return normalized
+}
+
+func people() []Person {
+	nickname := "Dee"
+	return []Person{
+		{},
+		{Name: "Donald", Age: 48, Height: 1.8, Born: time.Date(1974, 3, 11, 0, 0, 0, 0, time.UTC)},
+		{ID: 1000, Name: "Stephen", Retired: true, Nickname: &nickname, Scores: []int16{3, -1, 3}},
+		{Name: "Diane", Age: 39, Scores: []int16{}, Tags: map[string]struct{}{"b": {}, "a": {}, "c": {}}},
+	}
+}
+
+func gadgets() []Gadget {
+	size := uint(12)
+	return []Gadget{
+		{},
+		{Serial: "x-1", Weight: 0.5, Count: 3},
+		{ID: 1001, Serial: "x-2", Size: &size},
+	}
+}
+
+func TestDestructAgrees(t *testing.T) {
+	for i, person := range people() {
+		t.Run(fmt.Sprintf("person %d", i), func(t *testing.T) {
+			expected, err := destruct.DestructOnlyData(person)
+			require.NoError(t, err)
+			actual, err := DestructPerson(person)
+			require.NoError(t, err)
+			assert.Equal(t, normalize(expected), normalize(actual))
+		})
+	}
+	for i, gadget := range gadgets() {
+		t.Run(fmt.Sprintf("gadget %d", i), func(t *testing.T) {
+			expected, err := destruct.DestructOnlyData(gadget)
+			require.NoError(t, err)
+			actual, err := DestructGadget(gadget)
+			require.NoError(t, err)
+			assert.Equal(t, normalize(expected), normalize(actual))
+		})
+	}
+	t.Run("overflow", func(t *testing.T) {
+		_, expected := destruct.DestructOnlyData(Gadget{ID: -1})
+		_, actual := DestructGadget(Gadget{ID: -1})
+		assert.ErrorIs(t, actual, types.ErrAttrFieldOverflow)
+		assert.EqualError(t, actual, expected.Error())
+	})
+}
+
+// write records the schema and the claims, returning the resulting database and the
+// ids of the records' entities.
+func write(t *testing.T, claims []types.Claim) (types.Database, []types.ID) {
+	conn := database.OpenConnection()
+	personSchema, err := destruct.Schema(reflect.TypeOf(Person{}))
+	require.NoError(t, err)
+	gadgetSchema, err := destruct.Schema(reflect.TypeOf(Gadget{}))
+	require.NoError(t, err)
+	_, err = conn.Write(types.Request{Claims: append(personSchema, gadgetSchema...)})
+	require.NoError(t, err)
+	txn, err := conn.Write(types.Request{Claims: claims})
+	require.NoError(t, err)
+	var ids []types.ID
+	seen := map[types.ID]bool{}
+	for _, claim := range claims {
+		var id types.ID
+		switch e := claim.E.(type) {
+		case types.TempID:
+			id = txn.NewIDs[e]
+		case types.ID:
+			id = e
+		}
+		if !seen[id] {
+			seen[id] = true
+			ids = append(ids, id)
+		}
+	}
+	return txn.Database, ids
+}
+
+// destructAll destructures the people and gadgets by their generated functions.
+func destructAll(t *testing.T, people []Person, gadgets []Gadget) []types.Claim {
+	var claims []types.Claim
+	for _, person := range people {
+		pclaims, err := DestructPerson(person)
+		require.NoError(t, err)
+		claims = append(claims, pclaims...)
+	}
+	for _, gadget := range gadgets {
+		gclaims, err := DestructGadget(gadget)
+		require.NoError(t, err)
+		claims = append(claims, gclaims...)
+	}
+	return claims
+}
+
+func TestConstructAgrees(t *testing.T) {
+	db, ids := write(t, destructAll(t, people(), gadgets()))
+	require.Len(t, ids, len(people())+len(gadgets()))
+	for i, id := range ids[:len(people())] {
+		t.Run(fmt.Sprintf("person %d", i), func(t *testing.T) {
+			var expected, actual Person
+			expectedOK, err := destruct.Construct(&expected, db, id)
+			require.NoError(t, err)
+			actualOK, err := ConstructPerson(&actual, db, id)
+			require.NoError(t, err)
+			assert.Equal(t, expectedOK, actualOK)
+			assert.Equal(t, expected, actual)
+		})
+	}
+	for i, id := range ids[len(people()):] {
+		t.Run(fmt.Sprintf("gadget %d", i), func(t *testing.T) {
+			var expected, actual Gadget
+			expectedOK, err := destruct.Construct(&expected, db, id)
+			require.NoError(t, err)
+			actualOK, err := ConstructGadget(&actual, db, id)
+			require.NoError(t, err)
+			assert.Equal(t, expectedOK, actualOK)
+			assert.Equal(t, expected, actual)
+		})
+	}
+	t.Run("missing", func(t *testing.T) {
+		var actual Person
+		ok, err := ConstructPerson(&actual, db, 99999)
+		require.NoError(t, err)
+		assert.False(t, ok)
+	})
+	t.Run("overflow", func(t *testing.T) {
+		db, ids := write(t, []types.Claim{{E: types.TempID("g"), A: types.Ident("gadget/count"), V: types.Int(300)}})
+		_, expected := destruct.Construct(&Gadget{}, db, ids[0])
+		_, actual := ConstructGadget(&Gadget{}, db, ids[0])
+		assert.ErrorIs(t, actual, types.ErrAttrFieldOverflow)
+		assert.EqualError(t, actual, expected.Error())
+	})
+}
+
+func TestQueries(t *testing.T) {
+	db, ids := write(t, destructAll(t, people(), nil))
+	donald, stephen, diane := ids[1], ids[2], ids[3]
+
+	assert.Equal(t, []types.ID{donald}, PersonQuery().NameIs("Donald").Entities(db))
+	assert.Equal(t, []types.ID{donald, diane}, PersonQuery().NameIn("Donald", "Diane", "Nobody").Entities(db))
+	assert.Equal(t, []types.ID{diane}, PersonQuery().NameIn("Donald", "Diane").AgeBetween(30, 40).Entities(db))
+	assert.Equal(t, []types.ID{stephen}, PersonQuery().RetiredIs(true).Entities(db))
+	assert.Equal(t, []types.ID{stephen}, PersonQuery().ScoresIs(-1).Entities(db))
+	assert.Equal(t, []types.ID{diane}, PersonQuery().TagsIn("c", "d").Entities(db))
+	assert.Empty(t, PersonQuery().NameIs("Donald").RetiredIs(true).Entities(db))
+
+	records, err := PersonQuery().AgeBetween(40, 50).Fetch(db)
+	require.NoError(t, err)
+	require.Len(t, records, 1)
+	assert.Equal(t, "Donald", records[0].Name)
+	assert.Equal(t, uint64(donald), records[0].ID)
+}
@@ -0,0 +1,28 @@
+// Package gentest has records whose functions are generated by constructive-gen, to
+// prove they agree with the destruct package.
+package gentest
+
+import "time"
+
+//go:generate go run ../../cmd/constructive-gen -type=Person,Gadget
+
+type Person struct {
+	ID       uint64              `attr:"sys/db/id"`
+	Name     string              `attr:"person/name,identity"`
+	Age      int                 `attr:"person/age"`
+	Height   float64             `attr:"person/height"`
+	Born     time.Time           `attr:"person/born,omitempty"`
+	Retired  bool                `attr:"person/retired"`
+	Nickname *string             `attr:"person/nickname"`
+	Scores   []int16             `attr:"person/scores"`
+	Tags     map[string]struct{} `attr:"person/tags"`
+}
+
+type Gadget struct {
+	_      struct{} `namespace:"gadget"`
+	ID     int      `attr:"sys/db/id"`
+	Serial string   `attr:"serial,unique"`
+	Weight float32  `attr:"weight"`
+	Count  uint8    `attr:"count,omitempty"`
+	Size   *uint    `attr:"size"`
+}
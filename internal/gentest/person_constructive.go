@@ -0,0 +1,572 @@
+// Code generated by "constructive-gen -type=Person,Gadget"; DO NOT EDIT.
+
+package gentest
+
+import (
+	"fmt"
+	"math"
+	"sort"
+	"time"
+
+	"github.com/dball/constructive/pkg/destruct"
+	"github.com/dball/constructive/pkg/types"
+)
+
+// DestructPerson returns the claims about the Person's attrs, as destruct.DestructOnlyData,
+// without reflection.
+func DestructPerson(x Person) ([]types.Claim, error) {
+	var e types.EWriteRef
+	if x.ID != 0 {
+		e = types.ID(x.ID)
+	} else {
+		e = destruct.NewTempID()
+	}
+	claims := make([]types.Claim, 0, 8)
+	// Name
+	{
+		v := types.String(x.Name)
+		if !v.IsEmpty() {
+			claims = append(claims, types.Claim{E: e, A: types.Ident("person/name"), V: v})
+		}
+	}
+	// Age
+	{
+		v := types.Int(x.Age)
+		claims = append(claims, types.Claim{E: e, A: types.Ident("person/age"), V: v})
+	}
+	// Height
+	{
+		v := types.Float(x.Height)
+		claims = append(claims, types.Claim{E: e, A: types.Ident("person/height"), V: v})
+	}
+	// Born
+	if x.Born == (time.Time{}) {
+		claims = append(claims, types.Claim{E: e, A: types.Ident("person/born"), Retract: true})
+	} else {
+		v := types.Inst(x.Born)
+		claims = append(claims, types.Claim{E: e, A: types.Ident("person/born"), V: v})
+	}
+	// Retired
+	{
+		v := types.Bool(x.Retired)
+		claims = append(claims, types.Claim{E: e, A: types.Ident("person/retired"), V: v})
+	}
+	// Nickname
+	if x.Nickname == nil {
+		claims = append(claims, types.Claim{E: e, A: types.Ident("person/nickname"), Retract: true})
+	} else {
+		v := types.String(*x.Nickname)
+		claims = append(claims, types.Claim{E: e, A: types.Ident("person/nickname"), V: v})
+	}
+	// Scores
+	if x.Scores != nil {
+		claims = append(claims, types.Claim{E: e, A: types.Ident("person/scores"), Retract: true})
+		for _, el := range x.Scores {
+			v := types.Int(el)
+			claims = append(claims, types.Claim{E: e, A: types.Ident("person/scores"), V: v})
+		}
+	}
+	// Tags
+	if x.Tags != nil {
+		claims = append(claims, types.Claim{E: e, A: types.Ident("person/tags"), Retract: true})
+		vs := make([]types.Value, 0, len(x.Tags))
+		for el := range x.Tags {
+			v := types.String(el)
+			vs = append(vs, v)
+		}
+		sort.Slice(vs, func(i, j int) bool { return types.Compare(vs[i], vs[j]) < 0 })
+		for _, value := range vs {
+			v := value.(types.VRef)
+			claims = append(claims, types.Claim{E: e, A: types.Ident("person/tags"), V: v})
+		}
+	}
+	return claims, nil
+}
+
+// ConstructPerson populates the Person from the datums about the entity, as destruct.Construct,
+// without reflection.
+func ConstructPerson(x *Person, db types.Database, id types.ID) (bool, error) {
+	{
+		n := int64(id)
+		if n < 0 {
+			return false, fmt.Errorf("gentest.Person.ID: %w", types.ErrAttrFieldOverflow)
+		}
+		x.ID = uint64(n)
+	}
+	a0 := db.AttrByIdent("person/name").ID
+	a1 := db.AttrByIdent("person/age").ID
+	a2 := db.AttrByIdent("person/height").ID
+	a3 := db.AttrByIdent("person/born").ID
+	a4 := db.AttrByIdent("person/retired").ID
+	a5 := db.AttrByIdent("person/nickname").ID
+	if a5 != 0 {
+		x.Nickname = nil
+	}
+	a6 := db.AttrByIdent("person/scores").ID
+	if a6 != 0 {
+		x.Scores = nil
+	}
+	a7 := db.AttrByIdent("person/tags").ID
+	if a7 != 0 {
+		x.Tags = nil
+	}
+	found := false
+	iter := db.Select(types.Selection{E: id})
+	for iter.Next() {
+		found = true
+		datum := iter.Value().(types.Datum)
+		switch datum.A {
+		case a0:
+			x.Name = string(datum.V.(types.String))
+		case a1:
+			n := int64(datum.V.(types.Int))
+			if n < math.MinInt || n > math.MaxInt {
+				return false, fmt.Errorf("gentest.Person.Age: %w", types.ErrAttrFieldOverflow)
+			}
+			x.Age = int(n)
+		case a2:
+			x.Height = float64(datum.V.(types.Float))
+		case a3:
+			x.Born = time.Time(datum.V.(types.Inst))
+		case a4:
+			x.Retired = bool(datum.V.(types.Bool))
+		case a5:
+			var el string
+			el = string(datum.V.(types.String))
+			x.Nickname = &el
+		case a6:
+			var el int16
+			n := int64(datum.V.(types.Int))
+			if n < math.MinInt16 || n > math.MaxInt16 {
+				return false, fmt.Errorf("gentest.Person.Scores: %w", types.ErrAttrFieldOverflow)
+			}
+			el = int16(n)
+			x.Scores = append(x.Scores, el)
+		case a7:
+			if x.Tags == nil {
+				x.Tags = map[string]struct{}{}
+			}
+			var el string
+			el = string(datum.V.(types.String))
+			x.Tags[el] = struct{}{}
+		}
+	}
+	return found, nil
+}
+
+// PersonQueryBuilder builds selections of Person entities by their attrs.
+type PersonQueryBuilder struct {
+	selections []types.Selection
+}
+
+// PersonQuery begins a query for Person entities.
+func PersonQuery() *PersonQueryBuilder {
+	return &PersonQueryBuilder{}
+}
+
+// NameIs selects the entities whose person/name is the value.
+func (q *PersonQueryBuilder) NameIs(v string) *PersonQueryBuilder {
+	q.selections = append(q.selections, types.Selection{A: types.Ident("person/name"), V: types.String(v)})
+	return q
+}
+
+// NameIn selects the entities whose person/name is any of the values.
+func (q *PersonQueryBuilder) NameIn(vs ...string) *PersonQueryBuilder {
+	set := make(types.VSet, len(vs))
+	for _, v := range vs {
+		set[types.String(v)] = types.Void{}
+	}
+	q.selections = append(q.selections, types.Selection{A: types.Ident("person/name"), V: set})
+	return q
+}
+
+// NameBetween selects the entities whose person/name is between the values, inclusive.
+func (q *PersonQueryBuilder) NameBetween(min string, max string) *PersonQueryBuilder {
+	q.selections = append(q.selections, types.Selection{A: types.Ident("person/name"), V: types.VRange{Min: types.String(min), Max: types.String(max)}})
+	return q
+}
+
+// AgeIs selects the entities whose person/age is the value.
+func (q *PersonQueryBuilder) AgeIs(v int) *PersonQueryBuilder {
+	q.selections = append(q.selections, types.Selection{A: types.Ident("person/age"), V: types.Int(v)})
+	return q
+}
+
+// AgeIn selects the entities whose person/age is any of the values.
+func (q *PersonQueryBuilder) AgeIn(vs ...int) *PersonQueryBuilder {
+	set := make(types.VSet, len(vs))
+	for _, v := range vs {
+		set[types.Int(v)] = types.Void{}
+	}
+	q.selections = append(q.selections, types.Selection{A: types.Ident("person/age"), V: set})
+	return q
+}
+
+// AgeBetween selects the entities whose person/age is between the values, inclusive.
+func (q *PersonQueryBuilder) AgeBetween(min int, max int) *PersonQueryBuilder {
+	q.selections = append(q.selections, types.Selection{A: types.Ident("person/age"), V: types.VRange{Min: types.Int(min), Max: types.Int(max)}})
+	return q
+}
+
+// HeightIs selects the entities whose person/height is the value.
+func (q *PersonQueryBuilder) HeightIs(v float64) *PersonQueryBuilder {
+	q.selections = append(q.selections, types.Selection{A: types.Ident("person/height"), V: types.Float(v)})
+	return q
+}
+
+// HeightIn selects the entities whose person/height is any of the values.
+func (q *PersonQueryBuilder) HeightIn(vs ...float64) *PersonQueryBuilder {
+	set := make(types.VSet, len(vs))
+	for _, v := range vs {
+		set[types.Float(v)] = types.Void{}
+	}
+	q.selections = append(q.selections, types.Selection{A: types.Ident("person/height"), V: set})
+	return q
+}
+
+// HeightBetween selects the entities whose person/height is between the values, inclusive.
+func (q *PersonQueryBuilder) HeightBetween(min float64, max float64) *PersonQueryBuilder {
+	q.selections = append(q.selections, types.Selection{A: types.Ident("person/height"), V: types.VRange{Min: types.Float(min), Max: types.Float(max)}})
+	return q
+}
+
+// BornIs selects the entities whose person/born is the value.
+func (q *PersonQueryBuilder) BornIs(v time.Time) *PersonQueryBuilder {
+	q.selections = append(q.selections, types.Selection{A: types.Ident("person/born"), V: types.Inst(v)})
+	return q
+}
+
+// BornIn selects the entities whose person/born is any of the values.
+func (q *PersonQueryBuilder) BornIn(vs ...time.Time) *PersonQueryBuilder {
+	set := make(types.VSet, len(vs))
+	for _, v := range vs {
+		set[types.Inst(v)] = types.Void{}
+	}
+	q.selections = append(q.selections, types.Selection{A: types.Ident("person/born"), V: set})
+	return q
+}
+
+// BornBetween selects the entities whose person/born is between the values, inclusive.
+func (q *PersonQueryBuilder) BornBetween(min time.Time, max time.Time) *PersonQueryBuilder {
+	q.selections = append(q.selections, types.Selection{A: types.Ident("person/born"), V: types.VRange{Min: types.Inst(min), Max: types.Inst(max)}})
+	return q
+}
+
+// RetiredIs selects the entities whose person/retired is the value.
+func (q *PersonQueryBuilder) RetiredIs(v bool) *PersonQueryBuilder {
+	q.selections = append(q.selections, types.Selection{A: types.Ident("person/retired"), V: types.Bool(v)})
+	return q
+}
+
+// RetiredIn selects the entities whose person/retired is any of the values.
+func (q *PersonQueryBuilder) RetiredIn(vs ...bool) *PersonQueryBuilder {
+	set := make(types.VSet, len(vs))
+	for _, v := range vs {
+		set[types.Bool(v)] = types.Void{}
+	}
+	q.selections = append(q.selections, types.Selection{A: types.Ident("person/retired"), V: set})
+	return q
+}
+
+// NicknameIs selects the entities whose person/nickname is the value.
+func (q *PersonQueryBuilder) NicknameIs(v string) *PersonQueryBuilder {
+	q.selections = append(q.selections, types.Selection{A: types.Ident("person/nickname"), V: types.String(v)})
+	return q
+}
+
+// NicknameIn selects the entities whose person/nickname is any of the values.
+func (q *PersonQueryBuilder) NicknameIn(vs ...string) *PersonQueryBuilder {
+	set := make(types.VSet, len(vs))
+	for _, v := range vs {
+		set[types.String(v)] = types.Void{}
+	}
+	q.selections = append(q.selections, types.Selection{A: types.Ident("person/nickname"), V: set})
+	return q
+}
+
+// NicknameBetween selects the entities whose person/nickname is between the values, inclusive.
+func (q *PersonQueryBuilder) NicknameBetween(min string, max string) *PersonQueryBuilder {
+	q.selections = append(q.selections, types.Selection{A: types.Ident("person/nickname"), V: types.VRange{Min: types.String(min), Max: types.String(max)}})
+	return q
+}
+
+// ScoresIs selects the entities whose person/scores is the value.
+func (q *PersonQueryBuilder) ScoresIs(v int16) *PersonQueryBuilder {
+	q.selections = append(q.selections, types.Selection{A: types.Ident("person/scores"), V: types.Int(v)})
+	return q
+}
+
+// ScoresIn selects the entities whose person/scores is any of the values.
+func (q *PersonQueryBuilder) ScoresIn(vs ...int16) *PersonQueryBuilder {
+	set := make(types.VSet, len(vs))
+	for _, v := range vs {
+		set[types.Int(v)] = types.Void{}
+	}
+	q.selections = append(q.selections, types.Selection{A: types.Ident("person/scores"), V: set})
+	return q
+}
+
+// ScoresBetween selects the entities whose person/scores is between the values, inclusive.
+func (q *PersonQueryBuilder) ScoresBetween(min int16, max int16) *PersonQueryBuilder {
+	q.selections = append(q.selections, types.Selection{A: types.Ident("person/scores"), V: types.VRange{Min: types.Int(min), Max: types.Int(max)}})
+	return q
+}
+
+// TagsIs selects the entities whose person/tags is the value.
+func (q *PersonQueryBuilder) TagsIs(v string) *PersonQueryBuilder {
+	q.selections = append(q.selections, types.Selection{A: types.Ident("person/tags"), V: types.String(v)})
+	return q
+}
+
+// TagsIn selects the entities whose person/tags is any of the values.
+func (q *PersonQueryBuilder) TagsIn(vs ...string) *PersonQueryBuilder {
+	set := make(types.VSet, len(vs))
+	for _, v := range vs {
+		set[types.String(v)] = types.Void{}
+	}
+	q.selections = append(q.selections, types.Selection{A: types.Ident("person/tags"), V: set})
+	return q
+}
+
+// TagsBetween selects the entities whose person/tags is between the values, inclusive.
+func (q *PersonQueryBuilder) TagsBetween(min string, max string) *PersonQueryBuilder {
+	q.selections = append(q.selections, types.Selection{A: types.Ident("person/tags"), V: types.VRange{Min: types.String(min), Max: types.String(max)}})
+	return q
+}
+
+// Selections returns the query's selections.
+func (q *PersonQueryBuilder) Selections() []types.Selection {
+	return q.selections
+}
+
+// Entities returns the ids of the entities matching all of the query's selections, in order.
+func (q *PersonQueryBuilder) Entities(db types.Database) []types.ID {
+	return destruct.SelectEntities(db, q.selections...)
+}
+
+// Fetch returns the records of the entities matching all of the query's selections.
+func (q *PersonQueryBuilder) Fetch(db types.Database) ([]Person, error) {
+	ids := q.Entities(db)
+	records := make([]Person, len(ids))
+	for i, id := range ids {
+		if _, err := ConstructPerson(&records[i], db, id); err != nil {
+			return nil, err
+		}
+	}
+	return records, nil
+}
+
+// DestructGadget returns the claims about the Gadget's attrs, as destruct.DestructOnlyData,
+// without reflection.
+func DestructGadget(x Gadget) ([]types.Claim, error) {
+	var e types.EWriteRef
+	if x.ID < 0 {
+		return nil, fmt.Errorf("gentest.Gadget.ID: %w", types.ErrAttrFieldOverflow)
+	}
+	if x.ID != 0 {
+		e = types.ID(x.ID)
+	} else {
+		e = destruct.NewTempID()
+	}
+	claims := make([]types.Claim, 0, 4)
+	// Serial
+	{
+		v := types.String(x.Serial)
+		if !v.IsEmpty() {
+			claims = append(claims, types.Claim{E: e, A: types.Ident("gadget/serial"), V: v})
+		}
+	}
+	// Weight
+	{
+		v := types.Float(x.Weight)
+		claims = append(claims, types.Claim{E: e, A: types.Ident("gadget/weight"), V: v})
+	}
+	// Count
+	if x.Count == 0 {
+		claims = append(claims, types.Claim{E: e, A: types.Ident("gadget/count"), Retract: true})
+	} else {
+		v := types.Int(x.Count)
+		claims = append(claims, types.Claim{E: e, A: types.Ident("gadget/count"), V: v})
+	}
+	// Size
+	if x.Size == nil {
+		claims = append(claims, types.Claim{E: e, A: types.Ident("gadget/size"), Retract: true})
+	} else {
+		if *x.Size > math.MaxInt64 {
+			return nil, fmt.Errorf("gentest.Gadget.Size: %w", types.ErrAttrFieldOverflow)
+		}
+		v := types.Int(*x.Size)
+		claims = append(claims, types.Claim{E: e, A: types.Ident("gadget/size"), V: v})
+	}
+	return claims, nil
+}
+
+// ConstructGadget populates the Gadget from the datums about the entity, as destruct.Construct,
+// without reflection.
+func ConstructGadget(x *Gadget, db types.Database, id types.ID) (bool, error) {
+	{
+		n := int64(id)
+		if n < math.MinInt || n > math.MaxInt {
+			return false, fmt.Errorf("gentest.Gadget.ID: %w", types.ErrAttrFieldOverflow)
+		}
+		x.ID = int(n)
+	}
+	a0 := db.AttrByIdent("gadget/serial").ID
+	a1 := db.AttrByIdent("gadget/weight").ID
+	a2 := db.AttrByIdent("gadget/count").ID
+	a3 := db.AttrByIdent("gadget/size").ID
+	if a3 != 0 {
+		x.Size = nil
+	}
+	found := false
+	iter := db.Select(types.Selection{E: id})
+	for iter.Next() {
+		found = true
+		datum := iter.Value().(types.Datum)
+		switch datum.A {
+		case a0:
+			x.Serial = string(datum.V.(types.String))
+		case a1:
+			f := float64(datum.V.(types.Float))
+			if a := math.Abs(f); a > math.MaxFloat32 && a <= math.MaxFloat64 {
+				return false, fmt.Errorf("gentest.Gadget.Weight: %w", types.ErrAttrFieldOverflow)
+			}
+			x.Weight = float32(f)
+		case a2:
+			n := int64(datum.V.(types.Int))
+			if n < 0 || n > math.MaxUint8 {
+				return false, fmt.Errorf("gentest.Gadget.Count: %w", types.ErrAttrFieldOverflow)
+			}
+			x.Count = uint8(n)
+		case a3:
+			var el uint
+			n := int64(datum.V.(types.Int))
+			if n < 0 || uint64(n) > math.MaxUint {
+				return false, fmt.Errorf("gentest.Gadget.Size: %w", types.ErrAttrFieldOverflow)
+			}
+			el = uint(n)
+			x.Size = &el
+		}
+	}
+	return found, nil
+}
+
+// GadgetQueryBuilder builds selections of Gadget entities by their attrs.
+type GadgetQueryBuilder struct {
+	selections []types.Selection
+}
+
+// GadgetQuery begins a query for Gadget entities.
+func GadgetQuery() *GadgetQueryBuilder {
+	return &GadgetQueryBuilder{}
+}
+
+// SerialIs selects the entities whose gadget/serial is the value.
+func (q *GadgetQueryBuilder) SerialIs(v string) *GadgetQueryBuilder {
+	q.selections = append(q.selections, types.Selection{A: types.Ident("gadget/serial"), V: types.String(v)})
+	return q
+}
+
+// SerialIn selects the entities whose gadget/serial is any of the values.
+func (q *GadgetQueryBuilder) SerialIn(vs ...string) *GadgetQueryBuilder {
+	set := make(types.VSet, len(vs))
+	for _, v := range vs {
+		set[types.String(v)] = types.Void{}
+	}
+	q.selections = append(q.selections, types.Selection{A: types.Ident("gadget/serial"), V: set})
+	return q
+}
+
+// SerialBetween selects the entities whose gadget/serial is between the values, inclusive.
+func (q *GadgetQueryBuilder) SerialBetween(min string, max string) *GadgetQueryBuilder {
+	q.selections = append(q.selections, types.Selection{A: types.Ident("gadget/serial"), V: types.VRange{Min: types.String(min), Max: types.String(max)}})
+	return q
+}
+
+// WeightIs selects the entities whose gadget/weight is the value.
+func (q *GadgetQueryBuilder) WeightIs(v float32) *GadgetQueryBuilder {
+	q.selections = append(q.selections, types.Selection{A: types.Ident("gadget/weight"), V: types.Float(v)})
+	return q
+}
+
+// WeightIn selects the entities whose gadget/weight is any of the values.
+func (q *GadgetQueryBuilder) WeightIn(vs ...float32) *GadgetQueryBuilder {
+	set := make(types.VSet, len(vs))
+	for _, v := range vs {
+		set[types.Float(v)] = types.Void{}
+	}
+	q.selections = append(q.selections, types.Selection{A: types.Ident("gadget/weight"), V: set})
+	return q
+}
+
+// WeightBetween selects the entities whose gadget/weight is between the values, inclusive.
+func (q *GadgetQueryBuilder) WeightBetween(min float32, max float32) *GadgetQueryBuilder {
+	q.selections = append(q.selections, types.Selection{A: types.Ident("gadget/weight"), V: types.VRange{Min: types.Float(min), Max: types.Float(max)}})
+	return q
+}
+
+// CountIs selects the entities whose gadget/count is the value.
+func (q *GadgetQueryBuilder) CountIs(v uint8) *GadgetQueryBuilder {
+	q.selections = append(q.selections, types.Selection{A: types.Ident("gadget/count"), V: types.Int(v)})
+	return q
+}
+
+// CountIn selects the entities whose gadget/count is any of the values.
+func (q *GadgetQueryBuilder) CountIn(vs ...uint8) *GadgetQueryBuilder {
+	set := make(types.VSet, len(vs))
+	for _, v := range vs {
+		set[types.Int(v)] = types.Void{}
+	}
+	q.selections = append(q.selections, types.Selection{A: types.Ident("gadget/count"), V: set})
+	return q
+}
+
+// CountBetween selects the entities whose gadget/count is between the values, inclusive.
+func (q *GadgetQueryBuilder) CountBetween(min uint8, max uint8) *GadgetQueryBuilder {
+	q.selections = append(q.selections, types.Selection{A: types.Ident("gadget/count"), V: types.VRange{Min: types.Int(min), Max: types.Int(max)}})
+	return q
+}
+
+// SizeIs selects the entities whose gadget/size is the value.
+func (q *GadgetQueryBuilder) SizeIs(v uint) *GadgetQueryBuilder {
+	q.selections = append(q.selections, types.Selection{A: types.Ident("gadget/size"), V: types.Int(v)})
+	return q
+}
+
+// SizeIn selects the entities whose gadget/size is any of the values.
+func (q *GadgetQueryBuilder) SizeIn(vs ...uint) *GadgetQueryBuilder {
+	set := make(types.VSet, len(vs))
+	for _, v := range vs {
+		set[types.Int(v)] = types.Void{}
+	}
+	q.selections = append(q.selections, types.Selection{A: types.Ident("gadget/size"), V: set})
+	return q
+}
+
+// SizeBetween selects the entities whose gadget/size is between the values, inclusive.
+func (q *GadgetQueryBuilder) SizeBetween(min uint, max uint) *GadgetQueryBuilder {
+	q.selections = append(q.selections, types.Selection{A: types.Ident("gadget/size"), V: types.VRange{Min: types.Int(min), Max: types.Int(max)}})
+	return q
+}
+
+// Selections returns the query's selections.
+func (q *GadgetQueryBuilder) Selections() []types.Selection {
+	return q.selections
+}
+
+// Entities returns the ids of the entities matching all of the query's selections, in order.
+func (q *GadgetQueryBuilder) Entities(db types.Database) []types.ID {
+	return destruct.SelectEntities(db, q.selections...)
+}
+
+// Fetch returns the records of the entities matching all of the query's selections.
+func (q *GadgetQueryBuilder) Fetch(db types.Database) ([]Gadget, error) {
+	ids := q.Entities(db)
+	records := make([]Gadget, len(ids))
+	for i, id := range ids {
+		if _, err := ConstructGadget(&records[i], db, id); err != nil {
+			return nil, err
+		}
+	}
+	return records, nil
+}
@@ -8,6 +8,8 @@ import (
 type Constraint interface {
 	Size() int
 	Iterator() *iterator.Iterator
+	// Contains is true if the id satisfies the constraint.
+	Contains(id ID) bool
 }
 
 type Scalar ID
@@ -29,6 +31,10 @@ func (scalar Scalar) Iterator() *iterator.Iterator {
 	return iterator.BuildIterator(scalar)
 }
 
+func (scalar Scalar) Contains(id ID) bool {
+	return ID(scalar) == id
+}
+
 func (set Set) Each(accept iterator.Accept) {
 	for id := range set {
 		if !accept(id) {
@@ -45,6 +51,11 @@ func (set Set) Iterator() *iterator.Iterator {
 	return iterator.BuildIterator(set)
 }
 
+func (set Set) Contains(id ID) bool {
+	_, ok := set[id]
+	return ok
+}
+
 func (r Range) Each(accept iterator.Accept) {
 	for id := r.Min; id <= r.Max; id++ {
 		if !accept(id) {
@@ -60,3 +71,7 @@ func (r Range) Size() int {
 func (r Range) Iterator() *iterator.Iterator {
 	return iterator.BuildIterator(r)
 }
+
+func (r Range) Contains(id ID) bool {
+	return id >= r.Min && id <= r.Max
+}
@@ -36,3 +36,15 @@ func Test_Seq(t *testing.T) {
 		assert.Equal(t, []ID{1, 2, 3, 4, 5, 6, 7, 8, 9, 10, 11, 12, 13, 14, 15, 16, 17, 18, 19, 20}, actual)
 	})
 }
+
+func Test_Contains(t *testing.T) {
+	assert.True(t, Scalar(ID(5)).Contains(5))
+	assert.False(t, Scalar(ID(5)).Contains(6))
+	set := Set{ID(5): Void{}, ID(7): Void{}}
+	assert.True(t, set.Contains(7))
+	assert.False(t, set.Contains(6))
+	r := Range{Min: ID(1), Max: ID(20)}
+	assert.True(t, r.Contains(1))
+	assert.True(t, r.Contains(20))
+	assert.False(t, r.Contains(21))
+}
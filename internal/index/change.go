@@ -1,6 +1,9 @@
 package index
 
 import (
+	"sort"
+	"sync/atomic"
+
 	. "github.com/dball/constructive/pkg/types"
 
 	"github.com/dball/constructive/pkg/sys"
@@ -34,6 +37,7 @@ func (idx *BTreeIndex) Assert(assertion Datum) (conclusion Datum, err error) {
 	if attr.Unique != 0 {
 		iter := idx.Filter(IndexAVE, Datum{A: assertion.A, V: assertion.V})
 		if iter.Next() {
+			iter.Stop()
 			extant := iter.Value().(Datum)
 			if extant.E == assertion.E {
 				conclusion = extant
@@ -44,6 +48,10 @@ func (idx *BTreeIndex) Assert(assertion Datum) (conclusion Datum, err error) {
 		}
 	}
 	switch assertion.A {
+	case sys.DbIdent, sys.AttrType, sys.AttrUnique, sys.AttrCardinality, sys.AttrRefType, sys.AttrRefTypeComponentKey:
+		idx.ownSchema()
+	}
+	switch assertion.A {
 	case sys.AttrType:
 		v := assertion.V.(ID)
 		if !sys.ValidAttrType(v) {
@@ -56,6 +64,10 @@ func (idx *BTreeIndex) Assert(assertion Datum) (conclusion Datum, err error) {
 				err = ErrAttrTypeChange
 				return
 			}
+			if attr.RefType != 0 && v != sys.AttrTypeRef {
+				err = ErrInvalidAttrRefType
+				return
+			}
 			attr.Type = v
 			idx.attrs[assertion.E] = attr
 		} else {
@@ -95,6 +107,40 @@ func (idx *BTreeIndex) Assert(assertion Datum) (conclusion Datum, err error) {
 		} else {
 			idx.attrs[assertion.E] = Attr{ID: assertion.E, Cardinality: v, Ident: Ident(idx.identNames[assertion.E])}
 		}
+	case sys.AttrRefType:
+		v := assertion.V.(ID)
+		if !sys.ValidAttrRefType(v) {
+			err = ErrInvalidAttrRefType
+			return
+		}
+		attr, ok := idx.attrs[assertion.E]
+		if ok {
+			if attr.RefType != 0 && attr.RefType != v {
+				err = ErrAttrRefTypeChange
+				return
+			}
+			if attr.Type != 0 && attr.Type != sys.AttrTypeRef {
+				err = ErrInvalidAttrRefType
+				return
+			}
+			attr.RefType = v
+			idx.attrs[assertion.E] = attr
+		} else {
+			idx.attrs[assertion.E] = Attr{ID: assertion.E, RefType: v, Ident: Ident(idx.identNames[assertion.E])}
+		}
+	case sys.AttrRefTypeComponentKey:
+		v := assertion.V.(ID)
+		attr, ok := idx.attrs[assertion.E]
+		if ok {
+			if attr.ComponentKey != 0 && attr.ComponentKey != v {
+				err = ErrAttrComponentKeyChange
+				return
+			}
+			attr.ComponentKey = v
+			idx.attrs[assertion.E] = attr
+		} else {
+			idx.attrs[assertion.E] = Attr{ID: assertion.E, ComponentKey: v, Ident: Ident(idx.identNames[assertion.E])}
+		}
 	case sys.DbIdent:
 		ident := assertion.V.(String)
 		if !sys.ValidUserIdent(ident) {
@@ -104,14 +150,24 @@ func (idx *BTreeIndex) Assert(assertion Datum) (conclusion Datum, err error) {
 		idx.idents[ident] = assertion.E
 		idx.identNames[assertion.E] = ident
 	}
+	var changed bool
 	if attr.Cardinality == sys.AttrCardinalityMany {
-		conclusion, _ = idx.assertCardinalityMany(assertion)
+		conclusion, changed = idx.assertCardinalityMany(assertion)
 	} else {
-		conclusion, _ = idx.assertCardinalityOne(assertion)
+		conclusion, changed = idx.assertCardinalityOne(assertion)
+	}
+	if changed {
+		switch assertion.A {
+		case sys.DbIdent, sys.AttrType, sys.AttrUnique, sys.AttrCardinality, sys.AttrRefType, sys.AttrRefTypeComponentKey:
+			atomic.AddUint64(&idx.schema.version, 1)
+		}
 	}
 	return
 }
 
+// Retracts the given datum from the database, if it exists. The datum's T is taken to
+// be the retracting transaction, and the retracted datum is retained for views of the
+// database as of earlier transactions.
 func (idx *BTreeIndex) Retract(assertion Datum) (err error) {
 	// TODO we're not validating anything at this point, but it's easy to imagine wanting
 	// to diagnose illogical retractions, so we'll return error to get the type right.
@@ -119,10 +175,33 @@ func (idx *BTreeIndex) Retract(assertion Datum) (err error) {
 	return
 }
 
+// Load inserts the datums into the index. The nodes for all kinds of index are sorted
+// together and inserted in order, so that each insertion descends the path the last one
+// copied, rather than copying paths throughout the tree the index shares with its clones.
+// Unlike Assert, this performs no validation: the datums must be valid, new to the index,
+// and consistent with its cardinality and uniqueness constraints.
+func (idx *BTreeIndex) Load(datums []Datum) {
+	nodes := make([]Node, 0, 4*len(datums))
+	for _, datum := range datums {
+		for _, kind := range idx.kinds(datum) {
+			nodes = append(nodes, Node{kind, datum})
+		}
+	}
+	sort.Slice(nodes, func(i, j int) bool {
+		return nodes[i].Less(nodes[j])
+	})
+	for _, node := range nodes {
+		idx.tree.ReplaceOrInsert(node)
+	}
+	for _, datum := range datums {
+		idx.logChange(Change{Datum: datum, Added: true}, datum)
+	}
+}
+
 // assertCardinalityOne ensures a datum for an attribute of cardinality one exists in the index.
 // If no datum for the entity and attribute already existed, this inserts one and returns
 // an empty datum. If one already exists with the same value, this returns that datum and
-// makes no changes to the index. Otherwise, this removes and returns that datum and inserts
+// makes no changes to the index. Otherwise, this retires and returns that datum and inserts
 // the given datum.
 //
 // This performs no validation.
@@ -136,31 +215,17 @@ func (idx *BTreeIndex) assertCardinalityOne(d Datum) (d0 Datum, changed bool) {
 	})
 	switch {
 	case extant.datum.E == 0:
-		node := Node{IndexEAV, d}
-		idx.tree.ReplaceOrInsert(node)
-		node.kind = IndexAEV
-		idx.tree.ReplaceOrInsert(node)
-		// TODO only for unique a
-		node.kind = IndexAVE
-		idx.tree.ReplaceOrInsert(node)
+		// TODO only for unique a in the AVE index
+		idx.insert(d)
+		idx.logChange(Change{Datum: d, Added: true}, d)
 		return Datum{}, true
 	case Compare(d.V, extant.datum.V) == 0:
 		return extant.datum, false
 	default:
-		node := Node{IndexEAV, extant.datum}
-		idx.tree.Delete(node)
-		node.kind = IndexAEV
-		idx.tree.Delete(node)
-		node.kind = IndexAVE
-		idx.tree.Delete(node)
-
-		node.datum = d
-		node.kind = IndexEAV
-		idx.tree.ReplaceOrInsert(node)
-		node.kind = IndexAEV
-		idx.tree.ReplaceOrInsert(node)
-		node.kind = IndexAVE
-		idx.tree.ReplaceOrInsert(node)
+		idx.delete(extant.datum)
+		idx.retire(extant.datum, d.T)
+		idx.insert(d)
+		idx.logChange(Change{Datum: d, Added: true}, d)
 		return extant.datum, true
 	}
 }
@@ -190,24 +255,85 @@ func (idx *BTreeIndex) assertCardinalityMany(d Datum) (d0 Datum, changed bool) {
 	if extant.datum.E != 0 {
 		return extant.datum, false
 	}
-	node := Node{IndexEAV, d}
-	idx.tree.ReplaceOrInsert(node)
-	node.kind = IndexAEV
-	idx.tree.ReplaceOrInsert(node)
-	// TODO only for unique a
-	node.kind = IndexAVE
-	idx.tree.ReplaceOrInsert(node)
+	// TODO only for unique a in the AVE index
+	idx.insert(d)
+	idx.logChange(Change{Datum: d, Added: true}, d)
 	return Datum{}, true
 }
 
 func (idx *BTreeIndex) retract(d Datum) (changed bool) {
-	item := idx.tree.Delete(Node{kind: IndexEAV, datum: d})
-	if item == nil {
-		return
+	// TODO can skip the AVE index if a is not unique
+	asserted, changed := idx.delete(d)
+	if changed {
+		idx.retire(asserted, d.T)
 	}
-	changed = true
-	idx.tree.Delete(Node{kind: IndexAEV, datum: d})
-	// TODO can skip if a is unique
-	idx.tree.Delete(Node{kind: IndexAVE, datum: d})
 	return
 }
+
+// retire records that the given datum, as it was asserted, was retracted in the given
+// transaction.
+func (idx *BTreeIndex) retire(d Datum, retraction ID) {
+	change := Change{Datum: d}
+	change.T = retraction
+	idx.logChange(change, d)
+	node := retiredNode{Node: Node{IndexEAV, d}, retraction: retraction}
+	idx.retired.ReplaceOrInsert(node)
+	node.kind = IndexAEV
+	idx.retired.ReplaceOrInsert(node)
+	node.kind = IndexAVE
+	idx.retired.ReplaceOrInsert(node)
+}
+
+// logChange records the change, and the datum as it was asserted, so that the change may
+// be rolled back.
+func (idx *BTreeIndex) logChange(change Change, d Datum) {
+	idx.log = append(idx.log, change)
+	idx.undo = append(idx.undo, d)
+}
+
+// Mark is the state of an index to which it may be rolled back.
+type Mark struct {
+	log        int
+	idents     map[String]ID
+	identNames map[ID]String
+	attrs      map[ID]Attr
+	schema     *schema
+	ownsSchema bool
+}
+
+// Mark returns the index's state, so that changes made after it may be rolled back. Until
+// then, the index copies its idents and attrs before its schema is next changed.
+func (idx *BTreeIndex) Mark() Mark {
+	mark := Mark{
+		log:        len(idx.log),
+		idents:     idx.idents,
+		identNames: idx.identNames,
+		attrs:      idx.attrs,
+		schema:     idx.schema,
+		ownsSchema: idx.ownsSchema,
+	}
+	idx.ownsSchema = false
+	return mark
+}
+
+// Rollback undoes the changes made to the index since it was marked, in reverse order.
+func (idx *BTreeIndex) Rollback(mark Mark) {
+	for i := len(idx.log) - 1; i >= mark.log; i-- {
+		change, d := idx.log[i], idx.undo[i]
+		if change.Added {
+			idx.delete(d)
+			continue
+		}
+		for _, kind := range datumKinds {
+			idx.retired.Delete(retiredNode{Node: Node{kind, d}, retraction: change.T})
+		}
+		idx.insert(d)
+	}
+	idx.log = idx.log[:mark.log]
+	idx.undo = idx.undo[:mark.log]
+	idx.idents = mark.idents
+	idx.identNames = mark.identNames
+	idx.attrs = mark.attrs
+	idx.schema = mark.schema
+	idx.ownsSchema = mark.ownsSchema
+}
@@ -1,6 +1,8 @@
 package index
 
 import (
+	"sync/atomic"
+
 	"github.com/dball/constructive/internal/compare"
 	"github.com/dball/constructive/pkg/sys"
 	. "github.com/dball/constructive/pkg/types"
@@ -11,9 +13,12 @@ import (
 func BuildIndex() *BTreeIndex {
 	return &BTreeIndex{
 		tree:       *btree.New(16),
+		retired:    *btree.New(16),
 		idents:     make(map[String]ID, 256),
 		identNames: make(map[ID]String, 256),
 		attrs:      make(map[ID]Attr, 256),
+		schema:     &schema{},
+		ownsSchema: true,
 	}
 }
 
@@ -26,12 +31,12 @@ func (idx *BTreeIndex) AttrByIdent(ident Ident) Attr {
 }
 
 func (idx *BTreeIndex) InitSys() *BTreeIndex {
-	for _, datum := range sys.Datums {
-		idx.assertCardinalityOne(datum)
-	}
 	for id, attr := range sys.Attrs {
 		idx.attrs[id] = attr
 	}
+	for _, datum := range sys.Datums {
+		idx.assertCardinalityOne(datum)
+	}
 	iter := func(item btree.Item) bool {
 		node := item.(Node)
 		if node.kind != IndexEAV {
@@ -46,24 +51,80 @@ func (idx *BTreeIndex) InitSys() *BTreeIndex {
 		return true
 	}
 	idx.tree.Ascend(iter)
+	idx.log = nil
+	idx.undo = nil
 	return idx
 }
 
+// Changes returns the changes made to the index since it was cloned, in order.
+func (idx *BTreeIndex) Changes() []Change {
+	return idx.log
+}
+
+// Clone returns a copy of the index. The clone shares its idents and attrs with the index
+// until its schema is first changed, whereupon it copies them.
 func (idx *BTreeIndex) Clone() *BTreeIndex {
 	return &BTreeIndex{
-		tree: *idx.tree.Clone(),
-		// TODO these either need to be guaranteed to be backwards compatible or need to be copied or similar
+		tree:       *idx.tree.Clone(),
+		retired:    *idx.retired.Clone(),
 		idents:     idx.idents,
 		identNames: idx.identNames,
 		attrs:      idx.attrs,
+		schema:     idx.schema,
+	}
+}
+
+// ownSchema copies the idents and attrs the index shares with the index from which it was
+// cloned, if any, so that it may change them without changing the other's schema.
+func (idx *BTreeIndex) ownSchema() {
+	if idx.ownsSchema {
+		return
+	}
+	idents := make(map[String]ID, len(idx.idents))
+	for ident, id := range idx.idents {
+		idents[ident] = id
+	}
+	identNames := make(map[ID]String, len(idx.identNames))
+	for id, ident := range idx.identNames {
+		identNames[id] = ident
 	}
+	attrs := make(map[ID]Attr, len(idx.attrs))
+	for id, attr := range idx.attrs {
+		attrs[id] = attr
+	}
+	idx.idents = idents
+	idx.identNames = identNames
+	idx.attrs = attrs
+	idx.schema = &schema{version: atomic.LoadUint64(&idx.schema.version)}
+	idx.ownsSchema = true
 }
 
 type BTreeIndex struct {
-	tree       btree.BTree
+	tree btree.BTree
+	// retired holds the datums that have been retracted, in support of views of the
+	// database as of earlier transactions.
+	retired btree.BTree
+	// log records the changes made to this index since it was cloned, and undo the datums
+	// as they were asserted, so that the changes may be rolled back.
+	log        []Change
+	undo       []Datum
 	idents     map[String]ID
 	identNames map[ID]String
 	attrs      map[ID]Attr
+	// schema is shared by clones, as are the idents and attrs, until ownsSchema.
+	schema     *schema
+	ownsSchema bool
+}
+
+// schema counts the changes to an index's idents and attrs.
+type schema struct {
+	version uint64
+}
+
+// SchemaVersion returns the version of the index's schema, which changes whenever an
+// ident or attr is asserted.
+func (idx *BTreeIndex) SchemaVersion() SchemaVersion {
+	return SchemaVersion{Schema: idx.schema, Version: atomic.LoadUint64(&idx.schema.version)}
 }
 
 type Node struct {
@@ -71,6 +132,28 @@ type Node struct {
 	datum Datum
 }
 
+// retiredNode is a node in the index of retracted datums. Unlike the current index, the
+// same datum may be retired many times, so retired nodes are further ordered by the
+// transactions in which their datums were asserted and retracted.
+type retiredNode struct {
+	Node
+	retraction ID
+}
+
+func (n1 retiredNode) Less(than btree.Item) bool {
+	n2 := than.(retiredNode)
+	switch {
+	case n1.Node.Less(n2.Node):
+		return true
+	case n2.Node.Less(n1.Node):
+		return false
+	case n1.datum.T != n2.datum.T:
+		return n1.datum.T < n2.datum.T
+	default:
+		return n1.retraction < n2.retraction
+	}
+}
+
 func compareKind(kind IndexType) compare.Fn {
 	switch kind {
 	case IndexEAV:
@@ -79,11 +162,47 @@ func compareKind(kind IndexType) compare.Fn {
 		return compare.AEV
 	case IndexAVE:
 		return compare.AVE
+	case IndexVAE:
+		return compare.VAE
 	default:
 		return nil
 	}
 }
 
+var (
+	datumKinds = []IndexType{IndexEAV, IndexAEV, IndexAVE}
+	refKinds   = []IndexType{IndexEAV, IndexAEV, IndexAVE, IndexVAE}
+)
+
+// kinds returns the kinds of index in which the datum appears. Only ref datums appear in
+// the VAE index. An attr's type never changes, so the datum's kinds do not either.
+func (idx *BTreeIndex) kinds(d Datum) []IndexType {
+	if idx.attrs[d.A].Type == sys.AttrTypeRef {
+		return refKinds
+	}
+	return datumKinds
+}
+
+// insert inserts the datum's nodes into the current index.
+func (idx *BTreeIndex) insert(d Datum) {
+	for _, kind := range idx.kinds(d) {
+		idx.tree.ReplaceOrInsert(Node{kind, d})
+	}
+}
+
+// delete deletes the datum's nodes from the current index, returning the datum as it was
+// asserted, or false if it was not.
+func (idx *BTreeIndex) delete(d Datum) (Datum, bool) {
+	item := idx.tree.Delete(Node{IndexEAV, d})
+	if item == nil {
+		return Datum{}, false
+	}
+	for _, kind := range idx.kinds(d)[1:] {
+		idx.tree.Delete(Node{kind, d})
+	}
+	return item.(Node).datum, true
+}
+
 func (n1 Node) Less(than btree.Item) bool {
 	n2 := than.(Node)
 	if n1.kind < n2.kind {
@@ -105,6 +224,7 @@ func (idx *BTreeIndex) ResolveEReadRef(eref EReadRef) (id ID) {
 		v := VSelValue(e.V)
 		iter := idx.Select(Selection{A: a, V: v})
 		if iter.Next() {
+			iter.Stop()
 			datum := iter.Value().(Datum)
 			id = datum.E
 		}
@@ -3,6 +3,7 @@ package index
 import (
 	"testing"
 
+	"github.com/dball/constructive/internal/ids"
 	"github.com/dball/constructive/internal/iterator"
 	"github.com/dball/constructive/pkg/sys"
 	. "github.com/dball/constructive/pkg/types"
@@ -84,6 +85,30 @@ func TestAttrsTypesAndCardinality(t *testing.T) {
 	})
 }
 
+func TestSchemaVersion(t *testing.T) {
+	idx := BuildIndex().InitSys()
+	v0 := idx.SchemaVersion()
+	idx.Assert(D(500, sys.DbIdent, String("person/name"), 100))
+	idx.Assert(D(500, sys.AttrType, sys.AttrTypeString, 100))
+	v1 := idx.SchemaVersion()
+	assert.NotEqual(t, v0, v1)
+	// reasserting the schema or asserting data does not change it
+	idx.Assert(D(500, sys.AttrType, sys.AttrTypeString, 101))
+	idx.Assert(D(1000, 500, String("Donald"), 101))
+	assert.Equal(t, v1, idx.SchemaVersion())
+	// clones share the schema until they change it
+	clone := idx.Clone()
+	assert.Equal(t, v1, clone.SchemaVersion())
+	clone.Assert(D(501, sys.DbIdent, String("person/age"), 102))
+	clone.Assert(D(501, sys.AttrType, sys.AttrTypeInt, 102))
+	assert.NotEqual(t, v1, clone.SchemaVersion())
+	assert.Equal(t, v1, idx.SchemaVersion())
+	assert.Equal(t, ID(501), clone.AttrByIdent("person/age").ID)
+	assert.Equal(t, Attr{}, idx.AttrByIdent("person/age"))
+	// other indexes have other schemas
+	assert.False(t, BuildIndex().InitSys().SchemaVersion() == BuildIndex().InitSys().SchemaVersion())
+}
+
 func TestInitSystem(t *testing.T) {
 	idx := BuildIndex().InitSys()
 	datums := slurp(idx.Select(Selection{E: sys.DbIdent}))
@@ -136,6 +161,42 @@ func TestSelect(t *testing.T) {
 	assert.Equal(t, D(ID(1000), ID(500), String("Donald"), ID(100)), datums[0])
 }
 
+func TestSelectAttrValues(t *testing.T) {
+	idx := BuildIndex().InitSys()
+	idx.Assert(D(500, sys.DbIdent, String("person/age"), 100))
+	idx.Assert(D(500, sys.AttrType, sys.AttrTypeInt, 100))
+	idx.Assert(D(1000, 500, Int(48), 100))
+	idx.Assert(D(1001, 500, Int(39), 100))
+	idx.Assert(D(1002, 500, Int(21), 100))
+	t.Run("set", func(t *testing.T) {
+		datums := slurp(idx.Select(Selection{A: ID(500), V: VSet{Int(48): Void{}, Int(21): Void{}, Int(7): Void{}}}))
+		assert.Equal(t, []Datum{D(1002, 500, Int(21), 100), D(1000, 500, Int(48), 100)}, datums)
+		searches := buildRangeSearches(Constraints{A: ids.Scalar(500), V: VSet{Int(48): Void{}, Int(21): Void{}, Int(7): Void{}}})
+		require.Len(t, searches, 1)
+		assert.Equal(t, IndexAVE, searches[0].indexType)
+		assert.Equal(t, Datum{A: 500, V: Int(7)}, searches[0].start)
+		assert.False(t, searches[0].terminator(D(1000, 500, Int(48), 100)))
+		assert.True(t, searches[0].terminator(D(1000, 500, Int(49), 100)))
+	})
+	t.Run("range", func(t *testing.T) {
+		datums := slurp(idx.Select(Selection{A: ID(500), V: VRange{Min: Int(30), Max: Int(50)}}))
+		assert.Equal(t, []Datum{D(1001, 500, Int(39), 100), D(1000, 500, Int(48), 100)}, datums)
+		searches := buildRangeSearches(Constraints{A: ids.Scalar(500), V: VRange{Min: Int(30), Max: Int(50)}})
+		require.Len(t, searches, 1)
+		assert.Equal(t, IndexAVE, searches[0].indexType)
+		assert.Equal(t, Datum{A: 500, V: Int(30)}, searches[0].start)
+		assert.False(t, searches[0].terminator(D(1000, 500, Int(50), 100)))
+		assert.True(t, searches[0].terminator(D(1000, 500, Int(51), 100)))
+		assert.True(t, searches[0].terminator(D(1000, 501, Int(40), 100)))
+	})
+	t.Run("half-open ranges", func(t *testing.T) {
+		datums := slurp(idx.Select(Selection{A: ID(500), V: VRange{Min: Int(39)}}))
+		assert.Equal(t, []Datum{D(1001, 500, Int(39), 100), D(1000, 500, Int(48), 100)}, datums)
+		datums = slurp(idx.Select(Selection{A: ID(500), V: VRange{Max: Int(39)}}))
+		assert.Equal(t, []Datum{D(1002, 500, Int(21), 100), D(1001, 500, Int(39), 100)}, datums)
+	})
+}
+
 func TestSelectLots(t *testing.T) {
 	t.Skip("create 500-504 attrs")
 	idx := BuildIndex().InitSys()
@@ -171,6 +232,144 @@ func TestSelectLots(t *testing.T) {
 	})
 }
 
+func TestWindows(t *testing.T) {
+	idx := BuildIndex().InitSys()
+	idx.Assert(D(500, sys.DbIdent, String("person/name"), 100))
+	idx.Assert(D(500, sys.AttrType, sys.AttrTypeString, 100))
+	idx.Assert(D(1000, 500, String("Donald"), 101))
+	idx.Assert(D(1000, 500, String("Don"), 102))
+	idx.Retract(D(1000, 500, String("Don"), 103))
+	idx.Assert(D(1000, 500, String("Donald"), 104))
+	t.Run("the current datums are unbounded", func(t *testing.T) {
+		datums := slurp(idx.Select(Selection{E: ID(1000)}))
+		assert.Equal(t, []Datum{D(1000, 500, String("Donald"), 104)}, datums)
+	})
+	t.Run("retired datums are visible as of their transactions", func(t *testing.T) {
+		assert.Equal(t, []Datum{D(1000, 500, String("Donald"), 101)}, slurp(idx.SelectWindow(Selection{E: ID(1000)}, Window{AsOf: 101})))
+		assert.Equal(t, []Datum{D(1000, 500, String("Don"), 102)}, slurp(idx.SelectWindow(Selection{E: ID(1000)}, Window{AsOf: 102})))
+		assert.Empty(t, slurp(idx.SelectWindow(Selection{E: ID(1000)}, Window{AsOf: 103})))
+		assert.Equal(t, []Datum{D(1000, 500, String("Donald"), 104)}, slurp(idx.SelectWindow(Selection{E: ID(1000)}, Window{AsOf: 104})))
+	})
+	t.Run("since excludes earlier datums", func(t *testing.T) {
+		assert.Equal(t, []Datum{D(1000, 500, String("Don"), 102)}, slurp(idx.SelectWindow(Selection{E: ID(1000)}, Window{Since: 101, AsOf: 102})))
+		assert.Empty(t, slurp(idx.SelectWindow(Selection{E: ID(1000)}, Window{Since: 104})))
+	})
+}
+
+func TestLoad(t *testing.T) {
+	idx := BuildIndex().InitSys()
+	idx.Assert(D(500, sys.DbIdent, String("person/name"), 100))
+	idx.Assert(D(500, sys.AttrType, sys.AttrTypeString, 100))
+	idx.Assert(D(500, sys.AttrUnique, sys.AttrUniqueIdentity, 100))
+	idx.Assert(D(1003, 500, String("Dave"), 100))
+	original := idx
+	idx = idx.Clone()
+	idx.Load([]Datum{
+		D(1002, 500, String("Alice"), 101),
+		D(1000, 500, String("Charlie"), 101),
+		D(1001, 500, String("Bob"), 101),
+	})
+	assert.Equal(t, []Datum{
+		D(1000, 500, String("Charlie"), 101),
+		D(1001, 500, String("Bob"), 101),
+		D(1002, 500, String("Alice"), 101),
+		D(1003, 500, String("Dave"), 100),
+	}, slurp(idx.Select(Selection{E: ERange{Min: ID(1000), Max: ID(1003)}})))
+	assert.Equal(t, D(1001, 500, String("Bob"), 101), idx.SelectOne(Selection{A: ID(500), V: String("Bob")}))
+	assert.Equal(t, D(1003, 500, String("Dave"), 100), idx.SelectOne(Selection{A: ID(500), V: String("Dave")}))
+	assert.Len(t, slurp(idx.Select(Selection{A: ID(500)})), 4)
+	assert.Equal(t, ID(500), idx.ResolveIdent(Ident("person/name")))
+	assert.Len(t, idx.Changes(), 3)
+	assert.Equal(t, []Datum{D(1003, 500, String("Dave"), 100)}, slurp(original.Select(Selection{A: ID(500)})))
+}
+
+func TestReferrers(t *testing.T) {
+	idx := BuildIndex().InitSys()
+	idx.Assert(D(500, sys.DbIdent, String("person/friend"), 100))
+	idx.Assert(D(500, sys.AttrType, sys.AttrTypeRef, 100))
+	idx.Assert(D(500, sys.AttrCardinality, sys.AttrCardinalityMany, 100))
+	idx.Assert(D(501, sys.DbIdent, String("person/mentor"), 100))
+	idx.Assert(D(501, sys.AttrType, sys.AttrTypeRef, 100))
+	idx.Assert(D(502, sys.DbIdent, String("person/age"), 100))
+	idx.Assert(D(502, sys.AttrType, sys.AttrTypeInt, 100))
+	idx.Assert(D(1001, 500, ID(1000), 101))
+	idx.Assert(D(1002, 500, ID(1000), 101))
+	idx.Assert(D(1002, 501, ID(1000), 101))
+	idx.Assert(D(1002, 500, ID(1001), 101))
+	idx.Assert(D(1003, 502, Int(1000), 101))
+	assert.Equal(t, []Datum{
+		D(1001, 500, ID(1000), 101),
+		D(1002, 500, ID(1000), 101),
+		D(1002, 501, ID(1000), 101),
+	}, slurp(idx.Referrers(1000)))
+	t.Run("retracted and rolled back", func(t *testing.T) {
+		clone := idx.Clone()
+		mark := clone.Mark()
+		clone.Retract(D(1001, 500, ID(1000), 102))
+		clone.Assert(D(1002, 501, ID(1001), 102))
+		clone.Assert(D(1004, 501, ID(1000), 102))
+		assert.Equal(t, []Datum{
+			D(1002, 500, ID(1000), 101),
+			D(1004, 501, ID(1000), 102),
+		}, slurp(clone.Referrers(1000)))
+		clone.Rollback(mark)
+		assert.Equal(t, slurp(idx.Referrers(1000)), slurp(clone.Referrers(1000)))
+	})
+	t.Run("loaded", func(t *testing.T) {
+		clone := idx.Clone()
+		clone.Load([]Datum{D(1005, 501, ID(1003), 102), D(1006, 502, Int(1003), 102)})
+		assert.Equal(t, []Datum{D(1005, 501, ID(1003), 102)}, slurp(clone.Referrers(1003)))
+		assert.Empty(t, slurp(idx.Referrers(1003)))
+	})
+}
+
+func TestRollback(t *testing.T) {
+	idx := BuildIndex().InitSys()
+	idx.Assert(D(500, sys.DbIdent, String("person/name"), 100))
+	idx.Assert(D(500, sys.AttrType, sys.AttrTypeString, 100))
+	idx = idx.Clone()
+	idx.Assert(D(1000, 500, String("Donald"), 101))
+	version := idx.SchemaVersion()
+	mark := idx.Mark()
+	idx.Assert(D(501, sys.DbIdent, String("person/age"), 102))
+	idx.Assert(D(501, sys.AttrType, sys.AttrTypeInt, 102))
+	idx.Assert(D(1000, 500, String("Don"), 102))
+	idx.Assert(D(1000, 501, Int(48), 102))
+	idx.Retract(D(1000, 501, Int(48), 102))
+	idx.Rollback(mark)
+	assert.Equal(t, []Datum{D(1000, 500, String("Donald"), 101)}, slurp(idx.Select(Selection{E: ID(1000)})))
+	assert.Equal(t, []Datum{D(1000, 500, String("Donald"), 101)}, slurp(idx.SelectWindow(Selection{E: ID(1000)}, Window{AsOf: 101})))
+	assert.Equal(t, []Change{{Datum: D(1000, 500, String("Donald"), 101), Added: true}}, idx.Changes())
+	assert.Equal(t, Attr{}, idx.AttrByIdent("person/age"))
+	assert.Zero(t, idx.ResolveIdent(Ident("person/age")))
+	assert.Equal(t, version, idx.SchemaVersion())
+}
+
+func TestMatcher(t *testing.T) {
+	idx := BuildIndex().InitSys()
+	idx.Assert(D(500, sys.DbIdent, String("person/name"), 100))
+	idx.Assert(D(500, sys.AttrType, sys.AttrTypeString, 100))
+	idx.Assert(D(501, sys.DbIdent, String("person/age"), 100))
+	idx.Assert(D(501, sys.AttrType, sys.AttrTypeInt, 100))
+	idx.Assert(D(1000, 500, String("Donald"), 101))
+	idx.Assert(D(1000, 501, Int(48), 101))
+	idx.Assert(D(1001, 501, Int(44), 101))
+
+	t.Run("selects by attr alone", func(t *testing.T) {
+		assert.Equal(t, []Datum{D(1000, 501, Int(48), 101), D(1001, 501, Int(44), 101)}, slurp(idx.Select(Selection{A: ID(501)})))
+	})
+	t.Run("matches datums satisfying the selection", func(t *testing.T) {
+		matches := idx.Matcher(Selection{E: ESet{ID(1000): Void{}, ID(1002): Void{}}, A: ID(501)})
+		assert.True(t, matches(D(1000, 501, Int(48), 101)))
+		assert.True(t, matches(D(1002, 501, Int(7), 102)))
+		assert.False(t, matches(D(1001, 501, Int(44), 101)))
+		assert.False(t, matches(D(1000, 500, String("Donald"), 101)))
+		matches = idx.Matcher(Selection{A: ID(501), V: Int(44)})
+		assert.True(t, matches(D(1001, 501, Int(44), 101)))
+		assert.False(t, matches(D(1000, 501, Int(48), 101)))
+	})
+}
+
 func TestIdents(t *testing.T) {
 	idx := BuildIndex().InitSys()
 	idx.Assert(D(ID(1000), sys.DbIdent, String("person/name"), ID(1000)))
@@ -1,6 +1,9 @@
 package index
 
 import (
+	"reflect"
+	"sort"
+
 	"github.com/dball/constructive/internal/ids"
 	"github.com/dball/constructive/internal/iterator"
 	. "github.com/dball/constructive/pkg/types"
@@ -71,10 +74,26 @@ func buildRangeSearches(c Constraints) []rangeSearch {
 		for as.Next() {
 			a := as.Value().(ID)
 			switch c.V.(type) {
-			case VRange:
-				panic("TODO filter on value range")
-			case VSet:
-				panic("TODO range search on min and max with filter on set values")
+			case VRange, VSet:
+				// The search spans the attr's values between the filter's min and max, if given.
+				filter := buildValueFilter(c.V)
+				max := filter.Max
+				search := rangeSearch{
+					indexType:  indexType,
+					start:      Datum{A: a, V: filter.Min},
+					ascending:  true,
+					filter:     filter.Pred,
+					terminator: func(d Datum) bool { return d.A > a || max != nil && Compare(d.V, max) > 0 },
+				}
+				searches = append(searches, search)
+			case nil:
+				search := rangeSearch{
+					indexType:  IndexAEV,
+					start:      Datum{A: a},
+					ascending:  true,
+					terminator: func(d Datum) bool { return d.A > a },
+				}
+				searches = append(searches, search)
 			default:
 				v := c.V.(Value)
 				search := rangeSearch{
@@ -100,7 +119,16 @@ func buildRangeSearches(c Constraints) []rangeSearch {
 
 type btreeRangeSearch struct {
 	rangeSearch
-	idx *BTreeIndex
+	idx    *BTreeIndex
+	window Window
+}
+
+// scan determines if the node matches the search, and if the search should continue.
+func (search btreeRangeSearch) scan(node Node) (match bool, more bool) {
+	if node.kind != search.indexType || search.terminator != nil && search.terminator(node.datum) {
+		return false, false
+	}
+	return search.filter == nil || search.filter(node.datum), true
 }
 
 func (search btreeRangeSearch) Each(accept iterator.Accept) {
@@ -108,41 +136,184 @@ func (search btreeRangeSearch) Each(accept iterator.Accept) {
 	if !search.ascending {
 		panic("TODO")
 	}
+	var retired []Datum
+	if search.window.AsOf != 0 {
+		search.idx.retired.AscendGreaterOrEqual(retiredNode{Node: start}, func(item btree.Item) bool {
+			node := item.(retiredNode)
+			match, more := search.scan(node.Node)
+			if match && search.window.includesRetired(node.datum, node.retraction) {
+				retired = append(retired, node.datum)
+			}
+			return more
+		})
+	}
+	compare := compareKind(search.indexType)
+	more := true
 	treeIter := func(item btree.Item) bool {
 		node := item.(Node)
-		datum := node.datum
-		if node.kind != search.indexType || search.terminator != nil && search.terminator(datum) {
+		match, ok := search.scan(node)
+		if !ok {
 			return false
 		}
-		if search.filter == nil || search.filter(datum) {
-			if !accept(datum) {
+		if !match || !search.window.includes(node.datum) {
+			return true
+		}
+		for len(retired) > 0 && compare(retired[0], node.datum) < 0 {
+			if !accept(retired[0]) {
+				more = false
 				return false
 			}
+			retired = retired[1:]
+		}
+		if !accept(node.datum) {
+			more = false
+			return false
 		}
 		return true
 	}
 	search.idx.tree.AscendGreaterOrEqual(start, treeIter)
+	if !more {
+		return
+	}
+	for _, datum := range retired {
+		if !accept(datum) {
+			return
+		}
+	}
 }
 
 func (search btreeRangeSearch) Iterator() *iterator.Iterator {
 	return iterator.BuildIterator(search)
 }
 
+// Window bounds the transactions whose datums are visible in a selection. The zero
+// window is unbounded, and sees exactly the current datums.
+type Window struct {
+	// Since, if given, excludes datums asserted in or before this transaction.
+	Since ID
+	// AsOf, if given, excludes datums asserted after this transaction and includes
+	// datums retracted after it.
+	AsOf ID
+}
+
+func (w Window) includes(d Datum) bool {
+	return w.includesT(d.T)
+}
+
+func (w Window) includesT(t ID) bool {
+	return (w.Since == 0 || t > w.Since) && (w.AsOf == 0 || t <= w.AsOf)
+}
+
+func (w Window) includesRetired(d Datum, retraction ID) bool {
+	return w.AsOf != 0 && w.includes(d) && retraction > w.AsOf
+}
+
 func (idx *BTreeIndex) Select(sel Selection) *iterator.Iterator {
+	return idx.SelectWindow(sel, Window{})
+}
+
+// SelectWindow selects the datums visible in the given window.
+func (idx *BTreeIndex) SelectWindow(sel Selection, window Window) *iterator.Iterator {
+	c := idx.buildConstraints(sel)
+	searches := buildRangeSearches(c)
+	iterators := make(iterator.Iterators, 0, len(searches))
+	for _, search := range searches {
+		iterators = append(iterators, *btreeRangeSearch{rangeSearch: search, idx: idx, window: window}.Iterator())
+	}
+	return iterator.BuildIterator(&iterators)
+}
+
+type btreeHistorySearch struct {
+	rangeSearch
+	idx    *BTreeIndex
+	window Window
+}
+
+// Each accepts the changes matching the search whose transactions are in the window,
+// ordered by the search index and then by transaction.
+func (search btreeHistorySearch) Each(accept iterator.Accept) {
+	start := Node{kind: search.indexType, datum: search.start}
+	if !search.ascending {
+		panic("TODO")
+	}
+	rs := btreeRangeSearch{rangeSearch: search.rangeSearch, idx: search.idx}
+	var changes []Change
+	push := func(change Change) {
+		if search.window.includesT(change.T) {
+			changes = append(changes, change)
+		}
+	}
+	search.idx.tree.AscendGreaterOrEqual(start, func(item btree.Item) bool {
+		node := item.(Node)
+		match, more := rs.scan(node)
+		if match {
+			push(Change{Datum: node.datum, Added: true})
+		}
+		return more
+	})
+	search.idx.retired.AscendGreaterOrEqual(retiredNode{Node: start}, func(item btree.Item) bool {
+		node := item.(retiredNode)
+		match, more := rs.scan(node.Node)
+		if match {
+			push(Change{Datum: node.datum, Added: true})
+			retraction := node.datum
+			retraction.T = node.retraction
+			push(Change{Datum: retraction, Added: false})
+		}
+		return more
+	})
+	compare := compareKind(search.indexType)
+	sort.SliceStable(changes, func(i, j int) bool {
+		c := compare(changes[i].Datum, changes[j].Datum)
+		if c != 0 {
+			return c < 0
+		}
+		return changes[i].T < changes[j].T
+	})
+	for _, change := range changes {
+		if !accept(change) {
+			return
+		}
+	}
+}
+
+func (search btreeHistorySearch) Iterator() *iterator.Iterator {
+	return iterator.BuildIterator(search)
+}
+
+// SelectHistory selects every assertion and retraction of the datums matching the
+// selection, yielding Changes whose transactions are in the given window.
+func (idx *BTreeIndex) SelectHistory(sel Selection, window Window) *iterator.Iterator {
 	c := idx.buildConstraints(sel)
 	searches := buildRangeSearches(c)
 	iterators := make(iterator.Iterators, 0, len(searches))
 	for _, search := range searches {
-		iterators = append(iterators, *btreeRangeSearch{rangeSearch: search, idx: idx}.Iterator())
+		iterators = append(iterators, *btreeHistorySearch{rangeSearch: search, idx: idx, window: window}.Iterator())
 	}
 	return iterator.BuildIterator(&iterators)
 }
 
+// Matcher returns a predicate that is true for the datums satisfying the selection's
+// constraints, whether or not they are in the index.
+func (idx *BTreeIndex) Matcher(sel Selection) func(Datum) bool {
+	c := idx.buildConstraints(sel)
+	var filter predicate
+	if c.V != nil {
+		filter = buildValueFilter(c.V).Pred
+	}
+	return func(d Datum) bool {
+		return (c.E == nil || c.E.Contains(d.E)) &&
+			(c.A == nil || c.A.Contains(d.A)) &&
+			(filter == nil || filter(d))
+	}
+}
+
 func (idx *BTreeIndex) SelectOne(sel Selection) (datum Datum) {
 	iter := idx.Select(sel)
 	if iter == nil || !iter.Next() {
 		return
 	}
+	iter.Stop()
 	return iter.Value().(Datum)
 }
 
@@ -208,6 +379,14 @@ func (filter btreeFilter) Each(accept iterator.Accept) {
 				return true
 			}
 		}
+	case IndexVAE:
+		treeIter = func(item btree.Item) bool {
+			node := item.(Node)
+			if node.kind != IndexVAE || Compare(node.datum.V, filter.start.V) != 0 {
+				return false
+			}
+			return accept(node.datum)
+		}
 	default:
 		panic("TODO")
 	}
@@ -222,6 +401,12 @@ func (idx *BTreeIndex) Filter(typ IndexType, d Datum) *iterator.Iterator {
 	return btreeFilter{idx: idx, indexType: typ, start: d}.Iterator()
 }
 
+// Referrers returns an iterator of the current ref datums whose value is the given id,
+// ordered by attr and then entity.
+func (idx *BTreeIndex) Referrers(id ID) *iterator.Iterator {
+	return idx.Filter(IndexVAE, Datum{V: id})
+}
+
 func (idx *BTreeIndex) ResolveIdent(ident Ident) ID {
 	return idx.idents[String(ident)]
 }
@@ -324,6 +509,21 @@ func buildValueFilter(vsel VSel) ValueFilter {
 		for v, _ := range typed {
 			filters = append(filters, buildValueFilter(v))
 		}
+		// The set is bounded by the least min and greatest max of its members, if they all
+		// have them.
+		var min, max Value
+		for i, filter := range filters {
+			if filter.Min == nil || filter.Max == nil {
+				min, max = nil, nil
+				break
+			}
+			if i == 0 || Compare(filter.Min, min) < 0 {
+				min = filter.Min
+			}
+			if i == 0 || Compare(filter.Max, max) > 0 {
+				max = filter.Max
+			}
+		}
 		return ValueFilter{
 			Pred: func(datum Datum) bool {
 				for _, filter := range filters {
@@ -333,6 +533,8 @@ func buildValueFilter(vsel VSel) ValueFilter {
 				}
 				return false
 			},
+			Min: min,
+			Max: max,
 		}
 	case VRange:
 		var exemplar Value
@@ -408,14 +610,8 @@ func buildValueFilter(vsel VSel) ValueFilter {
 				id, ok := datum.V.(String)
 				return ok && id <= max
 			}}
-		case Int:
-			panic("TODO int")
-		case Float:
-			panic("TODO float")
-		case Inst:
-			panic("TODO inst")
-		case Bool:
-			panic("TODO bool")
+		case Int, Float, Inst, Bool:
+			return buildOrderedRangeFilter(typed, exemplar)
 		default:
 			return matchesNoValue
 		}
@@ -423,3 +619,17 @@ func buildValueFilter(vsel VSel) ValueFilter {
 		return matchesNoValue
 	}
 }
+
+// buildOrderedRangeFilter returns a filter for the values of the exemplar's type in the
+// range, as ordered by Compare.
+func buildOrderedRangeFilter(r VRange, exemplar Value) ValueFilter {
+	typ := reflect.TypeOf(exemplar)
+	if r.Min != nil && reflect.TypeOf(r.Min) != typ || r.Max != nil && reflect.TypeOf(r.Max) != typ {
+		return matchesNoValue
+	}
+	return ValueFilter{Min: r.Min, Max: r.Max, Pred: func(datum Datum) bool {
+		return reflect.TypeOf(datum.V) == typ &&
+			(r.Min == nil || Compare(datum.V, r.Min) >= 0) &&
+			(r.Max == nil || Compare(datum.V, r.Max) <= 0)
+	}}
+}
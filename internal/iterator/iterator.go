@@ -42,17 +42,23 @@ func (iter *Iterator) Value() Value {
 	return iter.current
 }
 
+// Stop stops the iterator, returning once its collection is no longer being read, so
+// that the collection may then be changed.
 func (iter *Iterator) Stop() {
 	close(iter.stop)
+	for range iter.values {
+	}
 }
 
 type Iterators []Iterator
 
 func (iters Iterators) Each(accept Accept) {
-	for _, iterator := range iters {
-		for iterator.Next() {
-			if !accept(iterator.Value()) {
-				// TODO close the remaining iterators, yeah?
+	for i := range iters {
+		for iters[i].Next() {
+			if !accept(iters[i].Value()) {
+				for j := i; j < len(iters); j++ {
+					iters[j].Stop()
+				}
 				return
 			}
 		}
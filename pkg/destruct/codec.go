@@ -0,0 +1,132 @@
+package destruct
+
+import (
+	"math"
+	"reflect"
+	"time"
+
+	"github.com/dball/constructive/pkg/sys"
+	. "github.com/dball/constructive/pkg/types"
+)
+
+// ValueMarshaler is implemented by types that record themselves as values of their own
+// choosing, e.g. a UUID as a String, an amount of money as an Int of cents, or an enum
+// as the Ident of a ref.
+type ValueMarshaler interface {
+	// AttrType returns the type of the attr whose values this type records, e.g.
+	// sys.AttrTypeString. It must not depend on the receiver's value.
+	AttrType() ID
+	// MarshalValue returns the value to record, which may be an Ident for a ref attr.
+	MarshalValue() (VRef, error)
+}
+
+// ValueUnmarshaler is implemented by types that populate themselves from values, generally
+// by a pointer receiver. Ref values are given as the Ident of the referent if it has one,
+// and as its ID otherwise.
+type ValueUnmarshaler interface {
+	UnmarshalValue(v VRef) error
+}
+
+var marshalerType = reflect.TypeOf((*ValueMarshaler)(nil)).Elem()
+var unmarshalerType = reflect.TypeOf((*ValueUnmarshaler)(nil)).Elem()
+
+// marshalerAttrType returns the attr type declared by a marshaler type, or 0 if the type
+// is not a marshaler, either by value or by pointer. A pointer type, e.g. the type of an
+// optional field, declares the attr type of its element type. The attr type is given by
+// a pointer to a new value, as a nil pointer would not do for value receivers.
+func marshalerAttrType(typ reflect.Type) ID {
+	if typ.Kind() == reflect.Ptr {
+		typ = typ.Elem()
+	}
+	if !reflect.PtrTo(typ).Implements(marshalerType) {
+		return 0
+	}
+	return reflect.New(typ).Interface().(ValueMarshaler).AttrType()
+}
+
+// converter returns the value recorded by a field's value, or by an element of a
+// cardinality many or list field.
+type converter func(value reflect.Value) (VRef, error)
+
+// buildConverter returns the converter for values of the type, and whether they are
+// marshalers. A struct type other than time.Time is a ref to a record, and has none. The
+// values of other types that are not scalars fail to convert.
+func buildConverter(typ reflect.Type) (convert converter, marshaler bool) {
+	switch {
+	case typ.Implements(marshalerType):
+		return func(value reflect.Value) (VRef, error) {
+			return value.Interface().(ValueMarshaler).MarshalValue()
+		}, true
+	case reflect.PtrTo(typ).Implements(marshalerType):
+		return func(value reflect.Value) (VRef, error) {
+			ptr := reflect.New(typ)
+			ptr.Elem().Set(value)
+			return ptr.Interface().(ValueMarshaler).MarshalValue()
+		}, true
+	}
+	switch typ.Kind() {
+	case reflect.Bool:
+		return func(value reflect.Value) (VRef, error) {
+			return Bool(value.Bool()), nil
+		}, false
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		return func(value reflect.Value) (VRef, error) {
+			return Int(value.Int()), nil
+		}, false
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		return func(value reflect.Value) (VRef, error) {
+			u := value.Uint()
+			if u > math.MaxInt64 {
+				return nil, ErrAttrFieldOverflow
+			}
+			return Int(u), nil
+		}, false
+	case reflect.String:
+		return func(value reflect.Value) (VRef, error) {
+			return String(value.String()), nil
+		}, false
+	case reflect.Float32, reflect.Float64:
+		return func(value reflect.Value) (VRef, error) {
+			return Float(value.Float()), nil
+		}, false
+	case reflect.Struct:
+		if typ == timeType {
+			return func(value reflect.Value) (VRef, error) {
+				return Inst(value.Interface().(time.Time)), nil
+			}, false
+		}
+		return nil, false
+	}
+	return func(value reflect.Value) (VRef, error) {
+		return nil, ErrInvalidAttrField
+	}, false
+}
+
+// unmarshalValue populates an addressable unmarshaler value from the attr's value, if it
+// is one.
+func unmarshalValue(db Database, field reflect.Value, attr Attr, v Value) (bool, error) {
+	if !field.CanAddr() || !field.Addr().Type().Implements(unmarshalerType) {
+		return false, nil
+	}
+	var vref VRef = v.(VRef)
+	if attr.Type == sys.AttrTypeRef {
+		iter := db.Select(Selection{E: v.(ID), A: sys.DbIdent})
+		if iter.Next() {
+			vref = Ident(iter.Value().(Datum).V.(String))
+		}
+		iter.Stop()
+	}
+	return true, field.Addr().Interface().(ValueUnmarshaler).UnmarshalValue(vref)
+}
+
+// lessVRef orders values as Compare does, and Idents by name.
+func lessVRef(x VRef, y VRef) bool {
+	xv, xok := x.(Value)
+	yv, yok := y.(Value)
+	if xok && yok {
+		return Compare(xv, yv) < 0
+	}
+	xi, _ := x.(Ident)
+	yi, _ := y.(Ident)
+	return xi < yi
+}
@@ -2,6 +2,8 @@ package destruct
 
 import (
 	"reflect"
+	"sort"
+	"sync"
 	"time"
 
 	"github.com/dball/constructive/pkg/sys"
@@ -10,43 +12,160 @@ import (
 
 type attrField struct {
 	attr  Attr
-	index int
+	index []int
+	// position and value are the attrs of a list field's elements.
+	position ID
+	value    Attr
+	// convert and marshaler are those of the field's tagged field.
+	convert   converter
+	marshaler bool
 }
 
 type attrStruct struct {
-	idIndex int
+	// idIndex is the index of the entity id field, if any.
+	idIndex []int
 	fields  map[ID]attrField
 }
 
-func parseAttrFields(refType reflect.Type, db Database) (attrs attrStruct) {
-	n := refType.NumField()
-	attrs.idIndex = -1
-	attrs.fields = make(map[ID]attrField, n)
-	for i := 0; i < n; i++ {
-		ident := ParseAttrField(refType.Field(i)).Ident
+// attrStructs maps struct types to their attr structs for the most recently parsed schema
+// versions, most recent first, so that readers of databases of different versions do not
+// evict each other's. The slices are replaced rather than changed.
+var attrStructs sync.Map
+
+// maxCachedVersions is the number of schema versions for which a type's attr structs are
+// cached.
+const maxCachedVersions = 4
+
+type cachedAttrStruct struct {
+	version SchemaVersion
+	attrs   attrStruct
+}
+
+// parseAttrFields returns the struct type's attr fields, resolved against the database's
+// attrs. The attr structs are cached by schema version, and must not be changed.
+func parseAttrFields(refType reflect.Type, db Database) (attrStruct, error) {
+	version := db.SchemaVersion()
+	var cached []cachedAttrStruct
+	if value, ok := attrStructs.Load(refType); ok {
+		cached = value.([]cachedAttrStruct)
+		for _, c := range cached {
+			if c.version == version {
+				return c.attrs, nil
+			}
+		}
+	}
+	attrs, err := compileAttrFields(refType, db)
+	if err != nil {
+		return attrs, err
+	}
+	n := len(cached)
+	if n >= maxCachedVersions {
+		n = maxCachedVersions - 1
+	}
+	next := make([]cachedAttrStruct, 0, n+1)
+	next = append(next, cachedAttrStruct{version: version, attrs: attrs})
+	next = append(next, cached[:n]...)
+	attrStructs.Store(refType, next)
+	return attrs, nil
+}
+
+func compileAttrFields(refType reflect.Type, db Database) (attrs attrStruct, err error) {
+	fields, err := taggedFields(refType)
+	if err != nil {
+		return
+	}
+	attrs.fields = make(map[ID]attrField, len(fields))
+	for _, field := range fields {
+		ident := field.attr.Ident
 		switch ident {
-		case "":
 		case sys.DbId:
-			attrs.idIndex = i
+			attrs.idIndex = field.Index
 		default:
 			attr := db.AttrByIdent(ident)
 			if attr.ID == 0 {
 				continue
 			}
-			attrs.fields[attr.ID] = attrField{attr: attr, index: i}
+			af := attrField{
+				attr:      attr,
+				index:     field.Index,
+				convert:   field.convert,
+				marshaler: field.marshaler,
+			}
+			if field.list {
+				position, value := ListAttrIdents(ident)
+				af.position = db.AttrByIdent(position).ID
+				af.value = db.AttrByIdent(value)
+			}
+			attrs.fields[attr.ID] = af
 		}
 	}
 	return
 }
 
-func Construct(ref interface{}, db Database, id ID) bool {
-	refValue := reflect.ValueOf(ref).Elem()
+// constructor constructs records, following their struct refs.
+type constructor struct {
+	db    Database
+	depth int
+	// path holds the entities being constructed, from the outermost record inwards.
+	path map[ID]Void
+	// pointers maps the entities constructed by pointer to their pointers, so that each is
+	// constructed once per type, even if their refs form cycles.
+	pointers map[entityType]reflect.Value
+}
+
+type entityType struct {
+	e   ID
+	typ reflect.Type
+}
+
+// Construct populates the ref's struct from the datums about the entity, returning false
+// if there are none. Struct ref fields are populated by constructing the referenced
+// entities, in turn. Pointer fields that refer to the same entity share a pointer, but
+// struct ref fields whose values would have to contain themselves are invalid, as are
+// fields that cannot represent their values.
+func Construct(ref interface{}, db Database, id ID) (bool, error) {
+	refValue, err := recordPointer(ref)
+	if err != nil {
+		return false, err
+	}
+	c := constructor{db: db, path: map[ID]Void{}, pointers: map[entityType]reflect.Value{}}
+	c.pointers[entityType{e: id, typ: refValue.Type().Elem()}] = refValue
+	return c.construct(refValue.Elem(), id)
+}
+
+// recordPointer returns the value of the ref, which must be a non-nil pointer to a struct.
+func recordPointer(ref interface{}) (reflect.Value, error) {
+	refValue := reflect.ValueOf(ref)
+	if refValue.Kind() != reflect.Ptr || refValue.IsNil() || refValue.Elem().Kind() != reflect.Struct {
+		return refValue, ErrInvalidRecord
+	}
+	return refValue, nil
+}
+
+// construct populates the struct value from the datums about the entity.
+func (c *constructor) construct(refValue reflect.Value, id ID) (bool, error) {
+	db := c.db
+	c.path[id] = Void{}
+	defer delete(c.path, id)
 	refType := refValue.Type()
-	attrs := parseAttrFields(refType, db)
-	if attrs.idIndex >= 0 {
-		refValue.Field(attrs.idIndex).SetUint(uint64(id))
+	attrs, err := parseAttrFields(refType, db)
+	if err != nil {
+		return false, err
+	}
+	if attrs.idIndex != nil {
+		if err := setInt(refValue.FieldByIndex(attrs.idIndex), int64(id)); err != nil {
+			return false, fieldError(refType, refType.FieldByIndex(attrs.idIndex), err)
+		}
+	}
+	for _, attrField := range attrs.fields {
+		fieldValue := refValue.FieldByIndex(attrField.index)
+		switch fieldValue.Kind() {
+		case reflect.Slice, reflect.Map, reflect.Ptr:
+			fieldValue.Set(reflect.Zero(fieldValue.Type()))
+		}
 	}
 	found := false
+	lists := map[ID][]listElement{}
 	iter := db.Select(Selection{E: id})
 	for iter.Next() {
 		found = true
@@ -55,39 +174,213 @@ func Construct(ref interface{}, db Database, id ID) bool {
 		if !ok {
 			continue
 		}
-		switch attrField.attr.Type {
-		case sys.AttrTypeString:
-			refValue.Field(attrField.index).SetString(string(datum.V.(String)))
-		case sys.AttrTypeInt:
-			refValue.Field(attrField.index).SetInt(int64(datum.V.(Int)))
-		case sys.AttrTypeBool:
-			refValue.Field(attrField.index).SetBool(bool(datum.V.(Bool)))
-		case sys.AttrTypeRef:
-			refValue.Field(attrField.index).SetUint(uint64(datum.V.(ID)))
-		case sys.AttrTypeFloat:
-			refValue.Field(attrField.index).SetFloat(float64(datum.V.(Float)))
-		case sys.AttrTypeInst:
-			refValue.Field(attrField.index).Set(reflect.ValueOf(time.Time(datum.V.(Inst))))
+		if attrField.value.ID != 0 {
+			lists[attrField.attr.ID] = append(lists[attrField.attr.ID], constructElement(db, attrField, datum.V.(ID)))
+			continue
+		}
+		fieldValue := refValue.FieldByIndex(attrField.index)
+		ok, err := unmarshalValue(db, fieldValue, attrField.attr, datum.V)
+		if err != nil {
+			return false, fieldError(refType, refType.FieldByIndex(attrField.index), err)
+		}
+		if ok {
+			continue
+		}
+		switch fieldValue.Kind() {
+		case reflect.Slice:
+			// The elements are appended in the order of their values.
+			elem := reflect.New(fieldValue.Type().Elem()).Elem()
+			err = c.setValue(elem, attrField.attr, datum.V)
+			fieldValue.Set(reflect.Append(fieldValue, elem))
+		case reflect.Map:
+			if fieldValue.IsNil() {
+				fieldValue.Set(reflect.MakeMap(fieldValue.Type()))
+			}
+			key := reflect.New(fieldValue.Type().Key()).Elem()
+			err = c.setValue(key, attrField.attr, datum.V)
+			fieldValue.SetMapIndex(key, reflect.Zero(fieldValue.Type().Elem()))
+		case reflect.Ptr:
+			elemType := fieldValue.Type().Elem()
+			var key entityType
+			if attrField.attr.Type == sys.AttrTypeRef && elemType.Kind() == reflect.Struct {
+				key = entityType{e: datum.V.(ID), typ: elemType}
+				if ptr, ok := c.pointers[key]; ok {
+					fieldValue.Set(ptr)
+					continue
+				}
+			}
+			ptr := reflect.New(elemType)
+			if key.typ != nil {
+				c.pointers[key] = ptr
+			}
+			err = c.setValue(ptr.Elem(), attrField.attr, datum.V)
+			fieldValue.Set(ptr)
 		default:
-			panic("construct2 all the types")
+			err = c.setValue(fieldValue, attrField.attr, datum.V)
 		}
+		if err != nil {
+			return false, fieldError(refType, refType.FieldByIndex(attrField.index), err)
+		}
+	}
+	for a, elements := range lists {
+		attrField := attrs.fields[a]
+		sort.Slice(elements, func(i, j int) bool {
+			return elements[i].position < elements[j].position
+		})
+		fieldValue := refValue.FieldByIndex(attrField.index)
+		slice := reflect.MakeSlice(fieldValue.Type(), 0, len(elements))
+		for _, element := range elements {
+			elem := reflect.New(fieldValue.Type().Elem()).Elem()
+			if element.v != nil {
+				if err := c.setValue(elem, attrField.value, element.v); err != nil {
+					return false, fieldError(refType, refType.FieldByIndex(attrField.index), err)
+				}
+			}
+			slice = reflect.Append(slice, elem)
+		}
+		fieldValue.Set(slice)
 	}
-	return found
+	return found, nil
+}
+
+type listElement struct {
+	position Int
+	v        Value
 }
 
-func Fetch(ref interface{}, db Database) bool {
-	refValue := reflect.ValueOf(ref).Elem()
+// constructElement returns the position and value of a list field's element entity.
+func constructElement(db Database, attrField attrField, e ID) (element listElement) {
+	iter := db.Select(Selection{E: e})
+	for iter.Next() {
+		datum := iter.Value().(Datum)
+		switch datum.A {
+		case attrField.position:
+			element.position = datum.V.(Int)
+		case attrField.value.ID:
+			element.v = datum.V
+		}
+	}
+	return
+}
+
+// setValue sets the field, or slice element or map key, to the value of the attr,
+// unmarshaling it if the field is an unmarshaler, and constructing the referenced entity
+// if it is a struct.
+func (c *constructor) setValue(field reflect.Value, attr Attr, v Value) error {
+	if ok, err := unmarshalValue(c.db, field, attr, v); ok || err != nil {
+		return err
+	}
+	switch attr.Type {
+	case sys.AttrTypeString:
+		field.SetString(string(v.(String)))
+	case sys.AttrTypeInt:
+		return setInt(field, int64(v.(Int)))
+	case sys.AttrTypeBool:
+		field.SetBool(bool(v.(Bool)))
+	case sys.AttrTypeRef:
+		if field.Kind() == reflect.Struct {
+			return c.constructRef(field, v.(ID))
+		}
+		field.SetUint(uint64(v.(ID)))
+	case sys.AttrTypeFloat:
+		f := float64(v.(Float))
+		if field.OverflowFloat(f) {
+			return ErrAttrFieldOverflow
+		}
+		field.SetFloat(f)
+	case sys.AttrTypeInst:
+		field.Set(reflect.ValueOf(time.Time(v.(Inst))))
+	default:
+		return ErrInvalidAttrField
+	}
+	return nil
+}
+
+// setInt sets the integer field to the value, unless the field's kind cannot represent it.
+func setInt(field reflect.Value, i int64) error {
+	switch field.Kind() {
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		if field.OverflowInt(i) {
+			return ErrAttrFieldOverflow
+		}
+		field.SetInt(i)
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		if i < 0 || field.OverflowUint(uint64(i)) {
+			return ErrAttrFieldOverflow
+		}
+		field.SetUint(uint64(i))
+	default:
+		return ErrInvalidAttrField
+	}
+	return nil
+}
+
+// constructRef populates the struct ref field from the datums about the referenced entity.
+func (c *constructor) constructRef(field reflect.Value, id ID) error {
+	if _, ok := c.path[id]; ok {
+		return ErrStructRefCycle
+	}
+	if c.depth >= maxDepth {
+		return ErrRecordDepth
+	}
+	c.depth++
+	_, err := c.construct(field, id)
+	c.depth--
+	return err
+}
+
+// Fetch populates the ref's struct as Construct, from the entity identified by its entity
+// id field, then any of its unique attr fields. It returns false if there is no such
+// entity, or if the fields identify different entities.
+func Fetch(ref interface{}, db Database) (bool, error) {
+	refPtr, err := recordPointer(ref)
+	if err != nil {
+		return false, err
+	}
+	refValue := refPtr.Elem()
 	refType := refValue.Type()
-	attrs := parseAttrFields(refType, db)
+	attrs, err := parseAttrFields(refType, db)
+	if err != nil {
+		return false, err
+	}
 	var id ID
-	if attrs.idIndex >= 0 {
-		id = ID(refValue.Field(attrs.idIndex).Uint())
+	if attrs.idIndex != nil {
+		id, err = idValue(refValue.FieldByIndex(attrs.idIndex))
+		if err != nil {
+			return false, fieldError(refType, refType.FieldByIndex(attrs.idIndex), err)
+		}
 	}
 	for _, field := range attrs.fields {
-		if field.attr.Unique == 0 {
+		if field.attr.Unique == 0 || field.attr.Cardinality == sys.AttrCardinalityMany {
 			continue
 		}
-		value := pluckFieldValue(field.attr, refValue.Field(field.index))
+		fieldValue := refValue.FieldByIndex(field.index)
+		if fieldValue.Kind() == reflect.Ptr {
+			if fieldValue.IsNil() {
+				continue
+			}
+			fieldValue = fieldValue.Elem()
+		}
+		var value Value
+		if field.marshaler {
+			var vref VRef
+			vref, err = field.convert(fieldValue)
+			if err == nil {
+				switch v := vref.(type) {
+				case Value:
+					value = v
+				case Ident:
+					value = db.ResolveEReadRef(v)
+				default:
+					err = ErrInvalidValue
+				}
+			}
+		} else {
+			value, err = pluckFieldValue(field.attr, fieldValue)
+		}
+		if err != nil {
+			return false, fieldError(refType, refType.FieldByIndex(field.index), err)
+		}
 		if value.IsEmpty() {
 			continue
 		}
@@ -102,25 +395,60 @@ func Fetch(ref interface{}, db Database) bool {
 		if fieldID == id {
 			continue
 		}
-		return false
+		return false, nil
 	}
 	return Construct(ref, db, id)
 }
 
-func pluckFieldValue(attr Attr, refValue reflect.Value) Value {
+// pluckFieldValue returns the value of a unique attr field, by which it may identify its
+// entity.
+func pluckFieldValue(attr Attr, refValue reflect.Value) (Value, error) {
 	switch attr.Type {
-	case sys.AttrTypeString:
-		return String(refValue.String())
-	case sys.AttrTypeBool:
-		return Bool(refValue.Bool())
-	case sys.AttrTypeInt:
-		return Int(refValue.Int())
 	case sys.AttrTypeRef:
-		return ID(refValue.Uint())
-	case sys.AttrTypeInst:
-		panic("TODO inst")
-	case sys.AttrTypeFloat:
-		return Float(refValue.Float())
+		switch refValue.Kind() {
+		case reflect.Struct:
+			// Struct refs do not identify records.
+			return ID(0), nil
+		case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+			return ID(refValue.Uint()), nil
+		}
+		return nil, ErrInvalidAttrField
+	case sys.AttrTypeString, sys.AttrTypeBool, sys.AttrTypeInt, sys.AttrTypeFloat, sys.AttrTypeInst:
+		return scalarValue(refValue)
+	}
+	return nil, ErrInvalidAttrField
+}
+
+// SelectEntities returns the ids of the entities with datums matching all of the
+// selections, in order. Selections may name their attrs by Ident; those that name attrs
+// not in the database match nothing.
+func SelectEntities(db Database, selections ...Selection) []ID {
+	var entities map[ID]Void
+	for _, selection := range selections {
+		matched := map[ID]Void{}
+		if ident, ok := selection.A.(Ident); ok {
+			selection.A = db.AttrByIdent(ident).ID
+			if selection.A == ID(0) {
+				entities = matched
+				break
+			}
+		}
+		iter := db.Select(selection)
+		for iter.Next() {
+			e := iter.Value().(Datum).E
+			if _, ok := entities[e]; ok || entities == nil {
+				matched[e] = Void{}
+			}
+		}
+		entities = matched
+		if len(entities) == 0 {
+			break
+		}
+	}
+	ids := make([]ID, 0, len(entities))
+	for e := range entities {
+		ids = append(ids, e)
 	}
-	panic("TODO whatttt")
+	sort.Slice(ids, func(i, j int) bool { return ids[i] < ids[j] })
+	return ids
 }
@@ -1,9 +1,14 @@
 package destruct
 
 import (
+	"errors"
 	"fmt"
+	"math"
 	"reflect"
+	"sort"
 	"strings"
+	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/dball/constructive/pkg/sys"
@@ -13,20 +18,155 @@ import (
 func ParseAttrTag(tag string) (attr Attr) {
 	parts := strings.Split(tag, ",")
 	attr.Ident = Ident(parts[0])
-	if len(parts) > 1 {
-		switch parts[1] {
+	for _, option := range parts[1:] {
+		switch option {
 		case "identity":
 			attr.Unique = sys.AttrUniqueIdentity
 		case "unique":
 			attr.Unique = sys.AttrUniqueValue
+		case "component":
+			attr.RefType = sys.AttrRefTypeComponent
 		}
 	}
 	return
 }
 
+// hasTagOption is true if the attr tag has the given option.
+func hasTagOption(tag string, option string) bool {
+	for _, part := range strings.Split(tag, ",")[1:] {
+		if part == option {
+			return true
+		}
+	}
+	return false
+}
+
+// IsListField is true if the field declares a list attr with the list tag option. A list
+// attr is a cardinality many component ref to element entities, each of which has a
+// position and a value attr, keyed by position.
+func IsListField(field reflect.StructField) bool {
+	tag, ok := field.Tag.Lookup("attr")
+	return ok && hasTagOption(tag, "list") && field.Type.Kind() == reflect.Slice
+}
+
+// ListAttrIdents returns the idents of the position and value attrs of a list attr's
+// elements.
+func ListAttrIdents(ident Ident) (position Ident, value Ident) {
+	return ident + "/position", ident + "/value"
+}
+
 var timeType = reflect.TypeOf(time.Time{})
 
-func ParseAttrField(field reflect.StructField) (attr Attr) {
+// taggedField is a struct field that declares an attr, possibly promoted from an embedded
+// struct, in which case its Index is the path to it from the outer struct. The attr's
+// ident includes the namespace of the struct declaring the field, if any.
+type taggedField struct {
+	reflect.StructField
+	attr Attr
+	// list and omitEmpty record the field's list and omitempty tag options.
+	list      bool
+	omitEmpty bool
+	// convert converts the values of the field, or of its elements if it is a cardinality
+	// many or list field, once any pointer is dereferenced. Struct ref fields have none.
+	convert converter
+	// marshaler is true if the values converted are marshalers.
+	marshaler bool
+}
+
+// fieldsCache maps struct types to their tagged fields.
+var fieldsCache sync.Map
+
+// taggedFields returns the struct type's fields that declare attrs, including those of
+// its untagged embedded structs, in order, with the converters of their values, so that
+// records of the type are destructured without inspecting their types again. The fields
+// are cached, and must not be changed.
+func taggedFields(typ reflect.Type) ([]taggedField, error) {
+	if fields, ok := fieldsCache.Load(typ); ok {
+		return fields.([]taggedField), nil
+	}
+	if typ.Kind() != reflect.Struct {
+		return nil, ErrInvalidRecord
+	}
+	fields, err := appendTaggedFields(nil, typ, nil, "")
+	if err != nil {
+		return nil, err
+	}
+	fieldsCache.Store(typ, fields)
+	return fields, nil
+}
+
+// fieldError returns the error of the struct type's field, naming the field. Errors about
+// the nesting of struct refs are not named, lest they be named at every depth.
+func fieldError(typ reflect.Type, field reflect.StructField, err error) error {
+	if errors.Is(err, ErrRecordDepth) || errors.Is(err, ErrStructRefCycle) {
+		return err
+	}
+	return fmt.Errorf("%s.%s: %w", typ, field.Name, err)
+}
+
+// appendTaggedFields appends the struct type's tagged fields, given the path to the
+// struct and the namespace of the struct that embeds it, if any.
+//
+// A struct declares the namespace of its fields' attrs with a blank field tagged e.g.
+// `namespace:"person"`, so that its fields may be tagged e.g. `attr:"name"` to declare
+// person/name. Embedded structs without namespaces have their embedders' namespaces.
+func appendTaggedFields(fields []taggedField, typ reflect.Type, index []int, namespace string) ([]taggedField, error) {
+	n := typ.NumField()
+	for i := 0; i < n; i++ {
+		field := typ.Field(i)
+		if field.Name == "_" {
+			if ns, ok := field.Tag.Lookup("namespace"); ok {
+				namespace = ns
+			}
+		}
+	}
+	for i := 0; i < n; i++ {
+		field := typ.Field(i)
+		field.Index = append(append([]int{}, index...), i)
+		_, tagged := field.Tag.Lookup("attr")
+		if !tagged {
+			if field.Anonymous && field.Type.Kind() == reflect.Struct && marshalerAttrType(field.Type) == 0 {
+				var err error
+				fields, err = appendTaggedFields(fields, field.Type, field.Index, namespace)
+				if err != nil {
+					return nil, err
+				}
+			}
+			continue
+		}
+		attr, err := ParseAttrField(field)
+		if err != nil {
+			return nil, fieldError(typ, field, err)
+		}
+		if namespace != "" && !strings.Contains(string(attr.Ident), "/") {
+			attr.Ident = Ident(namespace) + "/" + attr.Ident
+		}
+		tf := taggedField{
+			StructField: field,
+			attr:        attr,
+			list:        IsListField(field),
+			omitEmpty:   hasTagOption(field.Tag.Get("attr"), "omitempty"),
+		}
+		valueType := field.Type
+		switch {
+		case valueType.Kind() == reflect.Ptr:
+			valueType = valueType.Elem()
+		case marshalerAttrType(valueType) != 0:
+		case valueType.Kind() == reflect.Slice:
+			valueType = valueType.Elem()
+		case valueType.Kind() == reflect.Map:
+			valueType = valueType.Key()
+		}
+		tf.convert, tf.marshaler = buildConverter(valueType)
+		fields = append(fields, tf)
+	}
+	return fields, nil
+}
+
+// ParseAttrField parses the attr declared by the field's tag, if any. Slice fields and
+// map fields whose values are empty structs declare cardinality many attrs, whose values
+// are the elements or keys. Fields of types that cannot be recorded are invalid.
+func ParseAttrField(field reflect.StructField) (attr Attr, err error) {
 	tag, ok := field.Tag.Lookup("attr")
 	if !ok {
 		return
@@ -35,40 +175,98 @@ func ParseAttrField(field reflect.StructField) (attr Attr) {
 	if attr.Ident == sys.DbId {
 		return
 	}
-	switch field.Type.Kind() {
+	typ := field.Type
+	if t := marshalerAttrType(typ); t != 0 {
+		attr.Type = t
+		return
+	}
+	if IsListField(field) {
+		if t := attrType(typ.Elem()); t == 0 || t == sys.AttrTypeRef && marshalerAttrType(typ.Elem()) == 0 {
+			err = ErrInvalidAttrField
+			return
+		}
+		attr.Type = sys.AttrTypeRef
+		attr.Cardinality = sys.AttrCardinalityMany
+		attr.RefType = sys.AttrRefTypeComponent
+		return
+	}
+	switch typ.Kind() {
+	case reflect.Ptr:
+		typ = typ.Elem()
+	case reflect.Slice:
+		attr.Cardinality = sys.AttrCardinalityMany
+		typ = typ.Elem()
+	case reflect.Map:
+		if typ.Elem().Kind() != reflect.Struct || typ.Elem().NumField() != 0 {
+			err = ErrInvalidAttrField
+			return
+		}
+		attr.Cardinality = sys.AttrCardinalityMany
+		typ = typ.Key()
+	}
+	attr.Type = attrType(typ)
+	if attr.Type == 0 || attr.Cardinality == sys.AttrCardinalityMany && attr.Type == sys.AttrTypeRef && marshalerAttrType(typ) == 0 {
+		err = ErrInvalidAttrField
+	}
+	return
+}
+
+// attrType returns the attr type of values of the given type, or 0 if there is none.
+func attrType(typ reflect.Type) ID {
+	if t := marshalerAttrType(typ); t != 0 {
+		return t
+	}
+	switch typ.Kind() {
 	case reflect.Bool:
-		attr.Type = sys.AttrTypeBool
-	case reflect.Int:
-		attr.Type = sys.AttrTypeInt
+		return sys.AttrTypeBool
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64,
+		reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		return sys.AttrTypeInt
 	case reflect.String:
-		attr.Type = sys.AttrTypeString
-	case reflect.Float64:
-		attr.Type = sys.AttrTypeFloat
+		return sys.AttrTypeString
+	case reflect.Float32, reflect.Float64:
+		return sys.AttrTypeFloat
 	case reflect.Struct:
-		if timeType == field.Type {
-			attr.Type = sys.AttrTypeInst
-		} else {
-			attr.Type = sys.AttrTypeRef
+		if timeType == typ {
+			return sys.AttrTypeInst
 		}
-	default:
-		panic("Invalid attr field type")
+		return sys.AttrTypeRef
 	}
-	return
+	return 0
 }
 
 var symCount uint64
 
-func Schema(typ reflect.Type) []Claim {
-	n := typ.NumField()
-	claims := make([]Claim, 0, n)
-	for i := 0; i < n; i++ {
-		field := typ.Field(i)
-		attr := ParseAttrField(field)
-		if attr.Ident == "" || attr.Ident == sys.DbId {
+// NewTempID returns a new tempid, distinct from those previously returned or used by the
+// destructuring functions.
+func NewTempID() TempID {
+	// TODO note we could use a different TempID type here and keep the whole string domain available to our callers
+	return TempID(fmt.Sprintf("%d", atomic.AddUint64(&symCount, 1)))
+}
+
+// Schema returns the claims that assert the attrs declared by the struct type's fields,
+// and by the fields of the struct types to which they refer.
+func Schema(typ reflect.Type) ([]Claim, error) {
+	return schema(typ, map[reflect.Type]Void{})
+}
+
+// schema returns the schema claims for the struct type, unless it has been visited.
+func schema(typ reflect.Type, visited map[reflect.Type]Void) ([]Claim, error) {
+	if _, ok := visited[typ]; ok {
+		return nil, nil
+	}
+	visited[typ] = Void{}
+	fields, err := taggedFields(typ)
+	if err != nil {
+		return nil, err
+	}
+	claims := make([]Claim, 0, 2*len(fields))
+	for _, field := range fields {
+		attr := field.attr
+		if attr.Ident == sys.DbId {
 			continue
 		}
-		symCount++
-		e := TempID(fmt.Sprintf("%d", symCount))
+		e := NewTempID()
 		claims = append(claims,
 			Claim{E: e, A: sys.DbIdent, V: String(attr.Ident)},
 			Claim{E: e, A: sys.AttrType, V: attr.Type},
@@ -76,27 +274,99 @@ func Schema(typ reflect.Type) []Claim {
 		if attr.Unique > 0 {
 			claims = append(claims, Claim{E: e, A: sys.AttrUnique, V: attr.Unique})
 		}
-		if attr.Type == sys.AttrTypeRef {
-			// TODO we need a types-that-have-been-schematized collection to prevent infinite cycles
-			claims = append(claims, Schema(field.Type)...)
+		if attr.Cardinality > 0 {
+			claims = append(claims, Claim{E: e, A: sys.AttrCardinality, V: attr.Cardinality})
+		}
+		if attr.RefType > 0 {
+			claims = append(claims, Claim{E: e, A: sys.AttrRefType, V: attr.RefType})
+		}
+		if field.list {
+			position, value := ListAttrIdents(attr.Ident)
+			p := NewTempID()
+			v := NewTempID()
+			claims = append(claims,
+				Claim{E: e, A: sys.AttrRefTypeComponentKey, V: p},
+				Claim{E: p, A: sys.DbIdent, V: String(position)},
+				Claim{E: p, A: sys.AttrType, V: sys.AttrTypeInt},
+				Claim{E: v, A: sys.DbIdent, V: String(value)},
+				Claim{E: v, A: sys.AttrType, V: attrType(field.Type.Elem())},
+			)
+			continue
+		}
+		ref := field.Type
+		if ref.Kind() == reflect.Ptr {
+			ref = ref.Elem()
+		}
+		if attr.Type == sys.AttrTypeRef && ref.Kind() == reflect.Struct && marshalerAttrType(ref) == 0 {
+			rclaims, err := schema(ref, visited)
+			if err != nil {
+				return nil, err
+			}
+			claims = append(claims, rclaims...)
 		}
 	}
-	return claims
+	return claims, nil
+}
+
+// Destruct destructures the records into claims about their entities, preceded by the
+// schema of their types. Records that are not structs or pointers to structs, or have
+// fields that cannot be recorded, are invalid.
+func Destruct(xs ...interface{}) ([]Claim, error) {
+	_, claims, err := destruct(true, nil, xs)
+	return claims, err
+}
+
+// DestructOnlyData destructures the records as Destruct, but without their schema.
+func DestructOnlyData(xs ...interface{}) ([]Claim, error) {
+	_, claims, err := destruct(false, nil, xs)
+	return claims, err
 }
 
-func Destruct(xs ...interface{}) []Claim {
-	return destruct(true, xs)
+// DestructRecords destructures the records as DestructOnlyData, also returning the refs to
+// the records' own entities, in order, e.g. to distinguish them from the entities to which
+// they refer.
+func DestructRecords(xs ...interface{}) ([]EWriteRef, []Claim, error) {
+	return destruct(false, nil, xs)
 }
 
-func DestructOnlyData(xs ...interface{}) []Claim {
-	return destruct(false, xs)
+// DestructEntity destructures the record as Destruct, but onto the given entity ref
+// unless the record has its own entity id, e.g. TxnID to make claims about the
+// transaction.
+func DestructEntity(e EWriteRef, x interface{}) ([]Claim, error) {
+	_, claims, err := destruct(true, e, []interface{}{x})
+	return claims, err
 }
 
-func destruct(schema bool, xs []interface{}) []Claim {
+// maxDepth is the greatest depth to which records' struct refs are followed.
+const maxDepth = 32
+
+// destructor destructures records, following their struct refs.
+type destructor struct {
+	depth int
+	// seen maps the pointers to structs that have been destructured to their entity refs,
+	// so that each is destructured once, even if the pointers form cycles.
+	seen map[uintptr]EWriteRef
+}
+
+// destruct destructures the records, which may be structs or pointers to structs, into
+// claims, including their schema if requested, and returns the refs to their entities.
+// Records without entity ids are given the entity ref e if given, or new tempids otherwise.
+func destruct(schema bool, e EWriteRef, xs []interface{}) ([]EWriteRef, []Claim, error) {
+	refs := make([]EWriteRef, 0, len(xs))
 	var claims []Claim
 	var types []reflect.Type
+	d := destructor{seen: map[uintptr]EWriteRef{}}
 	for _, x := range xs {
-		typ := reflect.TypeOf(x)
+		value := reflect.ValueOf(x)
+		var ptr uintptr
+		if value.Kind() == reflect.Ptr && !value.IsNil() {
+			ptr = value.Pointer()
+			value = value.Elem()
+		}
+		if value.Kind() != reflect.Struct {
+			return nil, nil, ErrInvalidRecord
+		}
+		typ := value.Type()
 		n := typ.NumField()
 		if claims == nil {
 			data := len(xs) * n
@@ -114,81 +384,320 @@ func destruct(schema bool, xs []interface{}) []Claim {
 				}
 			}
 			if !done {
-				claims = append(claims, Schema(typ)...)
+				sclaims, err := Schema(typ)
+				if err != nil {
+					return nil, nil, err
+				}
+				claims = append(claims, sclaims...)
 				types = append(types, typ)
 			}
 		}
-		var id ID
-		xclaims := make([]Claim, 0, n)
-		for i := 0; i < n; i++ {
-			fieldType := typ.Field(i)
-			attr := ParseAttrField(fieldType)
-			if attr.Ident == "" {
-				continue
+		ref, xclaims, err := d.record(value, e, ptr)
+		if err != nil {
+			return nil, nil, err
+		}
+		refs = append(refs, ref)
+		claims = append(claims, xclaims...)
+	}
+	return refs, claims, nil
+}
+
+// record destructures the struct value into claims about its entity, given by its entity
+// id if it has one, by e if given, or by a new tempid otherwise, followed by the claims
+// about the entities it refers to. If the value was given by pointer, ptr is the pointer.
+func (d *destructor) record(value reflect.Value, e EWriteRef, ptr uintptr) (ref EWriteRef, claims []Claim, err error) {
+	typ := value.Type()
+	fields, err := taggedFields(typ)
+	if err != nil {
+		return
+	}
+	for _, field := range fields {
+		if field.attr.Ident == sys.DbId {
+			id, err := idValue(value.FieldByIndex(field.Index))
+			if err != nil {
+				return nil, nil, fieldError(typ, field.StructField, err)
 			}
-			fieldValue := reflect.ValueOf(x).Field(i)
-			if attr.Ident == sys.DbId {
-				switch fieldType.Type.Kind() {
-				case reflect.Uint:
-					id = ID(fieldValue.Uint())
-				default:
-					// TODO error?
-				}
-				continue
+			if id != 0 {
+				ref = id
 			}
-			// TODO parseFieldValue?
-			var vref VRef
-			switch fieldType.Type.Kind() {
-			case reflect.Bool:
-				vref = Bool(fieldValue.Bool())
-			case reflect.Int:
-				vref = Int(fieldValue.Int())
-			case reflect.String:
-				vref = String(fieldValue.String())
-			case reflect.Struct:
-				v := fieldValue.Interface()
-				switch typed := v.(type) {
-				case time.Time:
-					vref = Inst(typed)
-				default:
-					xxclaims := destruct(schema, []interface{}{typed})
-					if len(xxclaims) == 0 {
-						panic("TODO do we assign a tempid to the ref or what")
-					}
-					switch ee := xclaims[0].E.(type) {
-					case ID:
-						vref = ee
-					case TempID:
-						vref = ee
-					default:
-						panic("TODO struct ref has an unexpected e type")
-					}
-				}
-			case reflect.Float64:
-				vref = Float(fieldValue.Float())
-			default:
-				// TODO error?
-				continue
+		}
+	}
+	if ref == nil {
+		ref = e
+	}
+	if ref == nil {
+		ref = NewTempID()
+	}
+	if ptr != 0 {
+		d.seen[ptr] = ref
+	}
+	xclaims := make([]Claim, 0, len(fields))
+	// elements holds the claims about list elements and referenced records, whose
+	// entities are their own.
+	var elements []Claim
+	for _, fieldType := range fields {
+		attr := fieldType.attr
+		if attr.Ident == sys.DbId {
+			continue
+		}
+		fieldValue := value.FieldByIndex(fieldType.Index)
+		if fieldType.list {
+			refs, claims, err := destructList(fieldType, fieldValue)
+			if err != nil {
+				return nil, nil, fieldError(typ, fieldType.StructField, err)
+			}
+			xclaims = append(xclaims, refs...)
+			elements = append(elements, claims...)
+			continue
+		}
+		if attr.Cardinality == sys.AttrCardinalityMany {
+			claims, err := destructMany(fieldType, fieldValue)
+			if err != nil {
+				return nil, nil, fieldError(typ, fieldType.StructField, err)
 			}
-			v, ok := vref.(Value)
-			if ok && attr.Unique != 0 && v.IsEmpty() {
+			xclaims = append(xclaims, claims...)
+			continue
+		}
+		var fieldPtr uintptr
+		if fieldValue.Kind() == reflect.Ptr {
+			if fieldValue.IsNil() {
+				xclaims = append(xclaims, Claim{A: attr.Ident, Retract: true})
 				continue
 			}
-			xclaims = append(xclaims, Claim{E: ID(0), A: attr.Ident, V: vref})
+			fieldPtr = fieldValue.Pointer()
+			fieldValue = fieldValue.Elem()
+		} else if fieldType.omitEmpty && fieldValue.IsZero() {
+			xclaims = append(xclaims, Claim{A: attr.Ident, Retract: true})
+			continue
 		}
-		if id != ID(0) {
-			for i := range xclaims {
-				xclaims[i].E = id
+		var vref VRef
+		if fieldType.convert == nil {
+			var rclaims []Claim
+			vref, rclaims, err = d.ref(fieldValue, fieldPtr)
+			if err != nil {
+				return nil, nil, fieldError(typ, fieldType.StructField, err)
 			}
+			if vref == nil {
+				continue
+			}
+			elements = append(elements, rclaims...)
 		} else {
-			symCount++
-			// TODO note we could use a different TempID type here and keep the whole string domain available to our callers
-			tempID := TempID(fmt.Sprintf("%d", symCount))
-			for i := range xclaims {
-				xclaims[i].E = tempID
+			vref, err = fieldType.convert(fieldValue)
+			if err != nil {
+				return nil, nil, fieldError(typ, fieldType.StructField, err)
 			}
 		}
-		claims = append(claims, xclaims...)
+		v, ok := vref.(Value)
+		if ok && attr.Unique != 0 && v.IsEmpty() {
+			continue
+		}
+		xclaims = append(xclaims, Claim{A: attr.Ident, V: vref})
+	}
+	for i := range xclaims {
+		xclaims[i].E = ref
+	}
+	claims = append(xclaims, elements...)
+	return
+}
+
+// ref destructures a record referred to by a struct field, returning the ref to its
+// entity and the claims about it. A record given by a pointer that has already been
+// destructured is not destructured again. A record that only identifies its entity, e.g.
+// Person{ID: id}, makes no claims about the rest of it. A record with neither an entity
+// id nor any nonzero attr fields is not referred to at all, so the ref is nil.
+func (d *destructor) ref(value reflect.Value, ptr uintptr) (vref VRef, claims []Claim, err error) {
+	if ptr != 0 {
+		if ref, ok := d.seen[ptr]; ok {
+			return ref.(VRef), nil, nil
+		}
+	}
+	vref, claims, ok, err := identify(value)
+	if err != nil {
+		return nil, nil, err
+	}
+	if ok && vref == nil {
+		return nil, nil, nil
+	}
+	if ok {
+		if ptr != 0 {
+			d.seen[ptr] = vref.(EWriteRef)
+		}
+		return vref, claims, nil
+	}
+	if d.depth >= maxDepth {
+		return nil, nil, ErrRecordDepth
+	}
+	d.depth++
+	ref, claims, err := d.record(value, nil, ptr)
+	d.depth--
+	if err != nil {
+		return nil, nil, err
+	}
+	return ref.(VRef), claims, nil
+}
+
+// identify returns the ref to the entity the record identifies if its only nonzero fields
+// are its entity id or its identity unique attrs. A record with an entity id resolves to
+// it, making no claims, while one with only identity attrs resolves to a tempid with only
+// their claims, which resolve it to the extant entity with those values, if any. A record
+// whose attr fields are all zero identifies nothing, so its ref is nil.
+func identify(value reflect.Value) (vref VRef, claims []Claim, ok bool, err error) {
+	typ := value.Type()
+	fields, err := taggedFields(typ)
+	if err != nil {
+		return
+	}
+	var id ID
+	var identities []taggedField
+	for _, field := range fields {
+		fieldValue := value.FieldByIndex(field.Index)
+		switch {
+		case field.attr.Ident == sys.DbId:
+			id, err = idValue(fieldValue)
+			if err != nil {
+				return nil, nil, false, fieldError(typ, field.StructField, err)
+			}
+		case fieldValue.IsZero():
+		case field.attr.Unique == sys.AttrUniqueIdentity && field.attr.Cardinality != sys.AttrCardinalityMany && !IsListField(field.StructField):
+			identities = append(identities, field)
+		default:
+			return nil, nil, false, nil
+		}
+	}
+	switch {
+	case id != 0:
+		return id, nil, true, nil
+	case len(identities) == 0:
+		return nil, nil, true, nil
+	}
+	e := NewTempID()
+	claims = make([]Claim, len(identities))
+	for i, field := range identities {
+		fieldValue := reflect.Indirect(value.FieldByIndex(field.Index))
+		v, err := field.convert(fieldValue)
+		if err != nil {
+			return nil, nil, false, fieldError(typ, field.StructField, err)
+		}
+		claims[i] = Claim{E: e, A: field.attr.Ident, V: v}
+	}
+	return e, claims, true, nil
+}
+
+// idValue returns the value of a sys/db/id field, which may be of any integer kind.
+func idValue(value reflect.Value) (ID, error) {
+	switch value.Kind() {
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		return ID(value.Uint()), nil
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		if value.Int() < 0 {
+			return 0, ErrAttrFieldOverflow
+		}
+		return ID(value.Int()), nil
 	}
-	return claims
+	return 0, ErrInvalidAttrField
+}
+
+// scalarValue returns the value of a bool, integer, string, float, or time.Time, or of a
+// named type based on one.
+func scalarValue(value reflect.Value) (Value, error) {
+	switch value.Kind() {
+	case reflect.Bool:
+		return Bool(value.Bool()), nil
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		return Int(value.Int()), nil
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		u := value.Uint()
+		if u > math.MaxInt64 {
+			return nil, ErrAttrFieldOverflow
+		}
+		return Int(u), nil
+	case reflect.String:
+		return String(value.String()), nil
+	case reflect.Float32, reflect.Float64:
+		return Float(value.Float()), nil
+	case reflect.Struct:
+		if t, ok := value.Interface().(time.Time); ok {
+			return Inst(t), nil
+		}
+	}
+	return nil, ErrInvalidAttrField
+}
+
+// destructMany returns the claims for a cardinality many field, without entities. A nil
+// field makes no claims. Otherwise, the values are claimed in order, after a claim to
+// retract any others.
+func destructMany(fieldType taggedField, field reflect.Value) ([]Claim, error) {
+	if field.IsNil() {
+		return nil, nil
+	}
+	attr, convert := fieldType.attr, fieldType.convert
+	if convert == nil {
+		return nil, ErrInvalidAttrField
+	}
+	var vrefs []VRef
+	switch field.Kind() {
+	case reflect.Slice:
+		vrefs = make([]VRef, 0, field.Len())
+		for i := 0; i < field.Len(); i++ {
+			vref, err := convert(field.Index(i))
+			if err != nil {
+				return nil, err
+			}
+			vrefs = append(vrefs, vref)
+		}
+	case reflect.Map:
+		vrefs = make([]VRef, 0, field.Len())
+		iter := field.MapRange()
+		for iter.Next() {
+			vref, err := convert(iter.Key())
+			if err != nil {
+				return nil, err
+			}
+			vrefs = append(vrefs, vref)
+		}
+		sort.Slice(vrefs, func(i, j int) bool {
+			return lessVRef(vrefs[i], vrefs[j])
+		})
+	}
+	claims := make([]Claim, 0, len(vrefs)+1)
+	claims = append(claims, Claim{A: attr.Ident, Retract: true})
+	for _, vref := range vrefs {
+		if v, ok := vref.(Value); ok && attr.Unique != 0 && v.IsEmpty() {
+			continue
+		}
+		claims = append(claims, Claim{A: attr.Ident, V: vref})
+	}
+	return claims, nil
+}
+
+// destructList returns the claims for a list field: the refs to its elements, without
+// entities, and the claims about the elements. A nil field makes no claims. Otherwise,
+// the refs are claimed after a claim to retract any others. Elements resolve by position
+// to the extant elements, so a rewrite only changes the values at positions that differ.
+func destructList(fieldType taggedField, field reflect.Value) (refs []Claim, elements []Claim, err error) {
+	if field.IsNil() {
+		return
+	}
+	attr, convert := fieldType.attr, fieldType.convert
+	if convert == nil {
+		return nil, nil, ErrInvalidAttrField
+	}
+	position, value := ListAttrIdents(attr.Ident)
+	n := field.Len()
+	refs = make([]Claim, 0, n+1)
+	refs = append(refs, Claim{A: attr.Ident, Retract: true})
+	elements = make([]Claim, 0, 2*n)
+	for i := 0; i < n; i++ {
+		vref, err := convert(field.Index(i))
+		if err != nil {
+			return nil, nil, err
+		}
+		e := NewTempID()
+		refs = append(refs, Claim{A: attr.Ident, V: e})
+		elements = append(elements,
+			Claim{E: e, A: position, V: Int(i)},
+			Claim{E: e, A: value, V: vref},
+		)
+	}
+	return
 }
@@ -1,12 +1,16 @@
 package destruct
 
 import (
+	"errors"
+	"fmt"
 	"reflect"
 	"testing"
 
+	"github.com/dball/constructive/internal/database"
 	"github.com/dball/constructive/pkg/sys"
 	. "github.com/dball/constructive/pkg/types"
 	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
 )
 
 type Person struct {
@@ -20,7 +24,8 @@ type Person struct {
 func Test_Schema(t *testing.T) {
 	symCount = 0
 	p := Person{}
-	claims := Schema(reflect.TypeOf(p))
+	claims, err := Schema(reflect.TypeOf(p))
+	require.NoError(t, err)
 	expected := []Claim{
 		{E: TempID("1"), A: sys.DbIdent, V: String("person/name")},
 		{E: TempID("1"), A: sys.AttrType, V: sys.AttrTypeString},
@@ -36,11 +41,152 @@ func Test_Schema(t *testing.T) {
 	assert.Equal(t, expected, claims)
 }
 
+type Member struct {
+	Name   string              `attr:"member/name,identity"`
+	Emails []string            `attr:"member/emails"`
+	Roles  map[string]struct{} `attr:"member/roles"`
+}
+
+func Test_SchemaMany(t *testing.T) {
+	symCount = 0
+	claims, err := Schema(reflect.TypeOf(Member{}))
+	require.NoError(t, err)
+	expected := []Claim{
+		{E: TempID("1"), A: sys.DbIdent, V: String("member/name")},
+		{E: TempID("1"), A: sys.AttrType, V: sys.AttrTypeString},
+		{E: TempID("1"), A: sys.AttrUnique, V: sys.AttrUniqueIdentity},
+		{E: TempID("2"), A: sys.DbIdent, V: String("member/emails")},
+		{E: TempID("2"), A: sys.AttrType, V: sys.AttrTypeString},
+		{E: TempID("2"), A: sys.AttrCardinality, V: sys.AttrCardinalityMany},
+		{E: TempID("3"), A: sys.DbIdent, V: String("member/roles")},
+		{E: TempID("3"), A: sys.AttrType, V: sys.AttrTypeString},
+		{E: TempID("3"), A: sys.AttrCardinality, V: sys.AttrCardinalityMany},
+	}
+	assert.Equal(t, expected, claims)
+}
+
+type Playlist struct {
+	Tracks []string `attr:"playlist/tracks,list"`
+}
+
+func Test_SchemaList(t *testing.T) {
+	symCount = 0
+	claims, err := Schema(reflect.TypeOf(Playlist{}))
+	require.NoError(t, err)
+	expected := []Claim{
+		{E: TempID("1"), A: sys.DbIdent, V: String("playlist/tracks")},
+		{E: TempID("1"), A: sys.AttrType, V: sys.AttrTypeRef},
+		{E: TempID("1"), A: sys.AttrCardinality, V: sys.AttrCardinalityMany},
+		{E: TempID("1"), A: sys.AttrRefType, V: sys.AttrRefTypeComponent},
+		{E: TempID("1"), A: sys.AttrRefTypeComponentKey, V: TempID("2")},
+		{E: TempID("2"), A: sys.DbIdent, V: String("playlist/tracks/position")},
+		{E: TempID("2"), A: sys.AttrType, V: sys.AttrTypeInt},
+		{E: TempID("3"), A: sys.DbIdent, V: String("playlist/tracks/value")},
+		{E: TempID("3"), A: sys.AttrType, V: sys.AttrTypeString},
+	}
+	assert.Equal(t, expected, claims)
+}
+
+func Test_ParseAttrFieldKinds(t *testing.T) {
+	type Cents int64
+	type Numbers struct {
+		Small  int8    `attr:"n/small"`
+		Count  uint16  `attr:"n/count"`
+		Amount Cents   `attr:"n/amount"`
+		Ratio  float32 `attr:"n/ratio"`
+	}
+	typ := reflect.TypeOf(Numbers{})
+	for i, expected := range []ID{sys.AttrTypeInt, sys.AttrTypeInt, sys.AttrTypeInt, sys.AttrTypeFloat} {
+		attr, err := ParseAttrField(typ.Field(i))
+		require.NoError(t, err)
+		assert.Equal(t, expected, attr.Type)
+	}
+}
+
+func Test_ParseAttrFieldInvalid(t *testing.T) {
+	type Invalid struct {
+		Ch     chan int            `attr:"x/ch"`
+		Counts map[string]int      `attr:"x/counts"`
+		Refs   []Person            `attr:"x/refs"`
+		Points []Person            `attr:"x/points,list"`
+		Funcs  func()              `attr:"x/funcs"`
+		Nested map[Person]struct{} `attr:"x/nested"`
+	}
+	typ := reflect.TypeOf(Invalid{})
+	for i := 0; i < typ.NumField(); i++ {
+		_, err := ParseAttrField(typ.Field(i))
+		assert.ErrorIs(t, err, ErrInvalidAttrField, typ.Field(i).Name)
+	}
+}
+
+type Team struct {
+	Name   string  `attr:"team/name,identity"`
+	Lead   Person  `attr:"team/lead"`
+	Backup *Person `attr:"team/backup"`
+	Parent *Team   `attr:"team/parent"`
+}
+
+func Test_SchemaRefs(t *testing.T) {
+	claims, err := Schema(reflect.TypeOf(Team{}))
+	require.NoError(t, err)
+	idents := []Value{}
+	for _, claim := range claims {
+		if claim.A == sys.DbIdent {
+			idents = append(idents, claim.V.(Value))
+		}
+	}
+	expected := []Value{
+		String("team/name"), String("team/lead"),
+		String("person/name"), String("person/uuid"), String("person/age"), String("person/active"),
+		String("team/backup"), String("team/parent"),
+	}
+	assert.Equal(t, expected, idents)
+}
+
+type Stamped struct {
+	Author string `attr:"author"`
+}
+
+type Note struct {
+	_    struct{} `namespace:"note"`
+	Text string   `attr:"text"`
+	Stamped
+	Tag string `attr:"tag/name"`
+}
+
+func Test_SchemaEmbedded(t *testing.T) {
+	symCount = 0
+	claims, err := Schema(reflect.TypeOf(Note{}))
+	require.NoError(t, err)
+	idents := []Value{}
+	for _, claim := range claims {
+		if claim.A == sys.DbIdent {
+			idents = append(idents, claim.V.(Value))
+		}
+	}
+	assert.Equal(t, []Value{String("note/text"), String("note/author"), String("tag/name")}, idents)
+	claims, err = DestructOnlyData(Note{Text: "hi", Stamped: Stamped{Author: "ada"}, Tag: "x"})
+	require.NoError(t, err)
+	expected := []Claim{
+		{E: TempID("4"), A: Ident("note/text"), V: String("hi")},
+		{E: TempID("4"), A: Ident("note/author"), V: String("ada")},
+		{E: TempID("4"), A: Ident("tag/name"), V: String("x")},
+	}
+	assert.Equal(t, expected, claims)
+}
+
+func Test_ParseAttrTag(t *testing.T) {
+	assert.Equal(t, Attr{Ident: "person/uuid", Unique: sys.AttrUniqueIdentity}, ParseAttrTag("person/uuid,identity"))
+	assert.Equal(t, Attr{Ident: "person/pet", RefType: sys.AttrRefTypeComponent}, ParseAttrTag("person/pet,component"))
+	assert.Equal(t, Attr{Ident: "person/pet", Unique: sys.AttrUniqueValue, RefType: sys.AttrRefTypeComponent}, ParseAttrTag("person/pet,unique,component"))
+}
+
 func Test_Destruct(t *testing.T) {
 	symCount = 0
 	t.Run("identified person", func(t *testing.T) {
 		p := Person{ID: 1, Name: "Donald", Age: 46, Active: true}
-		claims := DestructOnlyData(p)
+		claims, err := DestructOnlyData(p)
+		require.NoError(t, err)
 		expected := []Claim{
 			{E: ID(1), A: Ident("person/name"), V: String("Donald")},
 			{E: ID(1), A: Ident("person/age"), V: Int(46)},
@@ -50,7 +196,8 @@ func Test_Destruct(t *testing.T) {
 	})
 	t.Run("unidentified person", func(t *testing.T) {
 		p := Person{Name: "Donald", Age: 46, Active: true}
-		claims := DestructOnlyData(p)
+		claims, err := DestructOnlyData(p)
+		require.NoError(t, err)
 		expected := []Claim{
 			{E: TempID("1"), A: Ident("person/name"), V: String("Donald")},
 			{E: TempID("1"), A: Ident("person/age"), V: Int(46)},
@@ -58,4 +205,230 @@ func Test_Destruct(t *testing.T) {
 		}
 		assert.Equal(t, expected, claims)
 	})
+	t.Run("person onto entity", func(t *testing.T) {
+		p := Person{Name: "Donald"}
+		claims, err := DestructEntity(TxnID{}, p)
+		require.NoError(t, err)
+		assert.Contains(t, claims, Claim{E: TxnID{}, A: Ident("person/name"), V: String("Donald")})
+		assert.Contains(t, claims, Claim{E: TempID("2"), A: sys.DbIdent, V: String("person/name")})
+	})
+	t.Run("member", func(t *testing.T) {
+		m := Member{Name: "Ada", Emails: []string{"b", "a"}, Roles: map[string]struct{}{"editor": {}, "admin": {}}}
+		claims, err := DestructOnlyData(m)
+		require.NoError(t, err)
+		expected := []Claim{
+			{E: TempID("6"), A: Ident("member/name"), V: String("Ada")},
+			{E: TempID("6"), A: Ident("member/emails"), Retract: true},
+			{E: TempID("6"), A: Ident("member/emails"), V: String("b")},
+			{E: TempID("6"), A: Ident("member/emails"), V: String("a")},
+			{E: TempID("6"), A: Ident("member/roles"), Retract: true},
+			{E: TempID("6"), A: Ident("member/roles"), V: String("admin")},
+			{E: TempID("6"), A: Ident("member/roles"), V: String("editor")},
+		}
+		assert.Equal(t, expected, claims)
+		claims, err = DestructOnlyData(Member{Name: "Ada"})
+		require.NoError(t, err)
+		assert.Len(t, claims, 1)
+	})
+	t.Run("playlist", func(t *testing.T) {
+		claims, err := DestructOnlyData(Playlist{Tracks: []string{"b", "a"}})
+		require.NoError(t, err)
+		expected := []Claim{
+			{E: TempID("8"), A: Ident("playlist/tracks"), Retract: true},
+			{E: TempID("8"), A: Ident("playlist/tracks"), V: TempID("9")},
+			{E: TempID("8"), A: Ident("playlist/tracks"), V: TempID("10")},
+			{E: TempID("9"), A: Ident("playlist/tracks/position"), V: Int(0)},
+			{E: TempID("9"), A: Ident("playlist/tracks/value"), V: String("b")},
+			{E: TempID("10"), A: Ident("playlist/tracks/position"), V: Int(1)},
+			{E: TempID("10"), A: Ident("playlist/tracks/value"), V: String("a")},
+		}
+		assert.Equal(t, expected, claims)
+	})
+	t.Run("optional fields", func(t *testing.T) {
+		type Optional struct {
+			ID   uint   `attr:"sys/db/id"`
+			Age  *int   `attr:"person/age"`
+			Name string `attr:"person/name,omitempty"`
+		}
+		age := 0
+		claims, err := DestructOnlyData(Optional{ID: 1, Age: &age})
+		require.NoError(t, err)
+		expected := []Claim{
+			{E: ID(1), A: Ident("person/age"), V: Int(0)},
+			{E: ID(1), A: Ident("person/name"), Retract: true},
+		}
+		assert.Equal(t, expected, claims)
+		claims, err = DestructOnlyData(Optional{ID: 1, Name: "Donald"})
+		require.NoError(t, err)
+		expected = []Claim{
+			{E: ID(1), A: Ident("person/age"), Retract: true},
+			{E: ID(1), A: Ident("person/name"), V: String("Donald")},
+		}
+		assert.Equal(t, expected, claims)
+	})
+	t.Run("struct refs", func(t *testing.T) {
+		symCount = 0
+		team := Team{Name: "red", Lead: Person{ID: 7}, Backup: &Person{Name: "Leah"}}
+		team.Parent = &team
+		claims, err := DestructOnlyData(team)
+		require.NoError(t, err)
+		expected := []Claim{
+			{E: TempID("1"), A: Ident("team/name"), V: String("red")},
+			{E: TempID("1"), A: Ident("team/lead"), V: ID(7)},
+			{E: TempID("1"), A: Ident("team/backup"), V: TempID("2")},
+			{E: TempID("1"), A: Ident("team/parent"), V: TempID("3")},
+			{E: TempID("2"), A: Ident("person/name"), V: String("Leah")},
+			{E: TempID("2"), A: Ident("person/age"), V: Int(0)},
+			{E: TempID("2"), A: Ident("person/active"), V: Bool(false)},
+			{E: TempID("3"), A: Ident("team/name"), V: String("red")},
+			{E: TempID("3"), A: Ident("team/lead"), V: ID(7)},
+			{E: TempID("3"), A: Ident("team/backup"), V: TempID("2")},
+			{E: TempID("3"), A: Ident("team/parent"), V: TempID("3")},
+		}
+		assert.Equal(t, expected, claims)
+	})
+	t.Run("struct refs by identity", func(t *testing.T) {
+		symCount = 0
+		claims, err := DestructOnlyData(Team{Name: "red", Lead: Person{UUID: "ada"}})
+		require.NoError(t, err)
+		expected := []Claim{
+			{E: TempID("1"), A: Ident("team/name"), V: String("red")},
+			{E: TempID("1"), A: Ident("team/lead"), V: TempID("2")},
+			{E: TempID("1"), A: Ident("team/backup"), Retract: true},
+			{E: TempID("1"), A: Ident("team/parent"), Retract: true},
+			{E: TempID("2"), A: Ident("person/uuid"), V: String("ada")},
+		}
+		assert.Equal(t, expected, claims)
+	})
+	t.Run("zero struct refs", func(t *testing.T) {
+		symCount = 0
+		claims, err := DestructOnlyData(Team{Name: "red", Backup: &Person{}})
+		require.NoError(t, err)
+		expected := []Claim{
+			{E: TempID("1"), A: Ident("team/name"), V: String("red")},
+			{E: TempID("1"), A: Ident("team/parent"), Retract: true},
+		}
+		assert.Equal(t, expected, claims)
+	})
+}
+
+// Broken is a value marshaler that fails to marshal.
+type Broken struct{}
+
+var errBroken = errors.New("broken")
+
+func (Broken) AttrType() ID                { return sys.AttrTypeString }
+func (Broken) MarshalValue() (VRef, error) { return nil, errBroken }
+
+func Test_DestructErrors(t *testing.T) {
+	t.Run("not structs", func(t *testing.T) {
+		for _, x := range []interface{}{nil, 7, "person", (*Person)(nil), []Person{}} {
+			_, err := Destruct(x)
+			assert.ErrorIs(t, err, ErrInvalidRecord)
+		}
+	})
+	t.Run("invalid field", func(t *testing.T) {
+		type Invalid struct {
+			Counts map[string]int `attr:"x/counts"`
+		}
+		_, err := Destruct(Invalid{})
+		assert.ErrorIs(t, err, ErrInvalidAttrField)
+		assert.Contains(t, err.Error(), "Invalid.Counts")
+	})
+	t.Run("overflow", func(t *testing.T) {
+		type Big struct {
+			ID    int    `attr:"sys/db/id"`
+			Count uint64 `attr:"x/count"`
+		}
+		_, err := DestructOnlyData(Big{Count: 1 << 63})
+		assert.ErrorIs(t, err, ErrAttrFieldOverflow)
+		_, err = DestructOnlyData(Big{ID: -1})
+		assert.ErrorIs(t, err, ErrAttrFieldOverflow)
+	})
+	t.Run("marshaler", func(t *testing.T) {
+		type Wrapper struct {
+			Value Broken `attr:"x/value"`
+		}
+		_, err := DestructOnlyData(Wrapper{})
+		assert.ErrorIs(t, err, errBroken)
+	})
+	t.Run("depth", func(t *testing.T) {
+		team := &Team{Name: "0"}
+		for i := 1; i <= maxDepth+2; i++ {
+			team = &Team{Name: fmt.Sprint(i), Parent: team}
+		}
+		_, err := DestructOnlyData(team)
+		assert.Equal(t, ErrRecordDepth, err)
+	})
+}
+
+func Test_TaggedFieldConverters(t *testing.T) {
+	type Record struct {
+		ID     uint         `attr:"sys/db/id"`
+		Name   *string      `attr:"x/name"`
+		Tags   []string     `attr:"x/tags"`
+		Counts []uint       `attr:"x/counts,list"`
+		Value  Broken       `attr:"x/value"`
+		Lead   Person       `attr:"x/lead"`
+		Backup *Person      `attr:"x/backup"`
+		Labels map[int]Void `attr:"x/labels"`
+	}
+	fields, err := taggedFields(reflect.TypeOf(Record{}))
+	require.NoError(t, err)
+	byName := map[string]taggedField{}
+	for _, field := range fields {
+		byName[field.Name] = field
+	}
+	vref, err := byName["Name"].convert(reflect.ValueOf("ada"))
+	require.NoError(t, err)
+	assert.Equal(t, String("ada"), vref)
+	vref, err = byName["Tags"].convert(reflect.ValueOf("x"))
+	require.NoError(t, err)
+	assert.Equal(t, String("x"), vref)
+	_, err = byName["Counts"].convert(reflect.ValueOf(uint(1 << 63)))
+	assert.ErrorIs(t, err, ErrAttrFieldOverflow)
+	vref, err = byName["Labels"].convert(reflect.ValueOf(7))
+	require.NoError(t, err)
+	assert.Equal(t, Int(7), vref)
+	assert.True(t, byName["Value"].marshaler)
+	_, err = byName["Value"].convert(reflect.ValueOf(Broken{}))
+	assert.ErrorIs(t, err, errBroken)
+	assert.Nil(t, byName["Lead"].convert)
+	assert.Nil(t, byName["Backup"].convert)
+}
+
+func Test_ParseAttrFieldsVersions(t *testing.T) {
+	type Versioned struct {
+		Name string `attr:"versioned/name"`
+	}
+	typ := reflect.TypeOf(Versioned{})
+	conn := database.OpenConnection()
+	schema, err := Schema(typ)
+	require.NoError(t, err)
+	_, err = conn.Write(Request{Claims: schema})
+	require.NoError(t, err)
+	before := conn.Read()
+	_, err = conn.Write(Request{Claims: []Claim{
+		{E: TempID("x"), A: sys.DbIdent, V: String("versioned/other")},
+		{E: TempID("x"), A: sys.AttrType, V: sys.AttrTypeString},
+	}})
+	require.NoError(t, err)
+	after := conn.Read()
+	require.NotEqual(t, before.SchemaVersion(), after.SchemaVersion())
+
+	var versions []SchemaVersion
+	for i := 0; i < 2; i++ {
+		for _, db := range []Database{before, after} {
+			attrs, err := parseAttrFields(typ, db)
+			require.NoError(t, err)
+			assert.Equal(t, db.AttrByIdent("versioned/name").ID, attrs.fields[db.AttrByIdent("versioned/name").ID].attr.ID)
+		}
+		cached, ok := attrStructs.Load(typ)
+		require.True(t, ok)
+		versions = versions[:0]
+		for _, c := range cached.([]cachedAttrStruct) {
+			versions = append(versions, c.version)
+		}
+		assert.ElementsMatch(t, []SchemaVersion{before.SchemaVersion(), after.SchemaVersion()}, versions)
+	}
 }
@@ -2,6 +2,7 @@ package types
 
 import (
 	"errors"
+	"fmt"
 	"time"
 
 	"github.com/dball/constructive/internal/iterator"
@@ -19,6 +20,13 @@ type Datum struct {
 	T ID
 }
 
+// Change is a datum as asserted or retracted in the transaction T.
+type Change struct {
+	Datum
+	// Added is true if the datum was asserted and false if it was retracted.
+	Added bool
+}
+
 // IDs are issued by the system and never reused.
 type ID uint64
 
@@ -36,6 +44,11 @@ type Attr struct {
 	Cardinality ID `attr:"sys/attr/cardinality"`
 	// Unique specifies the uniqueness of the attribute's value.
 	Unique ID `attr:"sys/db/unique"`
+	// RefType qualifies the type of reference of a ref attribute.
+	RefType ID `attr:"sys/attr/ref/type"`
+	// ComponentKey identifies the attribute by which the components of a cardinality many
+	// component ref attribute are matched when their parent is asserted anew.
+	ComponentKey ID `attr:"sys/attr/ref/type/component/key"`
 }
 
 // Value is an immutable scalar.
@@ -110,8 +123,20 @@ type Claim struct {
 	A       ARef
 	V       VRef
 	Retract bool
+	// CAS, if true, rejects the claim unless Expect is a current value of the attribute
+	// on the entity, or, if Expect is nil, unless the entity has no value for the attribute.
+	// For cardinality many attributes, the expected value is retracted.
+	CAS    bool
+	Expect VRef
+	// Fn, if given, identifies a registered transaction function which is invoked with
+	// this claim and whose claims are applied in its stead.
+	Fn Ident
 }
 
+// TxFn is a transaction function. It is given the database as it stands within the
+// transaction and the claim invoking it, and returns the claims to apply in its stead.
+type TxFn func(db Database, claim Claim) ([]Claim, error)
+
 // EReadRef is a value that may resolve to a system id when reading from the database.
 type EReadRef interface {
 	IsEReadRef()
@@ -153,8 +178,18 @@ func (Bool) IsVRef()   {}
 func (Inst) IsVRef()   {}
 func (Float) IsVRef()  {}
 func (TempID) IsVRef() {}
+func (Ident) IsVRef()  {}
+
+// TODO LookupRef as another vref type?
 
-// TODO LookupRef as another vref type? How about Ident?
+// TRef is a value that may resolve to a transaction id within a database. An Inst
+// resolves to the last transaction recorded at or before that instant.
+type TRef interface {
+	IsTRef()
+}
+
+func (ID) IsTRef()   {}
+func (Inst) IsTRef() {}
 
 // Transaction is the result of successfully applying a request to the database.
 type Transaction struct {
@@ -166,6 +201,37 @@ type Transaction struct {
 	Database Database
 }
 
+// TxReport reports a transaction accepted by a connection.
+type TxReport struct {
+	// ID is the transaction's id.
+	ID ID
+	// DbBefore is a snapshot of the database immediately before the transaction.
+	DbBefore Database
+	// DbAfter is a snapshot of the database immediately after the transaction.
+	DbAfter Database
+	// Changes are the datums asserted and retracted by the transaction, in order. The T
+	// of a retracted datum is the transaction.
+	Changes []Change
+}
+
+// TxFilter narrows the changes in the transaction reports delivered to a subscription.
+// The zero filter narrows nothing.
+type TxFilter struct {
+	// Attrs, if given, narrows the changes to those about these attrs.
+	Attrs []Ident
+	// Entities, if given, narrows the changes to those about these entities.
+	Entities []ID
+}
+
+// BulkLoader loads claims into a connection in a single transaction, more quickly than
+// writing them would, with some restrictions.
+type BulkLoader interface {
+	// Add adds claims to the load.
+	Add(claims ...Claim) error
+	// Load completes the load and returns its transaction.
+	Load() (Transaction, error)
+}
+
 // Request is a request to record claims in the database.
 type Request struct {
 	Claims []Claim
@@ -179,9 +245,52 @@ type Database interface {
 	ResolveEReadRef(eref EReadRef) ID
 	ResolveARef(aref ARef) ID
 	ResolveLookupRef(ref LookupRef) ID
+	// AsOf returns a view of the database as it was immediately after the given transaction.
+	AsOf(t TRef) Database
+	// Since returns a view of the database including only the current datums asserted after
+	// the given transaction.
+	Since(t TRef) Database
+	// History returns a view of every datum ever asserted or retracted in the database.
+	History() HistoryDatabase
+	// With returns the transaction that would result from applying the request to the
+	// database, without changing the database or its connection.
+	With(request Request) (Transaction, error)
+	Dump() interface{}
+	// SchemaVersion returns the version of the database's schema.
+	SchemaVersion() SchemaVersion
+	// Watch delivers the datums matching the selection in the database, then again whenever
+	// a transaction subsequently written to its connection changes them, returning a
+	// function that cancels the watch. A watcher that falls behind receives only the latest
+	// results.
+	Watch(sel Selection) (results <-chan []Datum, cancel func())
+}
+
+// HistoryDatabase is a read-only view of every datum ever asserted or retracted in a
+// database, whose selections yield Changes instead of Datums.
+type HistoryDatabase interface {
+	// Select selects the assertions and retractions of the datums matching the selection,
+	// in the order of the datums and then of their transactions.
+	Select(selection Selection) *iterator.Iterator
+	AttrByID(id ID) Attr
+	AttrByIdent(ident Ident) Attr
+	ResolveEReadRef(eref EReadRef) ID
+	ResolveARef(aref ARef) ID
+	// AsOf returns a view of the changes made in or before the given transaction.
+	AsOf(t TRef) HistoryDatabase
+	// Since returns a view of the changes made after the given transaction.
+	Since(t TRef) HistoryDatabase
 	Dump() interface{}
 }
 
+// SchemaVersion identifies a version of a database's schema. Databases with equal schema
+// versions have the same attrs.
+type SchemaVersion struct {
+	// Schema identifies the schema, which the databases of a connection share.
+	Schema interface{}
+	// Version counts the changes to the schema.
+	Version uint64
+}
+
 // IndexType is the type of index being used to store or query datums.
 type IndexType int
 
@@ -192,7 +301,9 @@ const (
 	IndexAEV IndexType = 2
 	// IndexAVE indexes datums by unique attribute id, then value, then entity. Non-unique attributes do not appear in this index.
 	IndexAVE IndexType = 3
-	// TODO IndexVAE for ref types would give us backwards references, almost certainly good and useful.
+	// IndexVAE indexes ref datums by value, then attribute id, then entity, giving the references
+	// to an entity. Datums of other attributes do not appear in this index.
+	IndexVAE IndexType = 4
 )
 
 // Selection is a simple database query, where the constraints are scalars, scalar ranges, or sets of constraints.
@@ -281,6 +392,18 @@ type Connection interface {
 	Read() Database
 	Write(request Request) (Transaction, error)
 	SetClock(clock Clock)
+	// Register registers a transaction function under a user ident.
+	Register(ident Ident, fn TxFn) error
+	// Listen calls the listener with a report of each transaction subsequently written,
+	// returning a function that stops the listener. Listeners must not write to the
+	// connection, nor start or stop listeners, subscriptions, or watches.
+	Listen(listener func(TxReport)) (stop func())
+	// Subscribe delivers the reports of the transactions subsequently written with changes
+	// matching the filter, returning a function that cancels the subscription. A subscriber
+	// that falls so far behind that its channel fills is ended, closing the channel.
+	Subscribe(filter TxFilter) (reports <-chan TxReport, cancel func())
+	// BulkLoader begins a bulk load into the connection.
+	BulkLoader() BulkLoader
 }
 
 // ValueOf converts a value to a Value, if possible.
@@ -321,6 +444,29 @@ func VSelValue(v Value) (vsel VSel) {
 	return
 }
 
+// TxError reports the rejection of a claim in a request.
+type TxError struct {
+	// Index is the index of the rejected claim in the request. Claims returned by
+	// transaction functions are reported at the index of the invoking claim.
+	Index int
+	// Claim is the rejected claim.
+	Claim Claim
+	// Datum is the datum to which the claim resolved, as far as it resolved.
+	Datum Datum
+	// Attr is the ident of the claim's attribute, if known.
+	Attr Ident
+	// Err is the reason the claim was rejected.
+	Err error
+}
+
+func (err *TxError) Error() string {
+	return fmt.Sprintf("claim %d about %s rejected: %s", err.Index, err.Attr, err.Err)
+}
+
+func (err *TxError) Unwrap() error {
+	return err.Err
+}
+
 //// The system runtime errors.
 
 var ErrInvalidValue error = errors.New("invalid value")
@@ -332,3 +478,20 @@ var ErrAttrCardinalityChange error = errors.New("attr cardinality may not change
 var ErrInvalidAttr error = errors.New("invalid datum attr")
 var ErrInvalidAttrUnique error = errors.New("attr uniqueness must be identity or value")
 var ErrInvalidAttrType error = errors.New("attr type must be valid")
+var ErrInvalidAttrRefType error = errors.New("attr ref type must be component and only for ref attrs")
+var ErrAttrRefTypeChange error = errors.New("attr ref type may not change")
+var ErrAttrComponentKeyChange error = errors.New("attr component key may not change")
+var ErrComponentCycle error = errors.New("component refs may not form cycles")
+var ErrWriteToView error = errors.New("database views may not be written")
+var ErrCASFailed error = errors.New("compare-and-swap expected value is not current")
+var ErrUnknownTxFn error = errors.New("transaction function is not registered")
+var ErrTxFnDepth error = errors.New("transaction functions are nested too deeply")
+var ErrTempIDConflict error = errors.New("tempid resolves to more than one entity")
+var ErrBulkClaim error = errors.New("bulk loads may only assert values")
+var ErrConcurrentWrite error = errors.New("connection was written during the bulk load")
+var ErrBulkLoadDone error = errors.New("bulk load is done")
+var ErrInvalidRecord error = errors.New("records must be structs or pointers to structs")
+var ErrInvalidAttrField error = errors.New("attr field type is not valid")
+var ErrAttrFieldOverflow error = errors.New("attr field value overflows")
+var ErrRecordDepth error = errors.New("records are nested too deeply")
+var ErrStructRefCycle error = errors.New("struct refs form a cycle")